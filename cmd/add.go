@@ -0,0 +1,88 @@
+/*
+Copyright © 2025 Matt Krueger <mkrueger@rstms.net>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/rstms/iplsd/scanner"
+	"github.com/spf13/cobra"
+)
+
+var addCmd = &cobra.Command{
+	Use:   "add IP_ADDRESS",
+	Short: "add an address to the watchlist",
+	Long: `
+Add IP_ADDRESS to the watchlist with the configured timeout, writing its
+timeout file and running the add command, exactly as a pattern match
+would.  Commands are run immediately even when flush-interval is set.
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		addr := parseAddressArg(args[0])
+		s := newManualScanner()
+		defer s.Close()
+		action, err := s.Add(addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "%s %s %s\n", addr, action, s.AddressFile)
+	},
+}
+
+// return the argument if it is an IP address, exiting otherwise
+func parseAddressArg(arg string) string {
+	if !scanner.ValidAddress(arg) {
+		log.Fatalf("invalid IP address '%s'", arg)
+	}
+	return arg
+}
+
+// construct a scanner for manual changes and one-shot scans; its goroutines are never started,
+// so the caller closes it to release the timeout directory
+func newManualScanner() *scanner.Scanner {
+	ViperSet("flush_interval", "")
+	s, err := scanner.NewScanner(
+		ViperGetString("monitored_file"),
+		ViperGetString("address_file"),
+		ViperGetString("timeout_dir"),
+		ViperGetStringSlice("regex"),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return s
+}
+
+func init() {
+	rootCmd.AddCommand(addCmd)
+}
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rstms/iplsd/scanner"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddRemove(t *testing.T) {
+	initTestConfig(t)
+	seedWatchlist(t)
+	ViperSet("timeout_seconds", "3600")
+	ViperSet("interval_seconds", "60")
+	timeoutDir := ViperGetString("timeout_dir")
+	var out bytes.Buffer
+	addCmd.SetOut(&out)
+	defer addCmd.SetOut(nil)
+	removeCmd.SetOut(&out)
+	defer removeCmd.SetOut(nil)
+
+	addCmd.Run(addCmd, []string{"198.51.100.7"})
+	require.Contains(t, out.String(), "198.51.100.7 added to")
+	addrs, err := scanner.ReadAddressFile(ViperGetString("address_file"))
+	require.Nil(t, err)
+	require.Contains(t, addrs, "198.51.100.7")
+	timeouts, err := scanner.ReadTimeouts(timeoutDir)
+	require.Nil(t, err)
+	found := false
+	for _, timeout := range timeouts {
+		if timeout.Address == "198.51.100.7" {
+			found = true
+			require.InDelta(t, time.Hour, time.Until(timeout.Expiration), float64(time.Minute))
+		}
+	}
+	require.True(t, found)
+
+	out.Reset()
+	removeCmd.Run(removeCmd, []string{"198.51.100.7"})
+	require.Contains(t, out.String(), "198.51.100.7 deleted from")
+	addrs, err = scanner.ReadAddressFile(ViperGetString("address_file"))
+	require.Nil(t, err)
+	require.NotContains(t, addrs, "198.51.100.7")
+	_, err = os.Stat(filepath.Join(timeoutDir, "198.51.100.7"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestFlush(t *testing.T) {
+	initTestConfig(t)
+	seedWatchlist(t)
+	timeoutDir := ViperGetString("timeout_dir")
+	dir := t.TempDir()
+	output := filepath.Join(dir, "output")
+	script := filepath.Join(dir, "delete")
+	require.Nil(t, os.WriteFile(script, []byte("#!/bin/sh\necho \"$IPLSD_EVENT $1\" >> "+output+"\n"), 0700))
+	ViperSet("delete_command", script)
+	defer ViperSet("delete_command", "")
+	// the released record of an expired address is flushed too
+	data, err := json.Marshal(scanner.TimeoutRecord{Address: "198.51.100.9", Expiration: time.Now(), Strikes: 1, Released: true})
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(filepath.Join(timeoutDir, "198.51.100.9"), data, 0600))
+	var out bytes.Buffer
+	flushCmd.SetOut(&out)
+	defer flushCmd.SetOut(nil)
+
+	flushCmd.Run(flushCmd, []string{})
+	require.Contains(t, out.String(), "3 addresses flushed from")
+	addrs, err := scanner.ReadAddressFile(ViperGetString("address_file"))
+	require.Nil(t, err)
+	require.Empty(t, addrs)
+	timeouts, err := scanner.ReadTimeouts(timeoutDir)
+	require.Nil(t, err)
+	require.Empty(t, timeouts)
+	data, err = os.ReadFile(output)
+	require.Nil(t, err)
+	require.Equal(t, "delete 192.0.2.1\ndelete 192.0.2.2\ndelete 192.0.2.3\n", string(data))
+}
@@ -0,0 +1,29 @@
+package cmd
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheck(t *testing.T) {
+	seedWatchlist(t)
+	defer initTestConfig(t)
+
+	viper.SetConfigFile("testdata/check_good.yaml")
+	require.Nil(t, viper.ReadInConfig())
+	var out bytes.Buffer
+	require.Nil(t, checkConfig(&out))
+	require.Equal(t, "configuration OK\n", out.String())
+
+	viper.SetConfigFile("testdata/check_bad.yaml")
+	require.Nil(t, viper.ReadInConfig())
+	out.Reset()
+	err := checkConfig(&out)
+	require.ErrorContains(t, err, "ParseDuration (timeout) failed")
+	require.ErrorContains(t, err, "command '/nonexistent/pfctl' not found")
+	require.ErrorContains(t, err, "failed regex compile")
+	require.Empty(t, out.String())
+}
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rstms/iplsd/scanner"
+	"github.com/stretchr/testify/require"
+)
+
+func seedWatchlist(t *testing.T) {
+	dir := t.TempDir()
+	addressFile := filepath.Join(dir, "watchlist")
+	timeoutDir := filepath.Join(dir, "timeout")
+	require.Nil(t, os.Mkdir(timeoutDir, 0700))
+	require.Nil(t, os.WriteFile(addressFile, []byte("192.0.2.1\n192.0.2.2\n192.0.2.3\n"), 0600))
+	now := time.Now()
+	for addr, expiration := range map[string]time.Time{
+		"192.0.2.1": now.Add(2 * time.Hour),
+		"192.0.2.2": now.Add(time.Hour),
+	} {
+		data, err := json.Marshal(scanner.TimeoutRecord{Address: addr, LastSeen: now, Expiration: expiration})
+		require.Nil(t, err)
+		require.Nil(t, os.WriteFile(filepath.Join(timeoutDir, addr), data, 0600))
+	}
+	ViperSet("address_file", addressFile)
+	ViperSet("timeout_dir", timeoutDir)
+}
+
+func TestList(t *testing.T) {
+	initTestConfig(t)
+	seedWatchlist(t)
+	var out bytes.Buffer
+	listCmd.SetOut(&out)
+	defer listCmd.SetOut(nil)
+
+	require.Nil(t, listCmd.Flags().Set("json", "false"))
+	listCmd.Run(listCmd, []string{})
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 3)
+	require.True(t, strings.HasPrefix(lines[0], "192.0.2.2 remaining "), lines[0])
+	require.True(t, strings.HasPrefix(lines[1], "192.0.2.1 remaining "), lines[1])
+	require.Equal(t, "192.0.2.3 no timeout", lines[2])
+
+	out.Reset()
+	require.Nil(t, listCmd.Flags().Set("json", "true"))
+	listCmd.Run(listCmd, []string{})
+	entries := []scanner.WatchlistEntry{}
+	require.Nil(t, json.Unmarshal(out.Bytes(), &entries))
+	require.Len(t, entries, 3)
+	require.Equal(t, "192.0.2.2", entries[0].Address)
+	require.InDelta(t, time.Hour, entries[0].Remaining, float64(time.Minute))
+}
@@ -0,0 +1,72 @@
+/*
+Copyright © 2025 Matt Krueger <mkrueger@rstms.net>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/rstms/iplsd/scanner"
+	"github.com/spf13/cobra"
+)
+
+var retriesCmd = &cobra.Command{
+	Use:   "retries",
+	Short: "list add/delete commands pending retry",
+	Long: `
+Read the retry file and list each failed add or delete command that
+is queued for retry, with the attempt count and most recent error.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		filename := ViperGetString("retry_file")
+		if filename == "" {
+			log.Fatal("retry-file is not configured")
+		}
+		retries, err := scanner.ReadRetryQueue(filename)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if ViperGetBool("verbose") {
+			fmt.Println(FormatJSON(retries))
+			return
+		}
+		for _, retry := range retries {
+			fmt.Printf("%s %s attempts=%d first_failed=%s error=%s\n",
+				retry.Action, retry.Address, retry.Attempts,
+				retry.FirstFailed.Format(time.RFC3339), retry.Error)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(retriesCmd)
+}
@@ -31,9 +31,11 @@ POSSIBILITY OF SUCH DAMAGE.
 package cmd
 
 import (
+	"log"
 	"os"
 
 	"github.com/rstms/cobra-daemon"
+	"github.com/rstms/iplsd/scanner"
 	"github.com/spf13/cobra"
 )
 
@@ -45,7 +47,8 @@ var rootCmd = &cobra.Command{
 iplsd pf-table log scanning daemon
 Scan log files for regex patterns containing IP addresses.
 Open LOG_FILE; For each line added:
-  Match the line with REGEX
+  Match the line with REGEX; the IP address is the group named ip,
+  as in (?P<ip>...), or the first capture group
 When a pattern match produces a new IP_ADDRESS:
   Append IP_ADDRESS to LIST_FILE if not already present
   Write the timeout time into TIMEOUT_DIR/IP_ADDRESS
@@ -55,13 +58,108 @@ Every TIMEOUT_INTERVAL:
     Remove IP_ADDRESS from WATCHLIST_FILE
     Delete TIMEOUT_DIR/IP_ADDRESS
 Use case: maintain IP address list table file for a pf rule
+
+Commands run for each added or deleted IP_ADDRESS:
+  add_command / delete_command: command strings, IP_ADDRESS appended;
+  arguments may be quoted or backslash-escaped as in a shell
+  or: COMMAND base argv with ADD_ARGS / DELETE_ARGS argument lists;
+  an argument containing {ip} has IP_ADDRESS substituted, otherwise
+  IP_ADDRESS is appended; {pattern} and {timeout} are replaced by the
+  matching regex and the timeout in seconds.  With flush_interval set,
+  addresses are batched and an argument containing {ip} is repeated
+  for each address.  Example:
+    command: [pfctl, -t, blocklist]
+    add_args: [-T, add, "{ip}"]
+    delete_args: [-T, delete, "{ip}"]
+  Each command also receives IPLSD_EVENT (add, delete, match or
+  soft_timeout), IPLSD_ADDRESS (space separated for a batch),
+  IPLSD_PATTERN, IPLSD_LINE (the matched line, empty for deletes and
+  batches) and IPLSD_TIMEOUT (seconds) in its environment.
+  soft_timeout_command runs once for an address that has been blocked
+  for soft_timeout_fraction (default 0.8) of its timeout, as checked
+  every interval, so an operator can be warned before it expires.
+
+Entries in the patterns list may be a regex string or a map setting
+regex with an optional timeout_seconds, add_command and delete_command
+used instead of the defaults for addresses it matches, ip_group,
+the capture group holding the IP address, and mode.  A pattern with
+mode observe logs, notifies and runs on_match_command for its matches
+but never adds an address, so its noise can be judged before it is
+changed to the default mode, block.  Example:
+    patterns:
+      - regex: 'spam from ((?:\d{1,3}\.){3}\d{1,3})'
+        timeout_seconds: 604800
+        add_command: pfctl -t spam -T add
+        delete_command: pfctl -t spam -T delete
+      - regex: 'probe from ((?:\d{1,3}\.){3}\d{1,3})'
+        mode: observe
+
+Entries in the sources list are more log files followed beside
+LOG_FILE, given as a filename or a map setting file and priority.
+LOG_FILE has priority 0.  The scanner matches a line from the highest
+priority file with one waiting, so a quiet, important log is matched
+promptly while a noisy one floods; a file with a negative priority is
+read only while LOG_FILE and the files of priority 0 have none waiting.
+Example:
+    sources:
+      - file: /var/log/auth.log
+        priority: 10
+      - file: /var/log/httpd/access.log
+        priority: -1
+
+list_mode sets what the watchlist means.  In both modes a matched
+address is listed and runs add_command, and is removed, running
+delete_command, once it has not matched for its timeout:
+  block: the list holds offenders; add_command blocks an address and
+    delete_command unblocks it (default)
+  allow: the list holds active legitimate clients; add_command grants
+    an address access and delete_command revokes it when the client
+    stops appearing.  timeout_backoff_factor and block_prefix_v4 are
+    rejected, as they would extend access to returning or neighbouring
+    addresses.
+
+Blank lines, # comment lines, and a # annotation following an address
+are allowed in the watchlist and kept when iplsd rewrites it; comment
+lines are moved to the top as the entries are sorted.
+
+Expirations are wall clock times.  When the clock is stepped back,
+the reaper moves each expiration that would otherwise be extended by
+the step back by the same amount, so a ban is never held longer than
+its timeout from the step; clock_skew_grace sets how large a step is
+tolerated first, and also expires addresses that much early.
+
+Each instance locks TIMEOUT_DIR/.iplsd.lock and .iplsd-NAME.lock beside
+the watchlist file NAME; a second instance, or an add, remove or flush
+command, using the same TIMEOUT_DIR or watchlist refuses to start while
+they are held.  Use the control socket ADD, REMOVE and FLUSH commands
+to change a running daemon's watchlist.
+
+SIGHUP re-reads the config file and patterns_file, replacing the regex
+patterns, the add and delete commands, and timeout_seconds without a
+restart.
+SIGUSR1 checks timeouts immediately instead of at the next interval.
+SIGINT and SIGTERM stop iplsd, leaving the watchlist and timeout files
+for the next start; with cleanup_on_exit set, every address is first
+deleted, running delete_command, within shutdown_timeout.
+
+The scanner exits 0 when stopped by a signal, 1 for a command line
+error, 2 when the configuration is rejected, and 3 for a failure while
+running, such as a timeout directory locked by another instance.
 `,
 }
 
 func Execute() {
 	err := rootCmd.Execute()
 	if err != nil {
-		os.Exit(1)
+		os.Exit(scanner.ExitUsage)
+	}
+}
+
+// log err and exit with the status scanner.ExitCode gives it; a nil err returns
+func exitOnError(err error) {
+	if err != nil {
+		log.Println(err)
+		os.Exit(scanner.ExitCode(err))
 	}
 }
 
@@ -70,9 +168,82 @@ func init() {
 	OptionSwitch(rootCmd, "foreground", "", "run in foreground")
 	OptionString(rootCmd, "interval-seconds", "", "600", "timeout check interval in seconds (default: 10 minutes)")
 	OptionString(rootCmd, "timeout-seconds", "", "86400", "IP presence timeout in seconds (default: 24 hours)")
-	OptionString(rootCmd, "monitored-file", "m", "", "log file to monitor")
+	OptionString(rootCmd, "interval", "", "", "timeout check interval as a duration (example: 10m); overrides interval-seconds")
+	OptionString(rootCmd, "interval-jitter", "", "0", "vary each timeout check interval at random by up to this fraction of it (example: 0.1)")
+	OptionString(rootCmd, "timeout", "", "", "IP presence timeout as a duration (example: 24h); overrides timeout-seconds")
+	OptionString(rootCmd, "sliding-window", "", "true", "extend the timeout on each match; false keeps the expiration set when the address was added")
+	OptionString(rootCmd, "timeout-backoff-factor", "", "1", "multiply the timeout by this factor each time an expired address is added again")
+	OptionString(rootCmd, "timeout-max-seconds", "", "604800", "maximum timeout with backoff in seconds; strikes are forgotten this long after expiration (default: 1 week)")
+	OptionSwitch(rootCmd, "dry-run", "", "log intended changes without modifying the watchlist or timeout files or running commands")
+	OptionString(rootCmd, "log-format", "", "text", "log format: 'text' or 'json'")
+	OptionString(rootCmd, "instance-name", "", "", "prefix log lines with [NAME], and label JSON log records and metrics with it, to tell instances apart")
+	OptionString(rootCmd, "monitored-file", "m", "", "log file to monitor, or - to read stdin")
+	OptionString(rootCmd, "follow-mode", "", "name", "'name' reopens the monitored file after rotation, 'descriptor' follows the original file; a missing file is waited for in either mode")
+	OptionString(rootCmd, "follow-backend", "", "poll", "'poll' checks the monitored file every poll interval, 'inotify' reads as soon as it changes (Linux)")
+	OptionString(rootCmd, "poll-interval-seconds", "", "0.25", "monitored file poll interval in seconds")
+	OptionInt(rootCmd, "follower-restarts", "", 5, "restart the monitored file follower this many times, with a doubling delay, if it exits unexpectedly")
+	OptionInt(rootCmd, "line-buffer", "", 1024, "lines read ahead of the scanner, so a burst is taken from the monitored file or stdin while a slow command runs")
+	OptionInt(rootCmd, "max-line-length", "", 65536, "truncate longer log lines to this many bytes before matching")
+	OptionStringSlice(rootCmd, "sources", "", []string{}, "more log files to follow beside LOG_FILE at priority 0; set priorities in the config file")
+	OptionSwitch(rootCmd, "follow-symlink", "", "resolve a symlinked monitored file and restart when its target changes")
+	OptionString(rootCmd, "symlink-check-seconds", "", "10", "monitored file symlink check interval in seconds")
 	OptionString(rootCmd, "watchlist-file", "w", "/etc/iplsd/watchlist", "IP whitelist/blacklist table file")
+	OptionSwitch(rootCmd, "annotate-watchlist", "", "follow each address added to the watchlist with a # comment giving the time and the matching regex")
+	OptionString(rootCmd, "list-mode", "", "block", "'block' lists offending addresses, 'allow' lists active legitimate clients")
 	OptionString(rootCmd, "timeout-dir", "D", "/etc/iplsd/ip", "IP timeout file directory")
-	OptionString(rootCmd, "regex", "r", `((?:\d{1,3}\.){3}\d{1,3})`, "regex patterns")
+	OptionSwitch(rootCmd, "match-all", "", "act on every address a pattern matches in a line, not only the first")
+	OptionSwitch(rootCmd, "strict-boundaries", "", "skip a captured address that is part of a longer token, as in 10.0.0.1234 or v1.2.3.4build")
+	OptionStringSlice(rootCmd, "match-programs", "", []string{}, "only match syslog lines logged by these programs (example: sshd); lines without a syslog prefix are matched as usual")
+	OptionSwitch(rootCmd, "xff-mode", "", "treat each captured address as an X-Forwarded-For list and act on its first public, non-allowlisted address")
+	OptionString(rootCmd, "watchlist-mode", "", "0600", "octal permissions of the watchlist file")
+	OptionString(rootCmd, "timeout-dir-mode", "", "0700", "octal permissions of a created timeout directory; its files get the same without search bits")
+	OptionString(rootCmd, "file-owner", "", "", "user or user:group given the watchlist and timeout files when running as root")
+	OptionInt(rootCmd, "match-threshold", "", 1, "number of matches within match-window required before an address is added")
+	OptionString(rootCmd, "min-block-duration", "", "", "keep an added address at least this long even when its timeout expires sooner (example: 10m)")
+	OptionString(rootCmd, "clock-skew-grace", "", "", "expire an address this much before its expiration, and tolerate this much backward clock step before moving expirations back (example: 2s)")
+	OptionString(rootCmd, "match-window", "", "", "sliding window for match-threshold (example: 60s)")
+	OptionInt(rootCmd, "block-prefix-v4", "", 32, "add the enclosing IPv4 network of this prefix length instead of the single address")
+	OptionString(rootCmd, "skip-private", "", "true", "ignore private, loopback, link-local and multicast addresses")
+	OptionString(rootCmd, "allowlist-file", "", "", "addresses and CIDR networks that are never added to the watchlist")
+	OptionString(rootCmd, "geoip-db", "", "", "MaxMind GeoLite2 country or city database used to log the country of each address")
+	OptionStringSlice(rootCmd, "country-allowlist", "", []string{}, "ISO country codes whose addresses are never added (requires geoip-db)")
+	OptionStringSlice(rootCmd, "country-blocklist", "", []string{}, "only add addresses from these ISO country codes (requires geoip-db)")
+	OptionSwitch(rootCmd, "resolve-ptr", "", "log the reverse DNS name of each added address and include it in notifications")
+	OptionString(rootCmd, "control-socket", "", "", "unix socket accepting LIST, STATUS, ADD, REMOVE, SWEEP and FLUSH commands")
+	OptionString(rootCmd, "listen-address", "", "", "serve prometheus /metrics and /healthz on this address (example: 127.0.0.1:9137)")
+	OptionInt(rootCmd, "max-watchlist-size", "", 0, "evict the entry that expires first when an add would exceed this many entries (0: unlimited)")
+	OptionInt(rootCmd, "max-adds-per-minute", "", 0, "drop adds beyond this rate with a warning, so a runaway pattern cannot flood the watchlist; a dropped address is added by a later match (0: unlimited)")
+	OptionString(rootCmd, "notify-url", "", "", "post a JSON notification to this URL when an address is added or expires")
+	OptionString(rootCmd, "notify-timeout-seconds", "", "10", "notification request timeout in seconds")
+	OptionString(rootCmd, "regex", "r", scanner.IP_PATTERN.String(), "regex patterns")
+	OptionString(rootCmd, "patterns-file", "", "", "file of regex patterns, one per line with # comments, added to regex and re-read on SIGHUP")
+	OptionString(rootCmd, "pf-table", "", "", "add and delete addresses in this pf table through /dev/pf instead of running commands (OpenBSD)")
+	OptionStringSlice(rootCmd, "command", "", []string{}, "base command argv shared by add-args and delete-args")
+	OptionStringSlice(rootCmd, "add-args", "", []string{}, "add command arguments appended to command")
+	OptionStringSlice(rootCmd, "delete-args", "", []string{}, "delete command arguments appended to command")
+	OptionString(rootCmd, "on-match-command", "", "", "command run for every match that is not ignored, with the address appended and IPLSD_* variables set as for add-command")
+	OptionString(rootCmd, "soft-timeout-command", "", "", "command run once for a blocked address when soft-timeout-fraction of its timeout has passed, before it expires, with the address appended and IPLSD_EVENT=soft_timeout")
+	OptionString(rootCmd, "soft-timeout-fraction", "", "0.8", "part of its timeout an address is blocked before soft-timeout-command runs")
+	OptionSwitch(rootCmd, "force-add", "", "run add-command for an address even when it is already in the watchlist")
+	OptionInt(rootCmd, "command-retries", "", 0, "retry a failed add or delete command this many times")
+	OptionString(rootCmd, "command-retry-delay", "", "1s", "delay before the first retry of a failed command, doubling for each further retry")
+	OptionString(rootCmd, "shutdown-timeout", "", "10s", "on shutdown, wait this long for running add and delete commands to finish")
+	OptionSwitch(rootCmd, "cleanup-on-exit", "", "on SIGINT or SIGTERM, delete every watchlist address, running delete-command for each, within shutdown-timeout")
+	OptionString(rootCmd, "flush-interval", "", "", "batch add and delete commands, running each batch at this interval (example: 2s)")
+	OptionInt(rootCmd, "batch-size", "", 0, "run a batch early once it holds this many addresses (0: wait for flush-interval)")
+	OptionInt(rootCmd, "command-workers", "", 0, "run add, delete and on-match commands in up to this many concurrent workers so matching continues while they run (0: run each before the next line)")
+	OptionString(rootCmd, "match-budget", "", "", "warn when matching one line against every regex takes longer than this duration, naming the slowest regex (example: 5ms)")
+	OptionSwitch(rootCmd, "disable-slow-patterns", "", "stop matching the regex named by a match-budget warning until the next reload")
+	OptionString(rootCmd, "timestamp-layout", "", "", "log line timestamp layout (Go time format, example: 'Jan _2 15:04:05')")
+	OptionString(rootCmd, "stats-file", "", "", "persist per-pattern and per-address match counts to this file")
+	OptionString(rootCmd, "match-file", "", "", "persist the last line matched by each pattern to this file")
+	OptionString(rootCmd, "retry-file", "", "", "persist failed add/delete commands to this file and retry them")
+	OptionString(rootCmd, "retry-max-age-seconds", "", "86400", "discard failed commands after retrying for this many seconds")
+	OptionString(rootCmd, "history-file", "", "", "append a JSON line to this file for each address added to or expired from the watchlist")
+	OptionInt(rootCmd, "history-max-size", "", 10485760, "rotate the history file before it grows past this many bytes (0: never)")
+	OptionInt(rootCmd, "history-keep", "", 3, "rotated history files kept as history-file.1, .2, ...")
+	OptionString(rootCmd, "startup-grace", "", "", "log but do not act on matches for this long after startup (example: 1m)")
+	OptionSwitch(rootCmd, "skip-before-start", "", "ignore matches in lines with timestamps from before startup (requires timestamp-layout)")
+	OptionString(rootCmd, "max-line-age", "", "", "ignore matches in lines with timestamps older than this duration (example: 1h)")
 	daemon.AddDaemonCommands(rootCmd, "scanner")
 }
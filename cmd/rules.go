@@ -0,0 +1,79 @@
+/*
+Copyright © 2025 Matt Krueger <mkrueger@rstms.net>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/rstms/iplsd/scanner"
+	"github.com/spf13/cobra"
+)
+
+var rulesCmd = &cobra.Command{
+	Use:   "rules",
+	Short: "list patterns with the last line each one matched",
+	Long: `
+List each configured regex pattern with the most recent line it
+matched and when, as recorded in match-file by the running scanner.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		filename := ViperGetString("match_file")
+		if filename == "" {
+			log.Fatal("match-file is not configured")
+		}
+		matches, err := scanner.ReadMatchFile(filename)
+		if err != nil {
+			log.Fatal(err)
+		}
+		lastMatch := make(map[string]scanner.MatchState)
+		for _, state := range matches {
+			lastMatch[state.Pattern] = state
+		}
+		patterns, err := scanner.ConfiguredPatterns(ViperGetStringSlice("regex"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, pattern := range patterns {
+			state, ok := lastMatch[pattern]
+			if ok {
+				fmt.Printf("%s\n  %s %s\n", pattern, state.Time.Format(time.RFC3339), state.Line)
+			} else {
+				fmt.Printf("%s\n  no match\n", pattern)
+			}
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(rulesCmd)
+}
@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rstms/iplsd/scanner"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScan(t *testing.T) {
+	initTestConfig(t)
+	seedWatchlist(t)
+	ViperSet("regex", []string{`failed from ((?:\d{1,3}\.){3}\d{1,3})`})
+	defer ViperSet("regex", []string{scanner.IP_PATTERN.String()})
+	dir := t.TempDir()
+
+	var data bytes.Buffer
+	gz := gzip.NewWriter(&data)
+	_, err := gz.Write([]byte("failed from 198.51.100.1\naccepted from 198.51.100.2\nfailed from 198.51.100.3"))
+	require.Nil(t, err)
+	require.Nil(t, gz.Close())
+	compressed := filepath.Join(dir, "auth.log.1.gz")
+	require.Nil(t, os.WriteFile(compressed, data.Bytes(), 0600))
+	plain := filepath.Join(dir, "auth.log")
+	require.Nil(t, os.WriteFile(plain, []byte("failed from 198.51.100.4\n"), 0600))
+
+	var out bytes.Buffer
+	scanCmd.SetOut(&out)
+	defer scanCmd.SetOut(nil)
+	scanCmd.Run(scanCmd, []string{compressed, plain})
+	require.Contains(t, out.String(), compressed+": scanned 3 lines")
+	require.Contains(t, out.String(), plain+": scanned 1 lines")
+	addrs, err := scanner.ReadAddressFile(ViperGetString("address_file"))
+	require.Nil(t, err)
+	require.Equal(t, []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "198.51.100.1", "198.51.100.3", "198.51.100.4"}, addrs)
+}
@@ -31,8 +31,6 @@ POSSIBILITY OF SUCH DAMAGE.
 package cmd
 
 import (
-	"log"
-
 	"github.com/rstms/iplsd/scanner"
 	"github.com/spf13/cobra"
 )
@@ -55,13 +53,8 @@ to quickly create a Cobra application.
 			ViperGetString("timeout_dir"),
 			ViperGetStringSlice("regex"),
 		)
-		if err != nil {
-			log.Fatal(err)
-		}
-		err = s.Run()
-		if err != nil {
-			log.Fatal(err)
-		}
+		exitOnError(err)
+		exitOnError(s.Run())
 	},
 }
 
@@ -0,0 +1,85 @@
+/*
+Copyright © 2025 Matt Krueger <mkrueger@rstms.net>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/rstms/iplsd/scanner"
+	"github.com/spf13/cobra"
+)
+
+var simulateCmd = &cobra.Command{
+	Use:   "simulate TIMEOUT_SECONDS",
+	Short: "report which addresses would expire under a different timeout",
+	Long: `
+Read the current timeout files and recompute each expiration as
+TIMEOUT_SECONDS after the address was last seen, in place of the
+configured, per-pattern or backoff timeout that set it.  Report which
+entries would already be expired and how many would remain.  Nothing
+is modified.
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		current, err := scanner.ConfiguredDuration("timeout")
+		if err != nil {
+			log.Fatal(err)
+		}
+		hypothetical, err := time.ParseDuration(args[0] + "s")
+		if err != nil {
+			log.Fatalf("ParseDuration (TIMEOUT_SECONDS) failed: %v", err)
+		}
+		if hypothetical <= 0 {
+			log.Fatalf("TIMEOUT_SECONDS must be greater than zero")
+		}
+		results, err := scanner.SimulateExpiry(ViperGetString("timeout_dir"), current, hypothetical)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var expired, remaining int
+		for _, result := range results {
+			if result.Expired {
+				expired++
+				fmt.Printf("%s expired\n", result.Address)
+			} else {
+				remaining++
+				fmt.Printf("%s remaining %v\n", result.Address, result.Remaining.Round(time.Second))
+			}
+		}
+		fmt.Printf("%d would expire, %d would remain\n", expired, remaining)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(simulateCmd)
+}
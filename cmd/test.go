@@ -0,0 +1,121 @@
+/*
+Copyright © 2025 Matt Krueger <mkrueger@rstms.net>
+All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are met:
+
+ 1. Redistributions of source code must retain the above copyright notice,
+    this list of conditions and the following disclaimer.
+
+ 2. Redistributions in binary form must reproduce the above copyright notice,
+    this list of conditions and the following disclaimer in the documentation
+    and/or other materials provided with the distribution.
+
+ 3. Neither the name of the copyright holder nor the names of its contributors
+    may be used to endorse or promote products derived from this software
+    without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+POSSIBILITY OF SUCH DAMAGE.
+*/
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/rstms/iplsd/scanner"
+	"github.com/spf13/cobra"
+)
+
+var testCmd = &cobra.Command{
+	Use:   "test [FILE]",
+	Short: "show what the patterns match in sample lines",
+	Long: `
+Read lines from FILE, or stdin when FILE is omitted or -, and print
+each line matched by a configured pattern with the pattern and the
+address it extracts, or the capture that is not a valid address.
+Lines are matched as the scanner matches them: match_programs,
+match_all, strict_boundaries, xff_mode and max_line_length apply.
+Use --regex to try a pattern before adding it to the configuration.
+The watchlist, timeout files and commands are not touched.
+`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		input := cmd.InOrStdin()
+		if len(args) > 0 && args[0] != "-" {
+			file, err := os.Open(args[0])
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer file.Close()
+			input = file
+		}
+		err := testPatterns(input, cmd.OutOrStdout())
+		if err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+// longest line the test command reads
+const maxTestLine = 1024 * 1024
+
+// report the matches of the configured patterns in each line of input on out
+func testPatterns(input io.Reader, out io.Writer) error {
+	tester, err := scanner.NewPatternTester(ViperGetStringSlice("regex"))
+	if err != nil {
+		return err
+	}
+	// the scanner truncates lines to max_line_length before matching, so longer lines are read and truncated too
+	maxLine := ViperGetInt("max_line_length")
+	lines := bufio.NewScanner(input)
+	lines.Buffer(make([]byte, 0, 64*1024), max(maxLine+1, maxTestLine))
+	count := 0
+	matched := 0
+	for lines.Scan() {
+		count++
+		line := lines.Text()
+		if maxLine > 0 && len(line) > maxLine {
+			line = line[:maxLine]
+		}
+		line = strings.TrimSpace(line)
+		matches := tester.Match(line)
+		if len(matches) == 0 {
+			continue
+		}
+		matched++
+		fmt.Fprintf(out, "%d: %s\n", count, line)
+		for _, match := range matches {
+			if match.Address == "" {
+				fmt.Fprintf(out, "  '%s' is not a valid address [%s]\n", match.Capture, match.Pattern)
+			} else {
+				fmt.Fprintf(out, "  %s [%s]\n", match.Address, match.Pattern)
+			}
+		}
+	}
+	err = lines.Err()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%d of %d lines matched\n", matched, count)
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(testCmd)
+}
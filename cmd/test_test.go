@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/rstms/iplsd/scanner"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTestPatterns(t *testing.T) {
+	initTestConfig(t)
+	ViperSet("regex", []string{`failed from (\S+)`, `invalid user \S+ from (?P<ip>\S+)`})
+	defer ViperSet("regex", []string{scanner.IP_PATTERN.String()})
+	input := strings.Join([]string{
+		"sshd[42]: failed from 192.0.2.7 port 22",
+		"sshd[42]: accepted from 192.0.2.8 port 22",
+		"sshd[42]: invalid user admin from 2001:0db8::1",
+		"sshd[42]: failed from unknown",
+	}, "\n")
+	var out bytes.Buffer
+	require.Nil(t, testPatterns(strings.NewReader(input), &out))
+	require.Equal(t, strings.Join([]string{
+		"1: sshd[42]: failed from 192.0.2.7 port 22",
+		`  192.0.2.7 [failed from (\S+)]`,
+		"3: sshd[42]: invalid user admin from 2001:0db8::1",
+		`  2001:db8::1 [invalid user \S+ from (?P<ip>\S+)]`,
+		"4: sshd[42]: failed from unknown",
+		`  'unknown' is not a valid address [failed from (\S+)]`,
+		"3 of 4 lines matched",
+		"",
+	}, "\n"), out.String())
+
+	// a line longer than the default scanner buffer is read whole
+	out.Reset()
+	long := "sshd[42]: failed from 192.0.2.9 " + strings.Repeat("x", 100000)
+	require.Nil(t, testPatterns(strings.NewReader(long), &out))
+	require.Contains(t, out.String(), "  192.0.2.9 [failed from (\\S+)]\n1 of 1 lines matched\n")
+
+	// the scanner's match_all, match_programs and xff_mode settings apply
+	ViperSet("regex", []string{`from (\S+)`})
+	ViperSet("match_all", true)
+	ViperSet("match_programs", []string{"sshd"})
+	defer ViperSet("match_all", false)
+	defer ViperSet("match_programs", []string{})
+	input = strings.Join([]string{
+		"Jan  2 03:04:05 host sshd[42]: from 192.0.2.7 and from 192.0.2.8",
+		"Jan  2 03:04:05 host httpd[7]: from 192.0.2.9",
+	}, "\n")
+	out.Reset()
+	require.Nil(t, testPatterns(strings.NewReader(input), &out))
+	require.Equal(t, "1: "+strings.Split(input, "\n")[0]+"\n  192.0.2.7 [from (\\S+)]\n  192.0.2.8 [from (\\S+)]\n1 of 2 lines matched\n", out.String())
+
+	ViperSet("match_all", false)
+	ViperSet("match_programs", []string{})
+	ViperSet("xff_mode", true)
+	defer ViperSet("xff_mode", false)
+	ViperSet("regex", []string{`xff=(\S+)`})
+	out.Reset()
+	require.Nil(t, testPatterns(strings.NewReader("GET / xff=10.0.0.1,198.51.100.4\nGET / xff=10.0.0.2"), &out))
+	require.Equal(t, "1: GET / xff=10.0.0.1,198.51.100.4\n  198.51.100.4 [xff=(\\S+)]\n1 of 2 lines matched\n", out.String())
+
+	ViperSet("regex", []string{`failed from (`})
+	require.ErrorContains(t, testPatterns(strings.NewReader(input), &out), "failed regex compile")
+}
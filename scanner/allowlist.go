@@ -0,0 +1,64 @@
+package scanner
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// read an allowlist file of addresses and CIDR networks, one per line; blank lines and # comments are ignored
+func ReadAllowlist(filename string) ([]*net.IPNet, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	networks := []*net.IPNet{}
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if !strings.Contains(line, "/") {
+			ip := net.ParseIP(line)
+			if ip == nil {
+				return nil, fmt.Errorf("%s:%d: invalid address '%s'", filename, lineNumber, line)
+			}
+			// an IPv4-mapped address is written as the IPv4 address it maps
+			if v4 := ip.To4(); v4 != nil {
+				line = v4.String() + "/32"
+			} else {
+				line += "/128"
+			}
+		}
+		network, err := parseNetwork(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, lineNumber, err)
+		}
+		networks = append(networks, network)
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("failed reading allowlist file '%s': %v", filename, err)
+	}
+	return networks, nil
+}
+
+// return the allowlist network containing addr, if any; an address is only compared with networks
+// of its own family
+func (s *Scanner) allowlisted(addr string) (*net.IPNet, bool) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, false
+	}
+	for _, network := range s.allowlist {
+		if network.Contains(ip) {
+			return network, true
+		}
+	}
+	return nil, false
+}
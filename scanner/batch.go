@@ -0,0 +1,114 @@
+package scanner
+
+import (
+	"context"
+	"log"
+	"slices"
+	"time"
+)
+
+// an add or delete waiting for the next flush
+type batchEntry struct {
+	Action  string
+	Address string
+	Pattern string
+	Timeout time.Duration
+}
+
+// queue an add or delete for the next flush, waking the batcher when BatchSize is reached
+func (s *Scanner) queueBatch(action, addr, pattern string) {
+	timeout := s.recordTimeout(addr)
+	s.batchLock.Lock()
+	defer s.batchLock.Unlock()
+	i := slices.IndexFunc(s.batch, func(entry batchEntry) bool { return entry.Address == addr })
+	if i >= 0 {
+		// an opposite action still waiting in the batch never reached the backend; the two cancel out
+		if s.batch[i].Action != action {
+			s.batch = slices.Delete(s.batch, i, i+1)
+		}
+		return
+	}
+	s.batch = append(s.batch, batchEntry{Action: action, Address: addr, Pattern: pattern, Timeout: timeout})
+	if s.BatchSize > 0 && len(s.batch) >= s.BatchSize {
+		select {
+		case s.flushNow <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run one command for each group of queued actions sharing an action, pattern and timeout;
+// the addresses of a failed command are queued for retry
+func (s *Scanner) flushBatch() error {
+	s.batchLock.Lock()
+	batch := s.batch
+	s.batch = nil
+	s.batchLock.Unlock()
+
+	type batchKey struct {
+		Action  string
+		Pattern string
+		Timeout time.Duration
+	}
+	keys := []batchKey{}
+	groups := make(map[batchKey][]string)
+	for _, entry := range batch {
+		key := batchKey{Action: entry.Action, Pattern: entry.Pattern, Timeout: entry.Timeout}
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], entry.Address)
+	}
+	for _, key := range keys {
+		addrs := groups[key]
+		command, args := s.batchCommand(key.Action, addrs, key.Pattern, key.Timeout)
+		if command == "" {
+			continue
+		}
+		log.Printf("batcher: %s %d addresses\n", key.Action, len(addrs))
+		err := s.exec(command, args, commandEnv(key.Action, addrs, key.Pattern, "", key.Timeout))
+		for _, addr := range addrs {
+			if err != nil {
+				log.Printf("batcher: %s command failed for %s: %v\n", key.Action, addr, err)
+				if s.RetryFile != "" {
+					qerr := s.queueRetry(key.Action, addr, key.Pattern, err)
+					if qerr != nil {
+						return qerr
+					}
+				}
+			} else {
+				cerr := s.clearRetry(addr)
+				if cerr != nil {
+					return cerr
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// flush queued actions every FlushInterval, when BatchSize is reached, and on shutdown
+func (s *Scanner) batcher(ctx context.Context, startChan chan struct{}) error {
+	defer func() {
+		log.Println("batcher: exiting")
+		s.active.Delete("batcher")
+		s.shutdown("batcher")
+	}()
+	ticker := time.NewTicker(s.FlushInterval)
+	defer ticker.Stop()
+	log.Printf("batcher: flushing commands every %v\n", s.FlushInterval)
+	s.active.Store("batcher", true)
+	startChan <- struct{}{}
+	for {
+		select {
+		case <-ctx.Done():
+			return s.flushBatch()
+		case <-ticker.C:
+		case <-s.flushNow:
+		}
+		err := s.flushBatch()
+		if err != nil {
+			return err
+		}
+	}
+}
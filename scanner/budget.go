@@ -0,0 +1,110 @@
+package scanner
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// false when the literal every match of pattern begins with is missing from line, so the full
+// match can be skipped; regexp computes the prefix when the pattern is compiled
+func prefilter(pattern *regexp.Regexp, line string) bool {
+	prefix, _ := pattern.LiteralPrefix()
+	return prefix == "" || strings.Contains(line, prefix)
+}
+
+// the time one line spent in each pattern, kept only when MatchBudget is set
+type matchTimer struct {
+	start   time.Time
+	slowest *regexp.Regexp
+	longest time.Duration
+}
+
+func (s *Scanner) startMatchTimer() *matchTimer {
+	if s.MatchBudget == 0 {
+		return nil
+	}
+	return &matchTimer{start: time.Now()}
+}
+
+func (t *matchTimer) now() time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// record the time pattern took to match since started
+func (t *matchTimer) record(pattern *regexp.Regexp, started time.Time) {
+	if t == nil {
+		return
+	}
+	if elapsed := time.Since(started); elapsed > t.longest {
+		t.slowest = pattern
+		t.longest = elapsed
+	}
+}
+
+// warn when a line took longer than MatchBudget to match, naming the pattern that took the most
+// of it; with DisableSlow that pattern is skipped until the next reload. the warning is repeated
+// for the 10th, 100th, ... slow line of a pattern so a flood does not fill the log
+func (s *Scanner) checkMatchBudget(t *matchTimer, patterns []*regexp.Regexp) {
+	if t == nil || t.slowest == nil {
+		return
+	}
+	total := time.Since(t.start)
+	if total <= s.MatchBudget {
+		return
+	}
+	pattern := t.slowest.String()
+	s.slowLock.Lock()
+	defer s.slowLock.Unlock()
+	s.slowCounts[pattern]++
+	count := s.slowCounts[pattern]
+	disable := s.DisableSlow && !s.disabled[pattern] && s.enabledPatterns(patterns) > 1
+	if disable {
+		s.disabled[pattern] = true
+	}
+	if disable || isPowerOfTen(count) {
+		values := fields{"pattern": pattern, "elapsed": total.String(), "count": count}
+		s.event("slow", values, "scanner: line took %v to match, over match_budget %v; slowest pattern '%s' took %v (%d slow lines)\n", total, s.MatchBudget, pattern, t.longest, count)
+	}
+	if disable {
+		s.event("disable", fields{"pattern": pattern}, "scanner: pattern '%s' disabled until reload\n", pattern)
+	}
+}
+
+// the number of patterns not disabled; the last one is never disabled. caller holds slowLock
+func (s *Scanner) enabledPatterns(patterns []*regexp.Regexp) int {
+	count := 0
+	for _, pattern := range patterns {
+		if !s.disabled[pattern.String()] {
+			count++
+		}
+	}
+	return count
+}
+
+func (s *Scanner) patternDisabled(pattern *regexp.Regexp) bool {
+	if !s.DisableSlow {
+		return false
+	}
+	s.slowLock.Lock()
+	defer s.slowLock.Unlock()
+	return s.disabled[pattern.String()]
+}
+
+// forget slow and disabled patterns; called when the patterns are reloaded
+func (s *Scanner) resetSlowPatterns() {
+	s.slowLock.Lock()
+	defer s.slowLock.Unlock()
+	s.slowCounts = make(map[string]int)
+	s.disabled = make(map[string]bool)
+}
+
+func isPowerOfTen(n int) bool {
+	for n >= 10 && n%10 == 0 {
+		n /= 10
+	}
+	return n == 1
+}
@@ -0,0 +1,42 @@
+package scanner
+
+import (
+	"log"
+	"path/filepath"
+	"time"
+)
+
+// Expirations are wall clock times so they survive a restart and can be read by the list and
+// simulate commands, which means a clock step moves them.  A forward step expires entries early
+// by the size of the step, which cannot be told apart from time passing.  A backward step leaves
+// LastSeen, written by a match, in the future; unguarded, every entry would stay blocked for its
+// timeout plus the size of the step, so the reaper shifts such a record back to now instead.
+
+// true when record, compared at now, has reached its expiration less ClockSkewGrace
+func (s *Scanner) expired(record TimeoutRecord, now time.Time) bool {
+	return now.Add(s.ClockSkewGrace).Compare(record.Expiration) >= 0
+}
+
+// when the clock has been stepped back past the LastSeen of record by more than ClockSkewGrace,
+// shift its times back by the step, so its expiration is at most its timeout from now, and
+// rewrite its timeout file; a record within ClockSkewGrace is returned unchanged
+func (s *Scanner) correctClockStep(record TimeoutRecord, now time.Time) TimeoutRecord {
+	step := record.LastSeen.Sub(now)
+	if step <= s.ClockSkewGrace {
+		return record
+	}
+	log.Printf("reaper: WARNING: %s last seen %v in the future; the clock was stepped back, moving its expiration to %s\n", record.Address, step.Round(time.Second), record.Expiration.Add(-step).Format(time.RFC3339Nano))
+	for _, t := range []*time.Time{&record.FirstSeen, &record.Blocked, &record.LastSeen, &record.Expiration} {
+		if t.After(now) {
+			*t = t.Add(-step)
+		}
+	}
+	if s.DryRun {
+		return record
+	}
+	err := s.writeTimeoutRecord(filepath.Join(s.TimeoutDir, timeoutFilename(record.Address)), record)
+	if err != nil {
+		log.Printf("reaper: failed rewriting timeout file for %s: %v\n", record.Address, err)
+	}
+	return record
+}
@@ -0,0 +1,323 @@
+package scanner
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// every setting of a Scanner; NewScanner reads it from viper with ConfigFromViper, and a program
+// embedding the scanner may fill it in directly, starting from DefaultConfig. A zero mode, limit or
+// name selects the same default as an unset config key; other values are used as given
+type Config struct {
+	LogFile         string
+	AddressFile     string
+	TimeoutDir      string
+	Reader          LineReader // replaces LogFile as the source of log lines when set
+	Patterns        []string
+	Rules           map[string]PatternRule
+	WatchlistMode   os.FileMode
+	TimeoutDirMode  os.FileMode
+	FileOwner       string
+	AddressTimeout  time.Duration
+	TickInterval    time.Duration
+	IntervalJitter  float64
+	AddCommand      string
+	AddArgs         []string
+	DeleteCommand   string
+	DeleteArgs      []string
+	OnMatchCommand  string
+	OnMatchArgs     []string
+	SoftTimeoutCmd  string
+	SoftTimeoutArgs []string
+	SoftTimeoutFrac float64
+	TimeLayout      string
+	MaxLineAge      time.Duration
+	StartupGrace    time.Duration
+	SkipBeforeStart bool
+	RetryFile       string
+	RetryMaxAge     time.Duration
+	HistoryFile     string
+	HistoryMaxSize  int
+	HistoryKeep     int
+	FollowSymlink   bool
+	SymlinkInterval time.Duration
+	MatchFile       string
+	StatsFile       string
+	AllowlistFile   string
+	GeoIPDB         string
+	CountryAllow    []string
+	CountryBlock    []string
+	ResolvePTR      bool
+	MatchAll        bool
+	StrictBounds    bool
+	MatchPrograms   []string
+	AnnotateList    bool
+	ForceAdd        bool
+	CleanupOnExit   bool
+	ListMode        string
+	XFFMode         bool
+	BlockPrefixV4   int
+	MatchThreshold  int
+	MatchWindow     time.Duration
+	MinBlock        time.Duration
+	ClockSkewGrace  time.Duration
+	BackoffFactor   float64
+	TimeoutMax      time.Duration
+	ControlSocket   string
+	ListenAddress   string
+	SkipPrivate     bool
+	SlidingWindow   bool
+	DryRun          bool
+	Verbose         bool
+	LogFormat       string
+	InstanceName    string
+	NotifyURL       string
+	MaxWatchlist    int
+	MaxAddsPerMin   int
+	PFTable         string
+	NotifyTimeout   time.Duration
+	CommandRetries  int
+	CommandBackoff  time.Duration
+	FollowMode      string
+	FollowBackend   string
+	PollInterval    time.Duration
+	FollowRestarts  int
+	LineBuffer      int
+	MaxLineLength   int
+	Sources         []Source
+	FlushInterval   time.Duration
+	BatchSize       int
+	CommandWorkers  int
+	MatchBudget     time.Duration
+	DisableSlow     bool
+	ShutdownTimeout time.Duration
+}
+
+// the command line defaults of the settings whose zero value is not their default
+func DefaultConfig() Config {
+	return Config{
+		AddressTimeout:  24 * time.Hour,
+		TickInterval:    10 * time.Minute,
+		RetryMaxAge:     24 * time.Hour,
+		SymlinkInterval: 10 * time.Second,
+		BackoffFactor:   1,
+		TimeoutMax:      7 * 24 * time.Hour,
+		SkipPrivate:     true,
+		SlidingWindow:   true,
+		NotifyTimeout:   10 * time.Second,
+		CommandBackoff:  time.Second,
+		PollInterval:    250 * time.Millisecond,
+		FollowRestarts:  5,
+		ShutdownTimeout: 10 * time.Second,
+	}
+}
+
+// read every setting from viper; the keys are checked by Validate, and their values by NewScannerFromConfig
+func ConfigFromViper(logFile, addressFile, timeoutDir string, patterns []string) (Config, error) {
+	cfg := DefaultConfig()
+	err := Validate(addressFile, timeoutDir, patterns)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.LogFile = logFile
+	cfg.AddressFile = addressFile
+	cfg.TimeoutDir = timeoutDir
+	cfg.AddressTimeout, err = ConfiguredDuration("timeout")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.TickInterval, err = ConfiguredDuration("interval")
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Verbose = ViperGetBool("verbose")
+	cfg.DryRun = ViperGetBool("dry_run")
+
+	cfg.AddCommand, cfg.AddArgs, cfg.DeleteCommand, cfg.DeleteArgs, err = parseCommands()
+	if err != nil {
+		return cfg, err
+	}
+	cfg.OnMatchCommand, cfg.OnMatchArgs, err = splitCommand(ViperGetString("on_match_command"))
+	if err != nil {
+		return cfg, fmt.Errorf("on_match_command: %v", err)
+	}
+	cfg.SoftTimeoutCmd, cfg.SoftTimeoutArgs, err = splitCommand(ViperGetString("soft_timeout_command"))
+	if err != nil {
+		return cfg, fmt.Errorf("soft_timeout_command: %v", err)
+	}
+	cfg.SoftTimeoutFrac, err = viperFloat("soft_timeout_fraction")
+	if err != nil {
+		return cfg, err
+	}
+	compiled, rules, err := readPatternRules(patterns)
+	if err != nil {
+		return cfg, err
+	}
+	for _, pattern := range compiled {
+		cfg.Patterns = append(cfg.Patterns, pattern.String())
+	}
+	cfg.Rules = rules
+
+	cfg.WatchlistMode, err = parseFileMode("watchlist_mode", ViperGetString("watchlist_mode"), 0600)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.TimeoutDirMode, err = parseFileMode("timeout_dir_mode", ViperGetString("timeout_dir_mode"), 0700)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.FileOwner = ViperGetString("file_owner")
+
+	cfg.FollowRestarts = ViperGetInt("follower_restarts")
+	cfg.CommandRetries = ViperGetInt("command_retries")
+	if cfg.CommandRetries > 0 {
+		cfg.CommandBackoff, err = time.ParseDuration(ViperGetString("command_retry_delay"))
+		if err != nil {
+			return cfg, fmt.Errorf("ParseDuration (command_retry_delay) failed: %v", err)
+		}
+	}
+
+	cfg.TimeLayout = ViperGetString("timestamp_layout")
+	cfg.SkipBeforeStart = ViperGetBool("skip_before_start")
+	cfg.FollowMode = ViperGetString("follow_mode")
+	cfg.FollowBackend = ViperGetString("follow_backend")
+	cfg.PollInterval, err = time.ParseDuration(ViperGetString("poll_interval_seconds") + "s")
+	if err != nil {
+		return cfg, fmt.Errorf("ParseDuration (poll_interval_seconds) failed: %v", err)
+	}
+	if cfg.PollInterval <= 0 {
+		return cfg, fmt.Errorf("poll_interval_seconds must be greater than zero")
+	}
+	cfg.LineBuffer = ViperGetInt("line_buffer")
+	cfg.MaxLineLength = ViperGetInt("max_line_length")
+	cfg.Sources, err = readSources()
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.FollowSymlink = ViperGetBool("follow_symlink")
+	if cfg.FollowSymlink {
+		cfg.SymlinkInterval, err = time.ParseDuration(ViperGetString("symlink_check_seconds") + "s")
+		if err != nil {
+			return cfg, fmt.Errorf("ParseDuration (symlink_check_seconds) failed: %v", err)
+		}
+	}
+
+	cfg.RetryFile = ViperGetString("retry_file")
+	if cfg.RetryFile != "" {
+		cfg.RetryMaxAge, err = time.ParseDuration(ViperGetString("retry_max_age_seconds") + "s")
+		if err != nil {
+			return cfg, fmt.Errorf("ParseDuration (retry_max_age_seconds) failed: %v", err)
+		}
+	}
+
+	cfg.HistoryFile = ViperGetString("history_file")
+	cfg.HistoryMaxSize = ViperGetInt("history_max_size")
+	cfg.HistoryKeep = ViperGetInt("history_keep")
+
+	if ViperGetString("timeout_backoff_factor") != "" {
+		cfg.BackoffFactor, err = viperFloat("timeout_backoff_factor")
+		if err != nil {
+			return cfg, err
+		}
+	}
+	if cfg.BackoffFactor > 1 {
+		cfg.TimeoutMax, err = time.ParseDuration(ViperGetString("timeout_max_seconds") + "s")
+		if err != nil {
+			return cfg, fmt.Errorf("ParseDuration (timeout_max_seconds) failed: %v", err)
+		}
+	}
+	cfg.IntervalJitter, err = viperFloat("interval_jitter")
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.MatchThreshold = ViperGetInt("match_threshold")
+	cfg.BlockPrefixV4 = ViperGetInt("block_prefix_v4")
+	cfg.ListMode = ViperGetString("list_mode")
+	if ViperGet("skip_private") != nil {
+		cfg.SkipPrivate = ViperGetBool("skip_private")
+	}
+	if ViperGet("sliding_window") != nil {
+		cfg.SlidingWindow = ViperGetBool("sliding_window")
+	}
+	cfg.MaxWatchlist = ViperGetInt("max_watchlist_size")
+	cfg.MaxAddsPerMin = ViperGetInt("max_adds_per_minute")
+	cfg.PFTable = ViperGetString("pf_table")
+	cfg.BatchSize = ViperGetInt("batch_size")
+	cfg.CommandWorkers = ViperGetInt("command_workers")
+	cfg.DisableSlow = ViperGetBool("disable_slow_patterns")
+
+	for key, value := range map[string]*time.Duration{
+		"max_line_age":       &cfg.MaxLineAge,
+		"startup_grace":      &cfg.StartupGrace,
+		"match_window":       &cfg.MatchWindow,
+		"min_block_duration": &cfg.MinBlock,
+		"clock_skew_grace":   &cfg.ClockSkewGrace,
+		"flush_interval":     &cfg.FlushInterval,
+		"match_budget":       &cfg.MatchBudget,
+		"shutdown_timeout":   &cfg.ShutdownTimeout,
+	} {
+		err = viperDuration(key, value)
+		if err != nil {
+			return cfg, err
+		}
+	}
+
+	cfg.NotifyURL = ViperGetString("notify_url")
+	if cfg.NotifyURL != "" {
+		cfg.NotifyTimeout, err = time.ParseDuration(ViperGetString("notify_timeout_seconds") + "s")
+		if err != nil {
+			return cfg, fmt.Errorf("ParseDuration (notify_timeout_seconds) failed: %v", err)
+		}
+	}
+
+	cfg.ControlSocket = ViperGetString("control_socket")
+	cfg.ListenAddress = ViperGetString("listen_address")
+	cfg.AllowlistFile = ViperGetString("allowlist_file")
+	cfg.GeoIPDB = ViperGetString("geoip_db")
+	cfg.CountryAllow = ViperGetStringSlice("country_allowlist")
+	cfg.CountryBlock = ViperGetStringSlice("country_blocklist")
+	cfg.MatchAll = ViperGetBool("match_all")
+	cfg.StrictBounds = ViperGetBool("strict_boundaries")
+	cfg.MatchPrograms = ViperGetStringSlice("match_programs")
+	cfg.AnnotateList = ViperGetBool("annotate_watchlist")
+	cfg.ForceAdd = ViperGetBool("force_add")
+	cfg.CleanupOnExit = ViperGetBool("cleanup_on_exit")
+	cfg.XFFMode = ViperGetBool("xff_mode")
+	cfg.ResolvePTR = ViperGetBool("resolve_ptr")
+	cfg.StatsFile = ViperGetString("stats_file")
+	cfg.MatchFile = ViperGetString("match_file")
+	cfg.LogFormat = ViperGetString("log_format")
+	cfg.InstanceName = ViperGetString("instance_name")
+	return cfg, nil
+}
+
+// set value to the Go duration string of key when it is configured
+func viperDuration(key string, value *time.Duration) error {
+	setting := ViperGetString(key)
+	if setting == "" {
+		return nil
+	}
+	duration, err := time.ParseDuration(setting)
+	if err != nil {
+		return fmt.Errorf("ParseDuration (%s) failed: %v", key, err)
+	}
+	*value = duration
+	return nil
+}
+
+// return the float value of key, or zero when it is not configured
+func viperFloat(key string) (float64, error) {
+	setting := ViperGetString(key)
+	if setting == "" {
+		return 0, nil
+	}
+	value, err := strconv.ParseFloat(setting, 64)
+	if err != nil {
+		return 0, fmt.Errorf("ParseFloat (%s) failed: %v", key, err)
+	}
+	return value, nil
+}
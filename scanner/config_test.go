@@ -0,0 +1,99 @@
+package scanner
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+func testConfig(t *testing.T) Config {
+	dir := t.TempDir()
+	cfg := DefaultConfig()
+	cfg.LogFile = filepath.Join(dir, "logfile")
+	cfg.AddressFile = filepath.Join(dir, "watchlist")
+	cfg.TimeoutDir = filepath.Join(dir, "timeout")
+	cfg.Patterns = []string{`from ((?:\d{1,3}\.){3}\d{1,3})`}
+	return cfg
+}
+
+func TestScannerFromConfig(t *testing.T) {
+	viper.Reset()
+	// settings in viper are not read
+	viper.Set("iplsd.list_mode", "deny")
+	cfg := testConfig(t)
+	cfg.Patterns = append(cfg.Patterns, `invalid user \S+ at (\S+)`)
+	cfg.Rules = map[string]PatternRule{cfg.Patterns[1]: {Timeout: time.Hour}}
+	reader := &testReader{lines: make(chan string), errors: make(chan string)}
+	cfg.Reader = reader
+	s, err := NewScannerFromConfig(cfg)
+	require.Nil(t, err)
+	t.Cleanup(func() { s.Close() })
+	require.Equal(t, "block", s.ListMode)
+	require.Equal(t, defaultLineBuffer, s.LineBuffer)
+	require.Equal(t, 1, s.MatchThreshold)
+	require.FileExists(t, cfg.AddressFile)
+	require.DirExists(t, cfg.TimeoutDir)
+
+	started := make(chan struct{}, 1)
+	result := make(chan error, 1)
+	go func() {
+		result <- s.scanner(s.ctx, started)
+	}()
+	<-started
+	reader.lines <- "failed from 192.0.2.1"
+	reader.lines <- "invalid user admin at 192.0.2.2"
+	close(reader.lines)
+	close(reader.errors)
+	require.Nil(t, <-result)
+	requireAddresses(t, s, "192.0.2.1", "192.0.2.2")
+	record, err := readTimeoutFile(filepath.Join(cfg.TimeoutDir, timeoutFilename("192.0.2.2")))
+	require.Nil(t, err)
+	require.WithinDuration(t, time.Now().Add(time.Hour), record.Expiration, time.Minute)
+
+	// there is no config file to reload
+	require.ErrorContains(t, s.reload(), "nothing to reload")
+}
+
+func TestScannerFromBadConfig(t *testing.T) {
+	viper.Reset()
+	for message, edit := range map[string]func(*Config){
+		"list_mode must be 'block' or 'allow'":                   func(cfg *Config) { cfg.ListMode = "deny" },
+		"failed regex compile":                                   func(cfg *Config) { cfg.Patterns = []string{"from ("} },
+		"not found":                                              func(cfg *Config) { cfg.AddCommand = "iplsd-no-such-command" },
+		"timeout must be greater than zero":                      func(cfg *Config) { cfg.AddressTimeout = 0 },
+		"timeout_backoff_factor must be at least 1":              func(cfg *Config) { cfg.BackoffFactor = 0 },
+		"match_threshold requires match_window":                  func(cfg *Config) { cfg.MatchThreshold = 3 },
+		"interval_jitter must be at least 0 and less than 1":     func(cfg *Config) { cfg.IntervalJitter = 1 },
+		"rule for regex 'other' that is not one of the patterns": func(cfg *Config) { cfg.Rules = map[string]PatternRule{"other": {}} },
+	} {
+		cfg := testConfig(t)
+		edit(&cfg)
+		_, err := NewScannerFromConfig(cfg)
+		require.ErrorContains(t, err, message)
+		// nothing is created for a rejected config
+		require.NoFileExists(t, cfg.AddressFile)
+		require.NoDirExists(t, cfg.TimeoutDir)
+	}
+}
+
+func TestConfigFromViper(t *testing.T) {
+	initTestConfig(t)
+	ViperSet("match_threshold", 3)
+	ViperSet("match_window", "1m")
+	cfg, err := ConfigFromViper(ViperGetString("monitored_file"), ViperGetString("address_file"), ViperGetString("timeout_dir"), []string{IP_PATTERN.String(), IP_PATTERN.String()})
+	require.Nil(t, err)
+	require.Equal(t, []string{IP_PATTERN.String()}, cfg.Patterns)
+	require.Equal(t, 5*time.Second, cfg.AddressTimeout)
+	require.Equal(t, time.Second, cfg.TickInterval)
+	require.Equal(t, 3, cfg.MatchThreshold)
+	require.Equal(t, time.Minute, cfg.MatchWindow)
+	require.True(t, cfg.SkipPrivate)
+	require.Equal(t, 10*time.Second, cfg.ShutdownTimeout)
+
+	ViperSet("match_window", "soon")
+	_, err = ConfigFromViper(ViperGetString("monitored_file"), ViperGetString("address_file"), ViperGetString("timeout_dir"), nil)
+	require.ErrorContains(t, err, "ParseDuration (match_window) failed")
+}
@@ -0,0 +1,155 @@
+package scanner
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// serve line commands on ControlSocket until the context is done
+func (s *Scanner) control(ctx context.Context, startChan chan struct{}) error {
+	defer func() {
+		log.Println("control: exiting")
+		s.active.Delete("control")
+		s.shutdown("control")
+	}()
+	// a socket left by an unclean exit would fail the listen
+	err := os.Remove(s.ControlSocket)
+	if err != nil && !os.IsNotExist(err) {
+		startChan <- struct{}{}
+		return fmt.Errorf("control: %v", err)
+	}
+	listener, err := net.Listen("unix", s.ControlSocket)
+	if err != nil {
+		startChan <- struct{}{}
+		return fmt.Errorf("control: %v", err)
+	}
+	err = os.Chmod(s.ControlSocket, 0600)
+	if err != nil {
+		listener.Close()
+		startChan <- struct{}{}
+		return fmt.Errorf("control: %v", err)
+	}
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	s.active.Store("control", true)
+	log.Printf("control: listening on %s\n", s.ControlSocket)
+	startChan <- struct{}{}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("control: accept failed: %v", err)
+		}
+		go s.controlConnection(conn)
+	}
+}
+
+func (s *Scanner) controlConnection(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewScanner(conn)
+	for reader.Scan() {
+		fields := strings.Fields(reader.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		lines, err := s.controlCommand(strings.ToUpper(fields[0]), fields[1:])
+		if err != nil {
+			lines = append(lines, "ERROR "+err.Error())
+		} else {
+			lines = append(lines, "OK")
+		}
+		_, err = conn.Write([]byte(strings.Join(lines, "\n") + "\n"))
+		if err != nil {
+			log.Printf("control: write failed: %v\n", err)
+			return
+		}
+	}
+}
+
+// run one control command, returning its response lines
+func (s *Scanner) controlCommand(command string, args []string) ([]string, error) {
+	switch command {
+	case "LIST":
+		timeouts, err := ReadTimeouts(s.TimeoutDir)
+		if err != nil {
+			return nil, err
+		}
+		lines := []string{}
+		now := time.Now()
+		for _, timeout := range timeouts {
+			if !timeout.Released {
+				remaining := max(timeout.Expiration.Sub(now), 0)
+				lines = append(lines, fmt.Sprintf("%s %v", timeout.Address, remaining.Round(time.Second)))
+			}
+		}
+		return lines, nil
+	case "STATUS":
+		addrs, err := s.readAddressFile()
+		if err != nil {
+			return nil, err
+		}
+		s.configLock.RLock()
+		patterns := len(s.Patterns)
+		timeout := s.AddressTimeout
+		s.configLock.RUnlock()
+		lines := []string{
+			fmt.Sprintf("monitored_file %s", s.LogFile),
+			fmt.Sprintf("address_file %s", s.AddressFile),
+			fmt.Sprintf("addresses %d", len(addrs)),
+			fmt.Sprintf("patterns %d", patterns),
+			fmt.Sprintf("timeout %v", timeout),
+			fmt.Sprintf("pending_retries %d", len(s.PendingRetries())),
+		}
+		stats := s.Stats()
+		for _, count := range TopCounts(stats.Patterns, 0) {
+			lines = append(lines, fmt.Sprintf("pattern_matches %d %s", count.Count, count.Key))
+		}
+		for _, count := range TopCounts(stats.Addresses, 10) {
+			lines = append(lines, fmt.Sprintf("address_hits %d %s", count.Count, count.Key))
+		}
+		return lines, nil
+	case "ADD", "REMOVE":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("usage: %s ADDRESS", command)
+		}
+		addr, ok := normalizeEntry(args[0])
+		if !ok {
+			return nil, fmt.Errorf("invalid address '%s'", args[0])
+		}
+		if command == "ADD" {
+			action, err := s.Add(addr)
+			if err != nil {
+				return nil, err
+			}
+			s.event("add", fields{"address": addr, "action": action}, "control: IP %s %s %s\n", addr, action, s.AddressFile)
+			return []string{fmt.Sprintf("%s %s %s", addr, action, filepath.Base(s.AddressFile))}, nil
+		}
+		action, err := s.Remove(addr)
+		if err != nil {
+			return nil, err
+		}
+		s.event("remove", fields{"address": addr, "action": action}, "control: IP %s %s %s\n", addr, action, s.AddressFile)
+		return []string{fmt.Sprintf("%s %s %s", addr, action, filepath.Base(s.AddressFile))}, nil
+	case "SWEEP":
+		s.Sweep()
+		return []string{"sweep requested"}, nil
+	case "FLUSH":
+		removed, err := s.Flush()
+		if err != nil {
+			return nil, err
+		}
+		return []string{fmt.Sprintf("%d addresses flushed from %s", removed, filepath.Base(s.AddressFile))}, nil
+	}
+	return nil, fmt.Errorf("unknown command '%s'; expected LIST, STATUS, ADD, REMOVE, SWEEP, or FLUSH", command)
+}
@@ -0,0 +1,49 @@
+package scanner
+
+import "errors"
+
+// exit status of the daemon, so a supervisor can tell a stop it asked for from a failure
+const (
+	// stopped by SIGINT, SIGTERM or Stop
+	ExitOK = 0
+	// the command line could not be parsed
+	ExitUsage = 1
+	// the configuration was rejected; restarting without changing it fails again
+	ExitConfig = 2
+	// failed after the configuration was accepted, such as a lock held by another instance or an
+	// unreadable log file; a restart may succeed
+	ExitRuntime = 3
+)
+
+// an error in the configuration, returned by NewScanner, NewScannerFromConfig and CheckConfig
+type ConfigError struct {
+	Err error
+}
+
+func (e *ConfigError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+func configError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &ConfigError{Err: err}
+}
+
+// the exit status for an error returned by NewScanner or Run: ExitConfig when it is or joins a
+// ConfigError, ExitRuntime for any other error, and ExitOK for nil
+func ExitCode(err error) int {
+	if err == nil {
+		return ExitOK
+	}
+	var configErr *ConfigError
+	if errors.As(err, &configErr) {
+		return ExitConfig
+	}
+	return ExitRuntime
+}
@@ -0,0 +1,234 @@
+package scanner
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// native replacement for tail; polls a file for appended lines, detecting truncation and rotation;
+// with inotify set, change events wake it early and the interval is only a fallback
+type follower struct {
+	filename   string
+	byName     bool
+	fromStart  bool
+	interval   time.Duration
+	inotify    bool
+	wake       <-chan struct{}
+	lines      chan string
+	errors     chan string
+	stop       chan struct{}
+	finish     chan struct{}
+	stopOnce   sync.Once
+	finishOnce sync.Once
+	file       *os.File
+	info       os.FileInfo
+	reader     *bufio.Reader
+	offset     int64
+	pending    lineBuilder
+}
+
+// buffer is the number of lines read ahead of the scanner; lines longer than maxLine are truncated
+func newFollower(filename string, byName, fromStart bool, interval time.Duration, buffer, maxLine int) *follower {
+	return &follower{
+		filename:  filename,
+		byName:    byName,
+		fromStart: fromStart,
+		interval:  interval,
+		lines:     make(chan string, buffer),
+		errors:    make(chan string, 1),
+		stop:      make(chan struct{}),
+		finish:    make(chan struct{}),
+		pending:   lineBuilder{max: maxLine},
+	}
+}
+
+func (f *follower) Lines() <-chan string {
+	return f.lines
+}
+
+func (f *follower) Errors() <-chan string {
+	return f.errors
+}
+
+// exit as soon as possible, discarding unread lines
+func (f *follower) Stop() {
+	f.stopOnce.Do(func() { close(f.stop) })
+}
+
+// read the file to its current end, deliver the remaining lines, then exit
+func (f *follower) Finish() {
+	f.finishOnce.Do(func() { close(f.finish) })
+}
+
+func (f *follower) send(channel chan string, line string) bool {
+	select {
+	case channel <- line:
+		return true
+	case <-f.stop:
+		return false
+	}
+}
+
+// wait one poll interval; returns false when stopped, and finishing true after Finish
+func (f *follower) wait() (bool, bool) {
+	timer := time.NewTimer(f.interval)
+	defer timer.Stop()
+	select {
+	case <-f.stop:
+		return false, false
+	case <-f.finish:
+		return true, true
+	case <-timer.C:
+		return true, false
+	case <-f.wake:
+		return true, false
+	}
+}
+
+func (f *follower) open(seekEnd bool) error {
+	file, err := os.Open(f.filename)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.offset = 0
+	if seekEnd {
+		f.offset, err = file.Seek(0, io.SeekEnd)
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+	f.file = file
+	f.info = info
+	f.reader = bufio.NewReader(file)
+	f.pending.take()
+	return nil
+}
+
+// deliver every complete line up to the current end of file; an incomplete last line is kept
+// until the rest of it is written
+func (f *follower) readLines() bool {
+	for {
+		chunk, err := f.reader.ReadSlice('\n')
+		f.offset += int64(len(chunk))
+		f.pending.add(chunk)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return true
+		}
+		if !f.sendPending() {
+			return false
+		}
+	}
+}
+
+// deliver the pending line, preceded by a notice when it was truncated
+func (f *follower) sendPending() bool {
+	line, notice := f.pending.take()
+	if notice != "" && !f.send(f.errors, fmt.Sprintf("%s: %s", f.filename, notice)) {
+		return false
+	}
+	return f.send(f.lines, line)
+}
+
+// check for rotation or truncation; returns false when stopped
+func (f *follower) checkFile() bool {
+	info, err := os.Stat(f.filename)
+	if err != nil {
+		// keep reading the open file until the name reappears
+		return true
+	}
+	if f.byName && !os.SameFile(f.info, info) {
+		if !f.readLines() {
+			return false
+		}
+		if !f.pending.empty() && !f.sendPending() {
+			return false
+		}
+		f.file.Close()
+		f.file = nil
+		err := f.open(false)
+		if err != nil {
+			// the run loop retries the open
+			return f.send(f.errors, fmt.Sprintf("%s: reopen failed: %v", f.filename, err))
+		}
+		return f.send(f.errors, fmt.Sprintf("%s has been replaced; following new file", f.filename))
+	}
+	if info.Size() < f.offset {
+		_, err := f.file.Seek(0, io.SeekStart)
+		if err != nil {
+			return f.send(f.errors, fmt.Sprintf("%s: seek failed: %v", f.filename, err))
+		}
+		f.offset = 0
+		f.pending.take()
+		f.reader.Reset(f.file)
+		return f.send(f.errors, fmt.Sprintf("%s: file truncated", f.filename))
+	}
+	return true
+}
+
+func (f *follower) run() {
+	defer close(f.errors)
+	defer close(f.lines)
+	defer func() {
+		if f.file != nil {
+			f.file.Close()
+		}
+	}()
+	if f.inotify {
+		done := make(chan struct{})
+		defer close(done)
+		wake, err := watchFile(f.filename, done)
+		if err != nil {
+			if !f.send(f.errors, fmt.Sprintf("%s: inotify watch failed: %v; polling every %v", f.filename, err, f.interval)) {
+				return
+			}
+		}
+		f.wake = wake
+	}
+	seekEnd := !f.fromStart
+	reported := false
+	for {
+		if f.file == nil {
+			// a missing file is polled for until it appears, in either follow mode
+			err := f.open(seekEnd)
+			if err != nil {
+				if !reported && !f.send(f.errors, fmt.Sprintf("cannot open %s: %v; retrying every %v", f.filename, err, f.interval)) {
+					return
+				}
+				reported = true
+			} else {
+				reported = false
+			}
+			// a file that appears later is read from its first line
+			seekEnd = false
+		}
+		if f.file != nil && !f.readLines() {
+			return
+		}
+		ok, finishing := f.wait()
+		if !ok {
+			return
+		}
+		if finishing {
+			if f.file != nil && f.readLines() && !f.pending.empty() {
+				f.sendPending()
+			}
+			return
+		}
+		if f.file != nil && !f.checkFile() {
+			return
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package scanner
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func nextLine(t *testing.T, channel chan string) string {
+	select {
+	case line := <-channel:
+		return line
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "timeout waiting for follower")
+	}
+	return ""
+}
+
+func TestFollowerTruncation(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "log")
+	err := os.WriteFile(filename, []byte("old line\n"), 0600)
+	require.Nil(t, err)
+
+	f := newFollower(filename, true, false, 10*time.Millisecond, 1, defaultMaxLineLength)
+	go f.run()
+	defer f.Stop()
+	time.Sleep(50 * time.Millisecond)
+
+	appendLine(t, filename, "first line")
+	require.Equal(t, "first line", nextLine(t, f.lines))
+
+	err = os.WriteFile(filename, []byte{}, 0600)
+	require.Nil(t, err)
+	require.Contains(t, nextLine(t, f.errors), "truncated")
+	appendLine(t, filename, "after truncate")
+	require.Equal(t, "after truncate", nextLine(t, f.lines))
+}
+
+func TestFollowerFinish(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "log")
+	err := os.WriteFile(filename, []byte("one\ntwo\n"), 0600)
+	require.Nil(t, err)
+
+	f := newFollower(filename, false, true, time.Hour, 1, defaultMaxLineLength)
+	go f.run()
+	f.Finish()
+	lines := []string{}
+	for line := range f.lines {
+		lines = append(lines, line)
+	}
+	require.Equal(t, []string{"one", "two"}, lines)
+}
+
+func TestFollowerInotify(t *testing.T) {
+	if !inotifySupported {
+		t.Skip("inotify is only supported on Linux")
+	}
+	filename := filepath.Join(t.TempDir(), "log")
+	err := os.WriteFile(filename, []byte{}, 0600)
+	require.Nil(t, err)
+
+	// the poll interval is too long to deliver anything within the test
+	f := newFollower(filename, true, false, time.Hour, 1, defaultMaxLineLength)
+	f.inotify = true
+	go f.run()
+	defer f.Stop()
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	appendLine(t, filename, "first line")
+	require.Equal(t, "first line", nextLine(t, f.lines))
+	require.Less(t, time.Since(start), time.Second)
+
+	require.Nil(t, os.Rename(filename, filename+".1"))
+	appendLine(t, filename, "after rotation")
+	require.Contains(t, nextLine(t, f.errors), "replaced")
+	require.Equal(t, "after rotation", nextLine(t, f.lines))
+}
+
+func TestMaxLineLength(t *testing.T) {
+	// a megabyte without a newline is truncated as it is read, not buffered whole
+	long := "failed from 192.0.2.1 " + strings.Repeat("x", 1<<20)
+	filename := filepath.Join(t.TempDir(), "log")
+	require.Nil(t, os.WriteFile(filename, []byte(long+"\nfailed from 192.0.2.2\n"), 0600))
+
+	f := newFollower(filename, false, true, time.Hour, 1, 1024)
+	go f.run()
+	defer f.Stop()
+	require.Contains(t, nextLine(t, f.errors), "line truncated to max_line_length 1024; 1047575 bytes discarded")
+	require.Equal(t, long[:1024], nextLine(t, f.lines))
+	require.Equal(t, "failed from 192.0.2.2", nextLine(t, f.lines))
+	f.Finish()
+	for range f.lines {
+	}
+	require.LessOrEqual(t, cap(f.pending.text), 2048)
+
+	reader := newIOReader(strings.NewReader(long+"\nfailed from 192.0.2.2"), 1, 1024)
+	require.Contains(t, <-reader.Errors(), "line truncated to max_line_length 1024")
+	lines := []string{}
+	for line := range reader.Lines() {
+		lines = append(lines, line)
+	}
+	require.Equal(t, []string{long[:1024], "failed from 192.0.2.2"}, lines)
+}
@@ -0,0 +1,299 @@
+package scanner
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"os"
+	"slices"
+	"strings"
+)
+
+// reader for the MaxMind DB format used by the GeoLite2 country and city databases
+type geoipDB struct {
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	treeSize   uint
+	ipv4Start  uint
+}
+
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+func openGeoIP(filename string) (*geoipDB, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	i := bytes.LastIndex(data, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("%s: not a MaxMind DB file", filename)
+	}
+	start := i + len(mmdbMetadataMarker)
+	value, _, err := mmdbDecode(data[start:], 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: failed reading metadata: %v", filename, err)
+	}
+	metadata, ok := value.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s: metadata is not a map", filename)
+	}
+	db := geoipDB{data: data}
+	for key, field := range map[string]*uint{"node_count": &db.nodeCount, "record_size": &db.recordSize, "ip_version": &db.ipVersion} {
+		value, ok := metadata[key].(uint64)
+		if !ok {
+			return nil, fmt.Errorf("%s: metadata is missing %s", filename, key)
+		}
+		*field = uint(value)
+	}
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("%s: unsupported record size %d", filename, db.recordSize)
+	}
+	db.treeSize = db.nodeCount * db.recordSize / 4
+	if db.treeSize+16 > uint(i) {
+		return nil, fmt.Errorf("%s: search tree is truncated", filename)
+	}
+	// IPv4 addresses live under ::/96 in an IPv6 tree
+	if db.ipVersion == 6 {
+		for bit := 0; bit < 96 && db.ipv4Start < db.nodeCount; bit++ {
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+	return &db, nil
+}
+
+// return the left (bit 0) or right (bit 1) record of node
+func (db *geoipDB) record(node, bit uint) uint {
+	b := db.data[node*db.recordSize/4:]
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// return the data record for ip, or nil when the database has none
+func (db *geoipDB) lookup(ip net.IP) (any, error) {
+	node := uint(0)
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+		if db.ipVersion == 6 {
+			node = db.ipv4Start
+		}
+	} else if db.ipVersion == 4 {
+		return nil, nil
+	}
+	for i := 0; i < len(ip)*8 && node < db.nodeCount; i++ {
+		node = db.record(node, uint(ip[i/8]>>(7-i%8)&1))
+	}
+	if node <= db.nodeCount {
+		return nil, nil
+	}
+	offset := node - db.nodeCount - 16
+	section := db.data[db.treeSize+16:]
+	if offset >= uint(len(section)) {
+		return nil, fmt.Errorf("invalid data pointer %d", node)
+	}
+	value, _, err := mmdbDecode(section, offset, 0)
+	return value, err
+}
+
+// decode the value at offset in a data section, returning it and the offset following it
+func mmdbDecode(section []byte, offset uint, depth int) (any, uint, error) {
+	if depth > 32 {
+		return nil, 0, fmt.Errorf("data nested too deeply")
+	}
+	next := func(n uint) ([]byte, error) {
+		if offset+n > uint(len(section)) {
+			return nil, fmt.Errorf("data truncated at %d", offset)
+		}
+		b := section[offset : offset+n]
+		offset += n
+		return b, nil
+	}
+	b, err := next(1)
+	if err != nil {
+		return nil, 0, err
+	}
+	control := uint(b[0])
+	kind := control >> 5
+	if kind == 1 {
+		size := (control >> 3) & 3
+		b, err := next(size + 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		var pointer uint
+		switch size {
+		case 0:
+			pointer = (control&7)<<8 | uint(b[0])
+		case 1:
+			pointer = ((control&7)<<16 | uint(b[0])<<8 | uint(b[1])) + 2048
+		case 2:
+			pointer = ((control&7)<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) + 526336
+		default:
+			pointer = uint(binary.BigEndian.Uint32(b))
+		}
+		value, _, err := mmdbDecode(section, pointer, depth+1)
+		return value, offset, err
+	}
+	if kind == 0 {
+		b, err := next(1)
+		if err != nil {
+			return nil, 0, err
+		}
+		kind = 7 + uint(b[0])
+	}
+	size := control & 0x1f
+	if size >= 29 {
+		b, err := next(size - 28)
+		if err != nil {
+			return nil, 0, err
+		}
+		switch size {
+		case 29:
+			size = 29 + uint(b[0])
+		case 30:
+			size = 285 + uint(b[0])<<8 | uint(b[1])
+		default:
+			size = 65821 + (uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]))
+		}
+	}
+	switch kind {
+	case 7:
+		entries := make(map[string]any, size)
+		for range size {
+			key, end, err := mmdbDecode(section, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("map key is not a string")
+			}
+			value, end, err := mmdbDecode(section, end, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			entries[name] = value
+			offset = end
+		}
+		return entries, offset, nil
+	case 11:
+		values := make([]any, 0, size)
+		for range size {
+			value, end, err := mmdbDecode(section, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			values = append(values, value)
+			offset = end
+		}
+		return values, offset, nil
+	case 14:
+		return size != 0, offset, nil
+	}
+	b, err = next(size)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch kind {
+	case 2:
+		return string(b), offset, nil
+	case 3:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("invalid double size %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case 15:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("invalid float size %d", size)
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), offset, nil
+	case 4:
+		return slices.Clone(b), offset, nil
+	case 5, 6, 8, 9, 10:
+		var value uint64
+		for _, c := range b {
+			value = value<<8 | uint64(c)
+		}
+		if kind == 8 {
+			return int64(int32(value)), offset, nil
+		}
+		return value, offset, nil
+	}
+	return nil, 0, fmt.Errorf("unknown data type %d", kind)
+}
+
+// return the ISO country code for addr, or "" when it is unknown; lookups are cached and failures only logged
+func (s *Scanner) country(addr string) string {
+	if s.geoip == nil {
+		return ""
+	}
+	s.geoipLock.Lock()
+	defer s.geoipLock.Unlock()
+	code, ok := s.countries[addr]
+	if ok {
+		return code
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		_, network, err := net.ParseCIDR(addr)
+		if err != nil {
+			return ""
+		}
+		ip = network.IP
+	}
+	record, err := s.geoip.lookup(ip)
+	if err != nil {
+		log.Printf("geoip: lookup %s failed: %v\n", addr, err)
+	}
+	if entries, ok := record.(map[string]any); ok {
+		if country, ok := entries["country"].(map[string]any); ok {
+			code, _ = country["iso_code"].(string)
+		}
+	}
+	// bound the cache; a scan flood should not grow it without limit
+	if len(s.countries) >= 65536 {
+		clear(s.countries)
+	}
+	s.countries[addr] = code
+	return code
+}
+
+// return the reason addr is skipped by country_allowlist or country_blocklist, or "" to act on it
+func (s *Scanner) countryFilter(country string) string {
+	if s.geoip == nil {
+		return ""
+	}
+	if slices.Contains(s.CountryAllow, country) {
+		return "country_allowlist"
+	}
+	if len(s.CountryBlock) > 0 && !slices.Contains(s.CountryBlock, country) {
+		return "not in country_blocklist"
+	}
+	return ""
+}
+
+// normalize a list of ISO country codes to upper case
+func countryCodes(codes []string) []string {
+	normalized := []string{}
+	for _, code := range codes {
+		code = strings.ToUpper(strings.TrimSpace(code))
+		if code != "" {
+			normalized = append(normalized, code)
+		}
+	}
+	return normalized
+}
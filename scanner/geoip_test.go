@@ -0,0 +1,145 @@
+package scanner
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// encode a MaxMind DB string
+func mmdbString(value string) []byte {
+	return append([]byte{0x40 | byte(len(value))}, value...)
+}
+
+// encode a MaxMind DB map of string keys and encoded values
+func mmdbMap(entries ...[]byte) []byte {
+	data := []byte{0xe0 | byte(len(entries)/2)}
+	for _, entry := range entries {
+		data = append(data, entry...)
+	}
+	return data
+}
+
+// encode a MaxMind DB uint32
+func mmdbUint32(value uint32) []byte {
+	return binary.BigEndian.AppendUint32([]byte{0xc4}, value)
+}
+
+// write an IPv4 country database with 24 bit records mapping each network to its country code
+func writeGeoIPFixture(t *testing.T, filename string, networks map[string]string) {
+	type node struct{ records [2]int }
+	// record values: >= 0 a node index, -1 no data, < -1 an index into records of the data section
+	nodes := []node{{[2]int{-1, -1}}}
+	data := []byte{}
+	offsets := []int{}
+	for network, country := range networks {
+		_, ipnet, err := net.ParseCIDR(network)
+		require.Nil(t, err)
+		ones, _ := ipnet.Mask.Size()
+		offsets = append(offsets, len(data))
+		data = append(data, mmdbMap(mmdbString("country"), mmdbMap(mmdbString("iso_code"), mmdbString(country)))...)
+		current := 0
+		for i := 0; i < ones; i++ {
+			bit := int(ipnet.IP.To4()[i/8]>>(7-i%8)) & 1
+			if i == ones-1 {
+				nodes[current].records[bit] = -2 - (len(offsets) - 1)
+				break
+			}
+			if nodes[current].records[bit] < 0 {
+				nodes = append(nodes, node{[2]int{-1, -1}})
+				nodes[current].records[bit] = len(nodes) - 1
+			}
+			current = nodes[current].records[bit]
+		}
+	}
+	count := len(nodes)
+	file := []byte{}
+	for _, n := range nodes {
+		for _, record := range n.records {
+			value := record
+			switch {
+			case record == -1:
+				value = count
+			case record < -1:
+				value = count + 16 + offsets[-2-record]
+			}
+			file = append(file, byte(value>>16), byte(value>>8), byte(value))
+		}
+	}
+	file = append(file, make([]byte, 16)...)
+	file = append(file, data...)
+	file = append(file, mmdbMetadataMarker...)
+	file = append(file, mmdbMap(
+		mmdbString("node_count"), mmdbUint32(uint32(count)),
+		mmdbString("record_size"), mmdbUint32(24),
+		mmdbString("ip_version"), mmdbUint32(4),
+	)...)
+	require.Nil(t, os.WriteFile(filename, file, 0600))
+}
+
+func TestGeoIPLookup(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "country.mmdb")
+	writeGeoIPFixture(t, filename, map[string]string{"192.0.2.0/24": "US", "198.51.100.0/24": "DE"})
+	db, err := openGeoIP(filename)
+	require.Nil(t, err)
+	record, err := db.lookup(net.ParseIP("198.51.100.20"))
+	require.Nil(t, err)
+	require.Equal(t, map[string]any{"country": map[string]any{"iso_code": "DE"}}, record)
+	record, err = db.lookup(net.ParseIP("203.0.113.5"))
+	require.Nil(t, err)
+	require.Nil(t, record)
+	record, err = db.lookup(net.ParseIP("2001:db8::1"))
+	require.Nil(t, err)
+	require.Nil(t, record)
+
+	bad := filepath.Join(t.TempDir(), "bad.mmdb")
+	require.Nil(t, os.WriteFile(bad, []byte("not a database"), 0600))
+	_, err = openGeoIP(bad)
+	require.NotNil(t, err)
+}
+
+func TestCountryFilter(t *testing.T) {
+	dir := initTestConfig(t)
+	filename := filepath.Join(dir, "country.mmdb")
+	writeGeoIPFixture(t, filename, map[string]string{"192.0.2.0/24": "US", "198.51.100.0/24": "DE"})
+	ViperSet("geoip_db", filename)
+	ViperSet("country_allowlist", []string{"us"})
+	s := newTestScanner(t)
+	require.Equal(t, "DE", s.country("198.51.100.20"))
+	require.Equal(t, "", s.country("203.0.113.5"))
+	for _, line := range []string{
+		"failed from 192.0.2.7",
+		"failed from 198.51.100.20",
+		"failed from 203.0.113.5",
+	} {
+		require.Nil(t, s.processLine(line))
+	}
+	addrs, err := s.readAddressFile()
+	require.Nil(t, err)
+	require.Equal(t, []string{"198.51.100.20", "203.0.113.5"}, addrs)
+
+	initTestConfig(t)
+	ViperSet("geoip_db", filename)
+	ViperSet("country_blocklist", []string{"DE"})
+	s = newTestScanner(t)
+	for _, line := range []string{
+		"failed from 192.0.2.7",
+		"failed from 198.51.100.20",
+		"failed from 203.0.113.5",
+	} {
+		require.Nil(t, s.processLine(line))
+	}
+	addrs, err = s.readAddressFile()
+	require.Nil(t, err)
+	require.Equal(t, []string{"198.51.100.20"}, addrs)
+
+	initTestConfig(t)
+	ViperSet("country_blocklist", []string{"DEU"})
+	err = Validate(ViperGetString("address_file"), ViperGetString("timeout_dir"), nil)
+	require.ErrorContains(t, err, "country_blocklist requires geoip_db")
+	require.ErrorContains(t, err, "'DEU' is not a two letter ISO country code")
+}
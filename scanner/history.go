@@ -0,0 +1,114 @@
+package scanner
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// rotated history files kept when history_keep is not set
+const defaultHistoryKeep = 3
+
+// one line of the history file, written when an address is added to or expires from the watchlist
+type HistoryRecord struct {
+	Time    time.Time `json:"time"`
+	Event   string    `json:"event"`
+	Address string    `json:"address"`
+	Pattern string    `json:"pattern,omitempty"`
+	Timeout int64     `json:"timeout,omitempty"`
+}
+
+// append an event to HistoryFile, if configured; a failure is only logged so the watchlist change stands
+func (s *Scanner) journal(event, addr, pattern string, timeout time.Duration) {
+	if s.HistoryFile == "" || s.DryRun {
+		return
+	}
+	record := HistoryRecord{
+		Time:    time.Now(),
+		Event:   event,
+		Address: addr,
+		Pattern: pattern,
+		Timeout: int64(timeout.Seconds()),
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("history: failed marshalling record: %v\n", err)
+		return
+	}
+	data = append(data, '\n')
+	s.historyLock.Lock()
+	defer s.historyLock.Unlock()
+	err = s.rotateHistory(len(data))
+	if err != nil {
+		log.Printf("history: rotate %s failed: %v\n", s.HistoryFile, err)
+	}
+	file, err := os.OpenFile(s.HistoryFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err == nil {
+		_, err = file.Write(data)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		log.Printf("history: write %s failed: %v\n", s.HistoryFile, err)
+	}
+}
+
+// when adding size bytes would grow HistoryFile past HistoryMaxSize, shift it to HistoryFile.1,
+// HistoryFile.1 to HistoryFile.2 and so on, dropping the oldest beyond HistoryKeep; caller holds historyLock
+func (s *Scanner) rotateHistory(size int) error {
+	if s.HistoryMaxSize == 0 {
+		return nil
+	}
+	info, err := os.Stat(s.HistoryFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 || info.Size()+int64(size) <= int64(s.HistoryMaxSize) {
+		return nil
+	}
+	err = os.Remove(rotatedHistory(s.HistoryFile, s.HistoryKeep))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := s.HistoryKeep - 1; i > 0; i-- {
+		err := os.Rename(rotatedHistory(s.HistoryFile, i), rotatedHistory(s.HistoryFile, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(s.HistoryFile, rotatedHistory(s.HistoryFile, 1))
+}
+
+func rotatedHistory(filename string, n int) string {
+	return fmt.Sprintf("%s.%d", filename, n)
+}
+
+// read the records of a history file, oldest first; rotated files are not included
+func ReadHistoryFile(filename string) ([]HistoryRecord, error) {
+	records := []HistoryRecord{}
+	file, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return records, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	lines := bufio.NewScanner(file)
+	for lines.Scan() {
+		var record HistoryRecord
+		err := json.Unmarshal(lines.Bytes(), &record)
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing history file '%s': %v", filename, err)
+		}
+		records = append(records, record)
+	}
+	return records, lines.Err()
+}
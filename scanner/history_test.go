@@ -0,0 +1,67 @@
+package scanner
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistoryJournal(t *testing.T) {
+	dir := initTestConfig(t)
+	ViperSet("history_file", filepath.Join(dir, "history"))
+	ViperSet("timeout", "1s")
+	s := newTestScanner(t, `from ((?:\d{1,3}\.){3}\d{1,3})`)
+	require.Nil(t, s.processLine("failed from 192.0.2.1"))
+	// a repeated match is not a new entry
+	require.Nil(t, s.processLine("failed from 192.0.2.1"))
+	time.Sleep(1100 * time.Millisecond)
+	require.Nil(t, s.expire())
+	requireAddresses(t, s)
+
+	records, err := ReadHistoryFile(s.HistoryFile)
+	require.Nil(t, err)
+	require.Len(t, records, 2)
+	for i, event := range []string{"add", "expire"} {
+		require.Equal(t, event, records[i].Event)
+		require.Equal(t, "192.0.2.1", records[i].Address)
+		require.Equal(t, `from ((?:\d{1,3}\.){3}\d{1,3})`, records[i].Pattern)
+		require.Equal(t, int64(1), records[i].Timeout)
+		require.WithinDuration(t, time.Now(), records[i].Time, 5*time.Second)
+	}
+
+	records, err = ReadHistoryFile(filepath.Join(dir, "missing"))
+	require.Nil(t, err)
+	require.Empty(t, records)
+	require.Nil(t, os.WriteFile(s.HistoryFile, []byte("garbage\n"), 0600))
+	_, err = ReadHistoryFile(s.HistoryFile)
+	require.ErrorContains(t, err, "failed parsing history file")
+}
+
+func TestHistoryRotation(t *testing.T) {
+	dir := initTestConfig(t)
+	history := filepath.Join(dir, "history")
+	ViperSet("history_file", history)
+	ViperSet("history_max_size", 200)
+	ViperSet("history_keep", 2)
+	s := newTestScanner(t)
+	for _, addr := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4", "192.0.2.5", "192.0.2.6", "192.0.2.7"} {
+		s.journal("add", addr, "", time.Hour)
+	}
+	// each record is about 90 bytes, so each file holds two
+	addresses := func(filename string) []string {
+		records, err := ReadHistoryFile(filename)
+		require.Nil(t, err)
+		addrs := []string{}
+		for _, record := range records {
+			addrs = append(addrs, record.Address)
+		}
+		return addrs
+	}
+	require.Equal(t, []string{"192.0.2.7"}, addresses(history))
+	require.Equal(t, []string{"192.0.2.5", "192.0.2.6"}, addresses(history+".1"))
+	require.Equal(t, []string{"192.0.2.3", "192.0.2.4"}, addresses(history+".2"))
+	require.NoFileExists(t, history+".3")
+}
@@ -0,0 +1,58 @@
+//go:build linux
+
+package scanner
+
+import (
+	"log"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const inotifySupported = true
+
+// signal on each change to filename until done is closed; the directory is watched to see rotation,
+// and the file itself so writes through a symlink elsewhere are seen too
+func watchFile(filename string, done <-chan struct{}) (<-chan struct{}, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	err = watcher.Add(filepath.Dir(filename))
+	if err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	// a file that does not exist yet is watched once it is created
+	watcher.Add(filename)
+	wake := make(chan struct{}, 1)
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-done:
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != filepath.Clean(filename) {
+					continue
+				}
+				if event.Has(fsnotify.Create) {
+					watcher.Add(filename)
+				}
+				select {
+				case wake <- struct{}{}:
+				default:
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("follower: inotify: %v\n", err)
+			}
+		}
+	}()
+	return wake, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package scanner
+
+import (
+	"fmt"
+)
+
+const inotifySupported = false
+
+func watchFile(filename string, done <-chan struct{}) (<-chan struct{}, error) {
+	return nil, fmt.Errorf("inotify is only supported on Linux")
+}
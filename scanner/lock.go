@@ -0,0 +1,82 @@
+package scanner
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// held in the timeout directory by the instance that owns it; a dotfile so it is not read as a timeout file
+const lockFilename = ".iplsd.lock"
+
+// returned by lockExclusive when another process holds the lock
+var errLockHeld = errors.New("lock held by another process")
+
+// the lock file beside the watchlist, so instances sharing a watchlist but not a timeout directory
+// are caught too; a dotfile not named like the temporary files the watchlist is written through
+func watchlistLockFilename(addressFile string) string {
+	return filepath.Join(filepath.Dir(addressFile), ".iplsd-"+filepath.Base(addressFile)+".lock")
+}
+
+// lock the watchlist and the timeout directory, failing when another live instance holds either;
+// the kernel releases the locks when their holder exits, so a stale file left by a crash does not block
+func (s *Scanner) lockInstance() error {
+	file, err := acquireLock(watchlistLockFilename(s.AddressFile), s.WatchlistMode, "address_file", s.AddressFile)
+	if err != nil {
+		return err
+	}
+	s.listLockFile = file
+	file, err = acquireLock(filepath.Join(s.TimeoutDir, lockFilename), s.timeoutFileMode(), "timeout_dir", s.TimeoutDir)
+	if err != nil {
+		s.unlockInstance()
+		return err
+	}
+	s.lockFile = file
+	return nil
+}
+
+// take an exclusive lock on filename and write the pid into it; key and path name what it guards
+func acquireLock(filename string, mode os.FileMode, key, path string) (*os.File, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, mode)
+	if err != nil {
+		return nil, err
+	}
+	err = lockExclusive(file)
+	if err != nil {
+		pid, _ := os.ReadFile(filename)
+		file.Close()
+		if errors.Is(err, errLockHeld) {
+			return nil, fmt.Errorf("%s '%s' is in use by another iplsd instance (pid %s); check address_file and timeout_dir in each config", key, path, strings.TrimSpace(string(pid)))
+		}
+		return nil, fmt.Errorf("%s: lock failed: %v", filename, err)
+	}
+	err = file.Truncate(0)
+	if err == nil {
+		_, err = file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// release the watchlist and timeout directory locks
+func (s *Scanner) unlockInstance() {
+	for _, file := range []**os.File{&s.lockFile, &s.listLockFile} {
+		if *file != nil {
+			(*file).Close()
+			*file = nil
+		}
+	}
+}
+
+// release the watchlist and timeout directory so another scanner may use them; Run calls this when it returns,
+// a scanner whose goroutines are never started must call it when done
+func (s *Scanner) Close() error {
+	s.unlockInstance()
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+
+package scanner
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// take a non-blocking exclusive flock on file
+func lockExclusive(file *os.File) error {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return errLockHeld
+	}
+	return err
+}
@@ -0,0 +1,90 @@
+package scanner
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// event fields added to a structured log record
+type fields map[string]any
+
+// writes each log record as a single JSON line; plain log output becomes a "log" event
+type jsonLogWriter struct {
+	lock     sync.Mutex
+	out      io.Writer
+	instance string
+}
+
+// route the standard logger through a jsonLogWriter, returning it for structured events; a
+// non-empty instance is added to every record
+func newJSONLogWriter(instance string) *jsonLogWriter {
+	writer := &jsonLogWriter{out: log.Writer(), instance: instance}
+	log.SetFlags(0)
+	log.SetOutput(writer)
+	return writer
+}
+
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		err := w.writeRecord("log", fields{}, line)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *jsonLogWriter) writeRecord(event string, values fields, message string) error {
+	record := fields{}
+	for key, value := range values {
+		record[key] = value
+	}
+	record["event"] = event
+	if w.instance != "" {
+		record["instance"] = w.instance
+	}
+	record["timestamp"] = time.Now().Format(time.RFC3339Nano)
+	record["message"] = message
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	_, err = w.out.Write(append(data, '\n'))
+	return err
+}
+
+// set up log_format and, for text, prefix every line of the standard logger with the instance name
+func (s *Scanner) setupLogging() error {
+	switch s.LogFormat {
+	case "", "text":
+		s.LogFormat = "text"
+		if s.InstanceName != "" {
+			log.SetPrefix("[" + s.InstanceName + "] ")
+			log.SetFlags(log.Flags() | log.Lmsgprefix)
+		}
+	case "json":
+		s.jsonLog = newJSONLogWriter(s.InstanceName)
+	default:
+		return fmt.Errorf("unknown log_format '%s'; expected 'text' or 'json'", s.LogFormat)
+	}
+	return nil
+}
+
+// log a significant event as text or, with log_format json, as a structured record
+func (s *Scanner) event(event string, values fields, format string, args ...any) {
+	if s.jsonLog == nil {
+		log.Printf(format, args...)
+		return
+	}
+	err := s.jsonLog.writeRecord(event, values, strings.TrimSpace(fmt.Sprintf(format, args...)))
+	if err != nil {
+		log.Printf("failed writing log record: %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package scanner
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// add an address or network to the watchlist with the configured timeout, running the add command
+func (s *Scanner) Add(entry string) (string, error) {
+	addr, ok := normalizeEntry(entry)
+	if !ok {
+		return "", fmt.Errorf("invalid address '%s'", entry)
+	}
+	err := s.writeTimeoutFile(addr, "")
+	if err != nil {
+		return "", err
+	}
+	action, err := s.addAddress(addr, "", "")
+	if err != nil {
+		return "", err
+	}
+	return action, nil
+}
+
+// remove an address or network from the watchlist and delete its timeout file, running the delete command
+func (s *Scanner) Remove(entry string) (string, error) {
+	addr, ok := normalizeEntry(entry)
+	if !ok {
+		return "", fmt.Errorf("invalid address '%s'", entry)
+	}
+	action, err := s.removeAddress(addr, "")
+	if err != nil {
+		return "", err
+	}
+	err = s.deleteTimeoutFile(addr)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	return action, nil
+}
+
+// remove every watchlist address, running the delete command and deleting the timeout file for each,
+// then delete the released records of expired addresses; returns the number of addresses removed,
+// stopping at the first failure.  Only those files are deleted: an address added while the flush runs
+// writes its timeout file before it reaches the watchlist, and must keep it.
+func (s *Scanner) Flush() (int, error) {
+	addrs, err := s.readAddressFile()
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, addr := range addrs {
+		record, _ := readTimeoutFile(filepath.Join(s.TimeoutDir, timeoutFilename(addr)))
+		_, err := s.removeAddress(addr, record.Pattern)
+		if err != nil {
+			return removed, fmt.Errorf("flush failed for %s: %v", addr, err)
+		}
+		err = s.deleteTimeoutFile(addr)
+		if err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		removed++
+	}
+	if s.FlushInterval > 0 {
+		err := s.flushBatch()
+		if err != nil {
+			return removed, err
+		}
+	}
+	entries, err := os.ReadDir(s.TimeoutDir)
+	if err != nil && !os.IsNotExist(err) {
+		return removed, err
+	}
+	for _, entry := range entries {
+		if !isTimeoutFile(entry) {
+			continue
+		}
+		filename := filepath.Join(s.TimeoutDir, entry.Name())
+		record, err := readTimeoutFile(filename)
+		if err != nil || !record.Released {
+			continue
+		}
+		if s.DryRun {
+			log.Printf("dry-run: would delete timeout file %s\n", entry.Name())
+			continue
+		}
+		err = os.Remove(filename)
+		if err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+	}
+	s.event("flush", fields{"removed": removed}, "flush: removed %d addresses from %s\n", removed, s.AddressFile)
+	return removed, nil
+}
@@ -0,0 +1,92 @@
+package scanner
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// counters exported on /metrics
+type metrics struct {
+	lines         atomic.Int64
+	matches       atomic.Int64
+	added         atomic.Int64
+	expired       atomic.Int64
+	commandErrors atomic.Int64
+	throttled     atomic.Int64
+}
+
+// serve /metrics and /healthz on ListenAddress until the context is done
+func (s *Scanner) metricsServer(ctx context.Context, startChan chan struct{}) error {
+	defer func() {
+		log.Println("metrics: exiting")
+		s.active.Delete("metrics")
+		s.shutdown("metrics")
+	}()
+	listener, err := net.Listen("tcp", s.ListenAddress)
+	if err != nil {
+		startChan <- struct{}{}
+		return fmt.Errorf("metrics: %v", err)
+	}
+	server := &http.Server{Handler: s.metricsHandler()}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	s.metricsListener = listener
+	s.active.Store("metrics", true)
+	log.Printf("metrics: listening on %s\n", listener.Addr())
+	startChan <- struct{}{}
+	err = server.Serve(listener)
+	if err != http.ErrServerClosed {
+		return fmt.Errorf("metrics: %v", err)
+	}
+	return nil
+}
+
+func (s *Scanner) metricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		addrs, err := s.readAddressFile()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		// not instance, which Prometheus sets to the scrape target
+		labels := ""
+		if s.InstanceName != "" {
+			labels = fmt.Sprintf("{instance_name=%q}", s.InstanceName)
+		}
+		for _, metric := range []struct {
+			name  string
+			kind  string
+			help  string
+			value int64
+		}{
+			{"iplsd_lines_total", "counter", "Log lines read.", s.metrics.lines.Load()},
+			{"iplsd_matches_total", "counter", "Log lines matched with a valid address.", s.metrics.matches.Load()},
+			{"iplsd_addresses_added_total", "counter", "Addresses added to the watchlist.", s.metrics.added.Load()},
+			{"iplsd_addresses_expired_total", "counter", "Addresses removed from the watchlist on expiration.", s.metrics.expired.Load()},
+			{"iplsd_command_errors_total", "counter", "Add and delete commands that failed.", s.metrics.commandErrors.Load()},
+			{"iplsd_adds_throttled_total", "counter", "Adds dropped by max_adds_per_minute.", s.metrics.throttled.Load()},
+			{"iplsd_watchlist_size", "gauge", "Addresses currently in the watchlist.", int64(len(addrs))},
+		} {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s%s %d\n", metric.name, metric.help, metric.name, metric.kind, metric.name, labels, metric.value)
+		}
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		for _, name := range []string{"scanner", "reaper"} {
+			_, ok := s.active.Load(name)
+			if !ok {
+				http.Error(w, name+" is not running", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	return mux
+}
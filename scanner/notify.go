@@ -0,0 +1,68 @@
+package scanner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"time"
+)
+
+// body posted to NotifyURL
+type Notification struct {
+	Event    string `json:"event"`
+	Address  string `json:"address"`
+	Pattern  string `json:"pattern"`
+	Timeout  int64  `json:"timeout"`
+	Country  string `json:"country,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+}
+
+// post a notification to NotifyURL in the background; failures are only logged
+func (s *Scanner) notify(event, addr, pattern string, timeout time.Duration) {
+	if s.NotifyURL == "" {
+		return
+	}
+	notification := Notification{
+		Event:   event,
+		Address: addr,
+		Pattern: pattern,
+		Timeout: int64(timeout / time.Second),
+		Country: s.country(addr),
+	}
+	go func() {
+		notification.Hostname = s.hostname(addr)
+		err := s.postNotification(notification)
+		if err != nil {
+			log.Printf("notify: %s %s failed: %v\n", event, addr, err)
+		}
+	}()
+}
+
+// the timeout recorded for an address, or zero when it has no timeout file
+func (s *Scanner) recordTimeout(addr string) time.Duration {
+	record, err := readTimeoutFile(filepath.Join(s.TimeoutDir, timeoutFilename(addr)))
+	if err != nil {
+		return 0
+	}
+	return record.Expiration.Sub(record.LastSeen)
+}
+
+func (s *Scanner) postNotification(notification Notification) error {
+	data, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	client := http.Client{Timeout: s.NotifyTimeout}
+	response, err := client.Post(s.NotifyURL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("unexpected status: %s", response.Status)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package scanner
+
+import (
+	"fmt"
+	"log"
+)
+
+// read on_match_command, run for each match in addition to the add and delete commands
+func readOnMatchCommand() (string, []string, error) {
+	command, args, err := splitCommand(ViperGetString("on_match_command"))
+	if err != nil {
+		return "", nil, fmt.Errorf("on_match_command: %v", err)
+	}
+	err = lookupCommand(command)
+	if err != nil {
+		return "", nil, err
+	}
+	return command, args, nil
+}
+
+// run OnMatchCommand for a match of addr; its arguments are substituted and its environment set
+// as for add_command, with IPLSD_EVENT=match.
+// It runs in the command pool when there is one, and a failure is only logged.
+func (s *Scanner) onMatch(addr, pattern, line string) {
+	s.configLock.RLock()
+	command := s.OnMatchCommand
+	args := s.OnMatchArgs
+	s.configLock.RUnlock()
+	if command == "" {
+		return
+	}
+	timeout := s.recordTimeout(addr)
+	args = commandArgs(args, []string{addr}, pattern, timeout)
+	env := commandEnv("match", []string{addr}, pattern, line, timeout)
+	s.submit(addr, func() {
+		err := s.exec(command, args, env)
+		if err != nil {
+			log.Printf("scanner: on_match_command failed for %s: %v\n", addr, err)
+		}
+	})
+}
@@ -0,0 +1,95 @@
+package scanner
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// uid and gid given to written files; -1 leaves either unchanged
+type fileOwner struct {
+	uid int
+	gid int
+}
+
+var noOwner = fileOwner{uid: -1, gid: -1}
+
+// parse an octal permission string such as 0640, returning defaultMode when value is empty
+func parseFileMode(key, value string, defaultMode os.FileMode) (os.FileMode, error) {
+	if value == "" {
+		return defaultMode, nil
+	}
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("%s '%s' is not an octal permission mode", key, value)
+	}
+	return os.FileMode(mode), nil
+}
+
+// resolve an owner of the form user or user:group; a user alone keeps each file's group
+func parseFileOwner(value string) (fileOwner, error) {
+	owner := noOwner
+	if value == "" {
+		return owner, nil
+	}
+	name, group, hasGroup := strings.Cut(value, ":")
+	account, err := user.Lookup(name)
+	if err != nil {
+		return owner, fmt.Errorf("file_owner: %v", err)
+	}
+	owner.uid, err = strconv.Atoi(account.Uid)
+	if err != nil {
+		return owner, fmt.Errorf("file_owner: user '%s' has non-numeric uid %s", name, account.Uid)
+	}
+	if hasGroup {
+		entry, err := user.LookupGroup(group)
+		if err != nil {
+			return owner, fmt.Errorf("file_owner: %v", err)
+		}
+		owner.gid, err = strconv.Atoi(entry.Gid)
+		if err != nil {
+			return owner, fmt.Errorf("file_owner: group '%s' has non-numeric gid %s", group, entry.Gid)
+		}
+	}
+	return owner, nil
+}
+
+// set mode and owner on a newly created file or directory; the mode given at creation is reduced by the umask
+func setPermissions(path string, mode os.FileMode, owner fileOwner) error {
+	err := os.Chmod(path, mode)
+	if err != nil {
+		return err
+	}
+	if owner != noOwner {
+		return os.Chown(path, owner.uid, owner.gid)
+	}
+	return nil
+}
+
+// timeout files get the timeout directory mode without its search bits
+func (s *Scanner) timeoutFileMode() os.FileMode {
+	return s.TimeoutDirMode &^ 0111
+}
+
+// default the unset modes and resolve FileOwner; ownership is only changed when running as root
+func (s *Scanner) checkPermissions() error {
+	if s.WatchlistMode == 0 {
+		s.WatchlistMode = 0600
+	}
+	if s.TimeoutDirMode == 0 {
+		s.TimeoutDirMode = 0700
+	}
+	var err error
+	s.owner, err = parseFileOwner(s.FileOwner)
+	if err != nil {
+		return err
+	}
+	if s.owner != noOwner && os.Geteuid() != 0 {
+		log.Printf("file_owner '%s' ignored; not running as root\n", s.FileOwner)
+		s.owner = noOwner
+	}
+	return nil
+}
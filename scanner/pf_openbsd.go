@@ -0,0 +1,115 @@
+//go:build openbsd
+
+package scanner
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const pfSupported = true
+
+const pfTableNameSize = 32
+
+// struct pfr_table from net/pfvar.h
+type pfrTable struct {
+	Anchor [1024]byte
+	Name   [pfTableNameSize]byte
+	Flags  uint32
+	Fback  uint8
+	_      [3]byte
+}
+
+// struct pfr_addr from net/pfvar.h
+type pfrAddr struct {
+	Addr   [16]byte
+	Ifname [16]byte
+	States uint32
+	Weight uint16
+	AF     uint8
+	Net    uint8
+	Not    uint8
+	Fback  uint8
+	Type   uint8
+	_      [7]byte
+}
+
+// struct pfioc_table from net/pfvar.h
+type pfiocTable struct {
+	Table   pfrTable
+	Buffer  unsafe.Pointer
+	Esize   int32
+	Size    int32
+	Size2   int32
+	Nadd    int32
+	Ndel    int32
+	Nchange int32
+	Flags   int32
+	Ticket  uint32
+}
+
+// _IOWR('D', n, struct pfioc_table)
+func pfTableRequest(n uintptr) uintptr {
+	return 0xc0000000 | (unsafe.Sizeof(pfiocTable{})&0x1fff)<<16 | 'D'<<8 | n
+}
+
+var (
+	diocrAddAddrs = pfTableRequest(67)
+	diocrDelAddrs = pfTableRequest(68)
+)
+
+// add or delete an address or network in a pf table through the /dev/pf ioctl interface
+func pfTable(action, table, entry string) error {
+	var addr pfrAddr
+	ip, network, err := net.ParseCIDR(entry)
+	if err != nil {
+		ip = net.ParseIP(entry)
+		if ip == nil {
+			return fmt.Errorf("pf table %s: invalid address '%s'", table, entry)
+		}
+		network = nil
+	}
+	if v4 := ip.To4(); v4 != nil {
+		copy(addr.Addr[:], v4)
+		addr.AF = syscall.AF_INET
+		addr.Net = 32
+	} else {
+		copy(addr.Addr[:], ip.To16())
+		addr.AF = syscall.AF_INET6
+		addr.Net = 128
+	}
+	if network != nil {
+		ones, _ := network.Mask.Size()
+		addr.Net = uint8(ones)
+	}
+
+	var request uintptr
+	switch action {
+	case "add":
+		request = diocrAddAddrs
+	case "delete":
+		request = diocrDelAddrs
+	default:
+		return fmt.Errorf("pf table %s: unknown action '%s'", table, action)
+	}
+
+	var io pfiocTable
+	copy(io.Table.Name[:], table)
+	io.Buffer = unsafe.Pointer(&addr)
+	io.Esize = int32(unsafe.Sizeof(addr))
+	io.Size = 1
+
+	file, err := os.OpenFile("/dev/pf", os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), request, uintptr(unsafe.Pointer(&io)))
+	if errno != 0 {
+		return fmt.Errorf("pf table %s: %s %s failed: %v", table, action, entry, errno)
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !openbsd
+
+package scanner
+
+import "fmt"
+
+const pfSupported = false
+
+const pfTableNameSize = 32
+
+func pfTable(action, table, entry string) error {
+	return fmt.Errorf("pf table %s: pf_table is only supported on OpenBSD", table)
+}
@@ -0,0 +1,79 @@
+package scanner
+
+import (
+	"log"
+)
+
+// start the command pool when CommandWorkers is set; until then, and in a scanner that is never
+// started, commands run inline
+func (s *Scanner) startPool() {
+	if s.CommandWorkers > 0 {
+		s.commandChains = make(map[string]chan struct{})
+		s.commandSlots = make(chan struct{}, s.CommandWorkers)
+	}
+}
+
+// run the add or delete command for addr and handle its result; in the pool the caller only waits
+// for a free worker, so matching continues while the command runs
+func (s *Scanner) runBackend(action, addr, pattern, line string) error {
+	if s.commandSlots == nil || s.PFTable != "" || s.FlushInterval > 0 {
+		ran, err := s.backend(action, addr, pattern, line)
+		return s.backendResult(action, addr, pattern, ran, err)
+	}
+	s.submit(addr, func() {
+		ran, err := s.backend(action, addr, pattern, line)
+		err = s.backendResult(action, addr, pattern, ran, err)
+		if err != nil {
+			log.Printf("pool: %v\n", err)
+		}
+	})
+	return nil
+}
+
+// run job in the command pool, or inline when the pool is not running
+func (s *Scanner) submit(addr string, job func()) {
+	if s.commandSlots == nil {
+		job()
+		return
+	}
+	s.commandSlots <- struct{}{}
+	// held shared until the job finishes so shutdown waits for queued commands too
+	s.poolLock.RLock()
+	// jobs for one address run in the order they were submitted
+	done := make(chan struct{})
+	s.chainLock.Lock()
+	previous := s.commandChains[addr]
+	s.commandChains[addr] = done
+	s.chainLock.Unlock()
+	go func() {
+		defer func() {
+			s.chainLock.Lock()
+			if s.commandChains[addr] == done {
+				delete(s.commandChains, addr)
+			}
+			s.chainLock.Unlock()
+			close(done)
+			s.poolLock.RUnlock()
+			<-s.commandSlots
+		}()
+		if previous != nil {
+			<-previous
+		}
+		job()
+	}()
+}
+
+// a failed command is not fatal; it is queued for retry when retry_file is set
+func (s *Scanner) backendResult(action, addr, pattern string, ran bool, err error) error {
+	if err != nil {
+		log.Printf("scanner: %s command failed for %s: %v\n", action, addr, err)
+		if s.RetryFile != "" {
+			return s.queueRetry(action, addr, pattern, err)
+		}
+		return nil
+	}
+	if ran {
+		return s.clearRetry(addr)
+	}
+	return nil
+}
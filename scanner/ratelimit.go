@@ -0,0 +1,45 @@
+package scanner
+
+import (
+	"sync"
+	"time"
+)
+
+// token bucket holding up to MaxAddsPerMin adds, refilled at MaxAddsPerMin a minute
+type addLimiter struct {
+	lock      sync.Mutex
+	tokens    float64
+	last      time.Time
+	throttled int
+}
+
+// take a token for an add of a matched address when MaxAddsPerMin is set; an add without one is
+// dropped with a warning before its timeout file is written, and its next match adds it once the
+// rate allows.  Adds through the control socket or the add command are not limited
+func (s *Scanner) allowAdd(addr string) bool {
+	if s.MaxAddsPerMin == 0 {
+		return true
+	}
+	limiter := &s.limiter
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	now := time.Now()
+	limit := float64(s.MaxAddsPerMin)
+	limiter.tokens = min(limit, limiter.tokens+now.Sub(limiter.last).Minutes()*limit)
+	limiter.last = now
+	if limiter.tokens >= 1 {
+		limiter.tokens--
+		if limiter.throttled > 0 {
+			s.event("throttle", fields{"throttled": limiter.throttled}, "scanner: adds resumed under max_adds_per_minute %d after %d were throttled\n", s.MaxAddsPerMin, limiter.throttled)
+			limiter.throttled = 0
+		}
+		return true
+	}
+	limiter.throttled++
+	s.metrics.throttled.Add(1)
+	// the first drop of a burst is always logged, then the 10th, 100th, ... so a flood does not fill the log
+	if isPowerOfTen(limiter.throttled) {
+		s.event("throttle", fields{"address": addr, "throttled": limiter.throttled}, "scanner: WARNING: more than max_adds_per_minute %d adds; %s not added to %s (%d throttled); check the patterns for a runaway match\n", s.MaxAddsPerMin, addr, s.AddressFile, limiter.throttled)
+	}
+	return false
+}
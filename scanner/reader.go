@@ -0,0 +1,122 @@
+package scanner
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// source of log lines for the scanner; both channels are closed when the source ends or is stopped
+type LineReader interface {
+	Lines() <-chan string
+	Errors() <-chan string
+	Stop()
+}
+
+// line source reading an io.Reader such as stdin until EOF
+type ioReader struct {
+	lines    chan string
+	errors   chan string
+	stop     chan struct{}
+	stopOnce sync.Once
+	pending  lineBuilder
+}
+
+// lines longer than this are truncated before matching, so a runaway line cannot exhaust memory
+const defaultMaxLineLength = 65536
+
+// a line assembled from reads, keeping at most max bytes and counting those discarded
+type lineBuilder struct {
+	max     int
+	text    []byte
+	dropped int
+}
+
+func (b *lineBuilder) add(chunk []byte) {
+	n := min(len(chunk), b.max-len(b.text))
+	b.text = append(b.text, chunk[:n]...)
+	b.dropped += len(chunk) - n
+}
+
+func (b *lineBuilder) empty() bool {
+	return len(b.text) == 0 && b.dropped == 0
+}
+
+// return the line with surrounding space removed, and a notice when it was truncated
+func (b *lineBuilder) take() (string, string) {
+	line := strings.TrimSpace(string(b.text))
+	notice := ""
+	if b.dropped > 0 {
+		notice = fmt.Sprintf("line truncated to max_line_length %d; %d bytes discarded", b.max, b.dropped)
+	}
+	b.text = b.text[:0]
+	b.dropped = 0
+	return line, notice
+}
+
+// lines read ahead of the scanner, so a burst is taken off the pipe while a slow command runs
+const defaultLineBuffer = 1024
+
+func NewIOReader(r io.Reader) LineReader {
+	return newIOReader(r, defaultLineBuffer, defaultMaxLineLength)
+}
+
+func newIOReader(r io.Reader, buffer, maxLine int) LineReader {
+	reader := &ioReader{
+		lines:   make(chan string, buffer),
+		errors:  make(chan string, 1),
+		stop:    make(chan struct{}),
+		pending: lineBuilder{max: maxLine},
+	}
+	go reader.run(r)
+	return reader
+}
+
+func (r *ioReader) Lines() <-chan string {
+	return r.lines
+}
+
+func (r *ioReader) Errors() <-chan string {
+	return r.errors
+}
+
+func (r *ioReader) Stop() {
+	r.stopOnce.Do(func() { close(r.stop) })
+}
+
+func (r *ioReader) send(channel chan string, line string) bool {
+	select {
+	case channel <- line:
+		return true
+	case <-r.stop:
+		return false
+	}
+}
+
+func (r *ioReader) run(input io.Reader) {
+	defer close(r.errors)
+	defer close(r.lines)
+	reader := bufio.NewReader(input)
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		r.pending.add(chunk)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil && r.pending.empty() {
+			if err != io.EOF {
+				r.send(r.errors, fmt.Sprintf("read failed: %v", err))
+			}
+			return
+		}
+		line, notice := r.pending.take()
+		if notice != "" && !r.send(r.errors, notice) {
+			return
+		}
+		if !r.send(r.lines, line) {
+			return
+		}
+	}
+}
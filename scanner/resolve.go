@@ -0,0 +1,46 @@
+package scanner
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+// reverse DNS lookups; net.DefaultResolver in production, a stub in tests
+type ptrResolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// a PTR lookup slower than this is treated as having no name
+const ptrTimeout = 2 * time.Second
+
+// return the PTR name of addr when ResolvePTR is set, or "" when it has none or the lookup fails;
+// results, including failures, are cached so a flooding address is looked up once
+func (s *Scanner) hostname(addr string) string {
+	if !s.ResolvePTR || net.ParseIP(addr) == nil {
+		return ""
+	}
+	s.ptrLock.Lock()
+	name, ok := s.hostnames[addr]
+	s.ptrLock.Unlock()
+	if ok {
+		return name
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ptrTimeout)
+	defer cancel()
+	names, err := s.resolver.LookupAddr(ctx, addr)
+	if err == nil && len(names) > 0 {
+		name = strings.TrimSuffix(names[0], ".")
+	} else if err != nil && s.verbose {
+		s.event("resolve", fields{"address": addr}, "scanner: PTR lookup of %s failed: %v\n", addr, err)
+	}
+	s.ptrLock.Lock()
+	defer s.ptrLock.Unlock()
+	// bound the cache; a scan flood should not grow it without limit
+	if len(s.hostnames) >= 65536 {
+		clear(s.hostnames)
+	}
+	s.hostnames[addr] = name
+	return name
+}
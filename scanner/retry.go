@@ -0,0 +1,171 @@
+package scanner
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// failed add or delete command pending retry
+type RetryAction struct {
+	Action      string    `json:"action"`
+	Address     string    `json:"address"`
+	Pattern     string    `json:"pattern,omitempty"`
+	FirstFailed time.Time `json:"first_failed"`
+	LastAttempt time.Time `json:"last_attempt"`
+	Attempts    int       `json:"attempts"`
+	Error       string    `json:"error"`
+}
+
+// read the retry queue file; a missing file is an empty queue
+func ReadRetryQueue(filename string) ([]RetryAction, error) {
+	retries := []RetryAction{}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return retries, nil
+		}
+		return nil, err
+	}
+	if len(data) == 0 {
+		return retries, nil
+	}
+	err = json.Unmarshal(data, &retries)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing retry queue '%s': %v", filename, err)
+	}
+	return retries, nil
+}
+
+// return a copy of the pending retry queue
+func (s *Scanner) PendingRetries() []RetryAction {
+	s.retryLock.Lock()
+	defer s.retryLock.Unlock()
+	return append([]RetryAction{}, s.retries...)
+}
+
+// caller must hold retryLock
+func (s *Scanner) writeRetryQueue() error {
+	data, err := json.MarshalIndent(s.retries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed marshalling retry queue: %v", err)
+	}
+	return writeFileAtomic(s.RetryFile, append(data, '\n'), 0600, noOwner)
+}
+
+// persist a failed action; a newer action for an address replaces any pending one
+func (s *Scanner) queueRetry(action, addr, pattern string, cmdErr error) error {
+	s.retryLock.Lock()
+	defer s.retryLock.Unlock()
+	now := time.Now()
+	log.Printf("retry: queueing %s %s: %v\n", action, addr, cmdErr)
+	for i, retry := range s.retries {
+		if retry.Address == addr {
+			if retry.Action == action {
+				s.retries[i].Pattern = pattern
+				s.retries[i].LastAttempt = now
+				s.retries[i].Attempts++
+				s.retries[i].Error = cmdErr.Error()
+				return s.writeRetryQueue()
+			}
+			s.retries = append(s.retries[:i], s.retries[i+1:]...)
+			break
+		}
+	}
+	s.retries = append(s.retries, RetryAction{
+		Action:      action,
+		Address:     addr,
+		Pattern:     pattern,
+		FirstFailed: now,
+		LastAttempt: now,
+		Attempts:    1,
+		Error:       cmdErr.Error(),
+	})
+	return s.writeRetryQueue()
+}
+
+// drop any pending action for an address after a command for it succeeds
+func (s *Scanner) clearRetry(addr string) error {
+	if s.RetryFile == "" {
+		return nil
+	}
+	s.retryLock.Lock()
+	defer s.retryLock.Unlock()
+	for i, retry := range s.retries {
+		if retry.Address == addr {
+			log.Printf("retry: dropping pending %s %s\n", retry.Action, addr)
+			s.retries = append(s.retries[:i], s.retries[i+1:]...)
+			return s.writeRetryQueue()
+		}
+	}
+	return nil
+}
+
+// rerun each queued action, dropping those that succeed or exceed RetryMaxAge
+func (s *Scanner) retryPending() error {
+	if s.RetryFile == "" {
+		return nil
+	}
+	// run the commands without holding retryLock so queueRetry never waits on a slow backend
+	s.retryLock.Lock()
+	snapshot := append([]RetryAction{}, s.retries...)
+	s.retryLock.Unlock()
+	if len(snapshot) == 0 {
+		return nil
+	}
+	// a batched action only succeeds once the flush runs its command; flushBatch then clears
+	// the entry, or queues it again with another attempt counted
+	batched := s.FlushInterval > 0 && s.PFTable == ""
+	results := make(map[RetryAction]*RetryAction)
+	for _, retry := range snapshot {
+		if batched && time.Since(retry.FirstFailed) > s.RetryMaxAge {
+			log.Printf("retry: giving up on %s %s after %d attempts: %s\n", retry.Action, retry.Address, retry.Attempts, retry.Error)
+			results[retry] = nil
+			continue
+		}
+		var err error
+		switch retry.Action {
+		case "add", "delete":
+			_, err = s.backend(retry.Action, retry.Address, retry.Pattern, "")
+		default:
+			err = fmt.Errorf("unknown action '%s'", retry.Action)
+		}
+		if err == nil && batched {
+			log.Printf("retry: %s %s queued for the next batch\n", retry.Action, retry.Address)
+			continue
+		}
+		if err == nil {
+			log.Printf("retry: %s %s succeeded after %d failed attempts\n", retry.Action, retry.Address, retry.Attempts)
+			results[retry] = nil
+			continue
+		}
+		updated := retry
+		updated.LastAttempt = time.Now()
+		updated.Attempts++
+		updated.Error = err.Error()
+		if updated.LastAttempt.Sub(updated.FirstFailed) > s.RetryMaxAge {
+			log.Printf("retry: giving up on %s %s after %d attempts: %v\n", retry.Action, retry.Address, updated.Attempts, err)
+			results[retry] = nil
+			continue
+		}
+		results[retry] = &updated
+	}
+
+	// merge: entries queued, replaced or cleared while the commands ran take precedence
+	s.retryLock.Lock()
+	defer s.retryLock.Unlock()
+	pending := []RetryAction{}
+	for _, retry := range s.retries {
+		result, ok := results[retry]
+		switch {
+		case !ok:
+			pending = append(pending, retry)
+		case result != nil:
+			pending = append(pending, *result)
+		}
+	}
+	s.retries = pending
+	return s.writeRetryQueue()
+}
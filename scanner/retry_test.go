@@ -0,0 +1,116 @@
+package scanner
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadRetryQueue(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "retry.json")
+	retries, err := ReadRetryQueue(filename)
+	require.Nil(t, err)
+	require.Empty(t, retries)
+	require.Nil(t, os.WriteFile(filename, []byte(`[{"action":"add","address":"192.0.2.1","attempts":2}]`), 0600))
+	retries, err = ReadRetryQueue(filename)
+	require.Nil(t, err)
+	require.Len(t, retries, 1)
+	require.Equal(t, "add", retries[0].Action)
+	require.Equal(t, 2, retries[0].Attempts)
+	require.Nil(t, os.WriteFile(filename, []byte("garbage"), 0600))
+	_, err = ReadRetryQueue(filename)
+	require.NotNil(t, err)
+}
+
+func TestQueueRetry(t *testing.T) {
+	dir := initTestConfig(t)
+	ViperSet("retry_file", filepath.Join(dir, "retry.json"))
+	ViperSet("retry_max_age_seconds", "3600")
+	s := newTestScanner(t)
+	require.Nil(t, s.queueRetry("add", "192.0.2.1", "", errors.New("backend down")))
+	require.Nil(t, s.queueRetry("add", "192.0.2.1", "", errors.New("backend down")))
+	require.Nil(t, s.queueRetry("add", "192.0.2.2", "", errors.New("backend down")))
+	retries, err := ReadRetryQueue(s.RetryFile)
+	require.Nil(t, err)
+	require.Len(t, retries, 2)
+	require.Equal(t, 2, retries[0].Attempts)
+	// a newer action for the same address replaces the pending one
+	require.Nil(t, s.queueRetry("delete", "192.0.2.1", "", errors.New("backend down")))
+	retries = s.PendingRetries()
+	require.Len(t, retries, 2)
+	require.Equal(t, "192.0.2.2", retries[0].Address)
+	require.Equal(t, "delete", retries[1].Action)
+}
+
+func TestRetryPending(t *testing.T) {
+	dir := initTestConfig(t)
+	ViperSet("retry_file", filepath.Join(dir, "retry.json"))
+	ViperSet("retry_max_age_seconds", "3600")
+	ViperSet("add_command", "false")
+	ViperSet("delete_command", "true")
+	s := newTestScanner(t)
+	require.Nil(t, s.queueRetry("add", "192.0.2.1", "", errors.New("backend down")))
+	require.Nil(t, s.queueRetry("delete", "192.0.2.2", "", errors.New("backend down")))
+	require.Nil(t, s.retryPending())
+	retries := s.PendingRetries()
+	require.Len(t, retries, 1)
+	require.Equal(t, "add", retries[0].Action)
+	require.Equal(t, 2, retries[0].Attempts)
+	s.AddCommand = "true"
+	require.Nil(t, s.retryPending())
+	require.Empty(t, s.PendingRetries())
+	persisted, err := ReadRetryQueue(s.RetryFile)
+	require.Nil(t, err)
+	require.Empty(t, persisted)
+}
+
+func TestRetryClearedBySuccess(t *testing.T) {
+	dir := initTestConfig(t)
+	ViperSet("retry_file", filepath.Join(dir, "retry.json"))
+	ViperSet("retry_max_age_seconds", "3600")
+	ViperSet("add_command", "false")
+	ViperSet("delete_command", "true")
+	s := newTestScanner(t)
+	// the add fails and is queued, then the expiry delete succeeds
+	_, err := s.addAddress("192.0.2.1", "", "")
+	require.Nil(t, err)
+	require.Len(t, s.PendingRetries(), 1)
+	_, err = s.removeAddress("192.0.2.1", "")
+	require.Nil(t, err)
+	require.Empty(t, s.PendingRetries())
+	persisted, err := ReadRetryQueue(s.RetryFile)
+	require.Nil(t, err)
+	require.Empty(t, persisted)
+}
+
+func TestRetryPendingBatched(t *testing.T) {
+	dir := initTestConfig(t)
+	ViperSet("retry_file", filepath.Join(dir, "retry.json"))
+	ViperSet("retry_max_age_seconds", "3600")
+	ViperSet("flush_interval", "1h")
+	ViperSet("add_command", "false")
+	s := newTestScanner(t)
+	require.Nil(t, s.queueRetry("add", "192.0.2.1", "", errors.New("backend down")))
+	// queued for the batch, the retry stays pending until the flush reports its result
+	require.Nil(t, s.retryPending())
+	retries := s.PendingRetries()
+	require.Len(t, retries, 1)
+	require.Equal(t, 1, retries[0].Attempts)
+	require.Nil(t, s.flushBatch())
+	retries = s.PendingRetries()
+	require.Len(t, retries, 1)
+	require.Equal(t, 2, retries[0].Attempts)
+
+	s.AddCommand = "true"
+	require.Nil(t, s.retryPending())
+	require.Len(t, s.PendingRetries(), 1)
+	require.Nil(t, s.flushBatch())
+	require.Empty(t, s.PendingRetries())
+	persisted, err := ReadRetryQueue(s.RetryFile)
+	require.Nil(t, err)
+	require.Empty(t, persisted)
+}
@@ -0,0 +1,219 @@
+package scanner
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// timeout, command and mode overrides for one pattern; zero values use the scanner defaults
+type PatternRule struct {
+	Timeout       time.Duration
+	IPGroup       int
+	AddCommand    string
+	AddArgs       []string
+	DeleteCommand string
+	DeleteArgs    []string
+	Observe       bool
+}
+
+// compile the flat patterns, those in patterns_file, and the structured patterns entries, returning all patterns and the rules for those with overrides
+//
+//	patterns:
+//	  - 'plain ((?:\d{1,3}\.){3}\d{1,3})'
+//	  - regex: 'spam from ((?:\d{1,3}\.){3}\d{1,3})'
+//	    timeout_seconds: 604800
+//	    ip_group: 1
+//	    add_command: pfctl -t spam -T add
+//	    delete_command: pfctl -t spam -T delete
+//	  - regex: 'probe from ((?:\d{1,3}\.){3}\d{1,3})'
+//	    mode: observe
+func readPatternRules(flat []string) ([]*regexp.Regexp, map[string]PatternRule, error) {
+	regexes := append([]string{}, flat...)
+	patternsFile := ViperGetString("patterns_file")
+	if patternsFile != "" {
+		filed, err := ReadPatternsFile(patternsFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		regexes = append(regexes, filed...)
+	}
+	rules := make(map[string]PatternRule)
+	entries, ok := ViperGet("patterns").([]any)
+	if !ok && ViperGet("patterns") != nil {
+		return nil, nil, fmt.Errorf("patterns must be a list")
+	}
+	for i, entry := range entries {
+		switch entry := entry.(type) {
+		case string:
+			regexes = append(regexes, entry)
+		case map[string]any:
+			regex, ok := entry["regex"].(string)
+			if !ok || regex == "" {
+				return nil, nil, fmt.Errorf("patterns[%d]: missing regex", i)
+			}
+			rule, err := parsePatternRule(entry)
+			if err != nil {
+				return nil, nil, fmt.Errorf("patterns[%d]: %v", i, err)
+			}
+			regexes = append(regexes, regex)
+			rules[regex] = rule
+		default:
+			return nil, nil, fmt.Errorf("patterns[%d]: expected a regex string or a map", i)
+		}
+	}
+	unique := []string{}
+	for _, regex := range regexes {
+		if !slices.Contains(unique, regex) {
+			unique = append(unique, regex)
+		}
+	}
+	patterns, err := compilePatterns(unique)
+	if err != nil {
+		return nil, nil, err
+	}
+	return patterns, rules, nil
+}
+
+// read a file of one regex per line, skipping blank lines and # comment lines; surrounding
+// whitespace is removed, so a regex matching a leading or trailing space must use \s or [ ]
+func ReadPatternsFile(filename string) ([]string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	regexes := []string{}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		_, err := regexp.Compile(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: regex does not compile: %v", filename, i+1, err)
+		}
+		regexes = append(regexes, line)
+	}
+	return regexes, nil
+}
+
+// return the configured flat and structured pattern regexes
+func ConfiguredPatterns(flat []string) ([]string, error) {
+	patterns, _, err := readPatternRules(flat)
+	if err != nil {
+		return nil, err
+	}
+	regexes := []string{}
+	for _, pattern := range patterns {
+		regexes = append(regexes, pattern.String())
+	}
+	return regexes, nil
+}
+
+func parsePatternRule(entry map[string]any) (PatternRule, error) {
+	rule := PatternRule{}
+	for key, value := range entry {
+		switch key {
+		case "regex":
+		case "timeout_seconds":
+			timeout, err := time.ParseDuration(fmt.Sprint(value) + "s")
+			if err != nil {
+				return rule, fmt.Errorf("ParseDuration (timeout_seconds) failed: %v", err)
+			}
+			if timeout <= 0 {
+				return rule, fmt.Errorf("timeout_seconds must be greater than zero")
+			}
+			rule.Timeout = timeout
+		case "ip_group":
+			group, ok := value.(int)
+			if !ok || group < 1 {
+				return rule, fmt.Errorf("ip_group must be a positive integer")
+			}
+			rule.IPGroup = group
+		case "mode":
+			switch value {
+			case "block":
+				rule.Observe = false
+			case "observe":
+				rule.Observe = true
+			default:
+				return rule, fmt.Errorf("mode must be 'block' or 'observe'")
+			}
+		case "add_command", "delete_command":
+			command, args, err := splitCommand(fmt.Sprint(value))
+			if err != nil {
+				return rule, fmt.Errorf("%s: %v", key, err)
+			}
+			err = lookupCommand(command)
+			if err != nil {
+				return rule, err
+			}
+			if key == "add_command" {
+				rule.AddCommand, rule.AddArgs = command, args
+			} else {
+				rule.DeleteCommand, rule.DeleteArgs = command, args
+			}
+		default:
+			return rule, fmt.Errorf("unknown key '%s'", key)
+		}
+	}
+	return rule, nil
+}
+
+// return true if pattern only observes its matches; they are logged but never added
+func (s *Scanner) observed(pattern string) bool {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+	return s.rules[pattern].Observe
+}
+
+// an address a pattern extracted from a line; Address is empty when Capture is not a valid address
+type PatternMatch struct {
+	Pattern string
+	Capture string
+	Address string
+}
+
+// matches lines against the configured patterns as the scanner does, honoring match_programs, match_all,
+// strict_boundaries and xff_mode, with no other effect
+type PatternTester struct {
+	scanner *Scanner
+}
+
+// compile the flat patterns with those configured in patterns_file and patterns
+func NewPatternTester(flat []string) (*PatternTester, error) {
+	patterns, rules, err := readPatternRules(flat)
+	if err != nil {
+		return nil, err
+	}
+	s := Scanner{
+		Patterns:      patterns,
+		MatchAll:      ViperGetBool("match_all"),
+		StrictBounds:  ViperGetBool("strict_boundaries"),
+		MatchPrograms: ViperGetStringSlice("match_programs"),
+		XFFMode:       ViperGetBool("xff_mode"),
+		rules:         rules,
+	}
+	// xff_mode skips allowlisted proxies
+	allowlistFile := ViperGetString("allowlist_file")
+	if s.XFFMode && allowlistFile != "" {
+		s.allowlist, err = ReadAllowlist(allowlistFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &PatternTester{scanner: &s}, nil
+}
+
+// return each capture of the patterns in line, in pattern order
+func (p *PatternTester) Match(line string) []PatternMatch {
+	matches := []PatternMatch{}
+	for _, captured := range p.scanner.lineCaptures(line) {
+		addr, _ := normalizeAddress(captured.capture)
+		matches = append(matches, PatternMatch{Pattern: captured.pattern.String(), Capture: captured.capture, Address: addr})
+	}
+	return matches
+}
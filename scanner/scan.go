@@ -0,0 +1,53 @@
+package scanner
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// process every line of filename once, as the live scanner would, returning the number of lines read;
+// gzip-compressed files are decompressed, and the reaper and other goroutines are not started
+func (s *Scanner) ScanFile(filename string) (int, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	// rotated logs may be compressed whatever they are named, so check the gzip magic number
+	magic, err := reader.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %v", filename, err)
+		}
+		defer gz.Close()
+		reader = bufio.NewReader(gz)
+	}
+	lines := 0
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			lines++
+			perr := s.processLine(strings.TrimSpace(line))
+			if perr != nil {
+				return lines, perr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return lines, fmt.Errorf("%s: %v", filename, err)
+		}
+	}
+	err = s.writeMatchFile()
+	if err != nil {
+		return lines, err
+	}
+	return lines, s.writeStats()
+}
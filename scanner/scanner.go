@@ -3,144 +3,1341 @@ package scanner
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math/rand/v2"
+	"net"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"regexp"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
+	"unicode"
+
+	"github.com/spf13/viper"
 )
 
 type Scanner struct {
-	LogFile        string
-	AddressFile    string
-	TimeoutDir     string
-	AddressTimeout time.Duration
-	TickInterval   time.Duration
-	Patterns       []*regexp.Regexp
-	AddCommand     string
-	AddArgs        []string
-	DeleteCommand  string
-	DeleteArgs     []string
-	tail           *exec.Cmd
-	tailStdout     chan string
-	tailStderr     chan string
-	reaperErr      chan error
-	scannerErr     chan error
-	handlerErr     chan error
-	scannerStop    chan struct{}
-	reaperStop     chan struct{}
-	handlerStop    chan struct{}
-	started        bool
-	wg             sync.WaitGroup
-	verbose        bool
-	shutdownLock   sync.Mutex
-	active         sync.Map
-}
-
-var IP_PATTERN = regexp.MustCompile(`((?:\d{1,3}\.){3}\d{1,3})`)
-
-func NewScanner(logFile, AddressFile, TimeoutDir string, patterns []string) (*Scanner, error) {
-	timeout, err := time.ParseDuration(ViperGetString("timeout_seconds") + "s")
-	if err != nil {
-		return nil, fmt.Errorf("ParseDuration (timeout_seconds) failed: %v", err)
-	}
-	interval, err := time.ParseDuration(ViperGetString("interval_seconds") + "s")
-	if err != nil {
-		return nil, fmt.Errorf("ParseDuration (interval_seconds) failed: %v", err)
+	LogFile         string
+	AddressFile     string
+	TimeoutDir      string
+	WatchlistMode   os.FileMode
+	TimeoutDirMode  os.FileMode
+	FileOwner       string
+	AddressTimeout  time.Duration
+	TickInterval    time.Duration
+	IntervalJitter  float64
+	Patterns        []*regexp.Regexp
+	AddCommand      string
+	AddArgs         []string
+	DeleteCommand   string
+	DeleteArgs      []string
+	OnMatchCommand  string
+	OnMatchArgs     []string
+	SoftTimeoutCmd  string
+	SoftTimeoutArgs []string
+	SoftTimeoutFrac float64
+	TimeLayout      string
+	MaxLineAge      time.Duration
+	StartupGrace    time.Duration
+	SkipBeforeStart bool
+	RetryFile       string
+	RetryMaxAge     time.Duration
+	HistoryFile     string
+	HistoryMaxSize  int
+	HistoryKeep     int
+	FollowSymlink   bool
+	SymlinkInterval time.Duration
+	MatchFile       string
+	StatsFile       string
+	AllowlistFile   string
+	GeoIPDB         string
+	CountryAllow    []string
+	CountryBlock    []string
+	ResolvePTR      bool
+	MatchAll        bool
+	StrictBounds    bool
+	MatchPrograms   []string
+	AnnotateList    bool
+	ForceAdd        bool
+	CleanupOnExit   bool
+	ListMode        string
+	XFFMode         bool
+	BlockPrefixV4   int
+	MatchThreshold  int
+	MatchWindow     time.Duration
+	MinBlock        time.Duration
+	ClockSkewGrace  time.Duration
+	BackoffFactor   float64
+	TimeoutMax      time.Duration
+	ControlSocket   string
+	ListenAddress   string
+	SkipPrivate     bool
+	SlidingWindow   bool
+	DryRun          bool
+	LogFormat       string
+	InstanceName    string
+	NotifyURL       string
+	MaxWatchlist    int
+	MaxAddsPerMin   int
+	PFTable         string
+	NotifyTimeout   time.Duration
+	CommandRetries  int
+	CommandBackoff  time.Duration
+	FollowMode      string
+	FollowBackend   string
+	PollInterval    time.Duration
+	FollowRestarts  int
+	LineBuffer      int
+	MaxLineLength   int
+	Sources         []Source
+	FlushInterval   time.Duration
+	BatchSize       int
+	CommandWorkers  int
+	MatchBudget     time.Duration
+	DisableSlow     bool
+	ShutdownTimeout time.Duration
+	stdin           io.Reader
+	reader          LineReader
+	jsonLog         *jsonLogWriter
+	tailStdout      <-chan string
+	tailStderr      <-chan string
+	sourceLevels    []*sourceLevel
+	sourceFollows   []*follower
+	sourceReady     chan struct{}
+	results         chan goprocResult
+	goprocs         int
+	metricsListener net.Listener
+	metrics         metrics
+	rules           map[string]PatternRule
+	ctx             context.Context
+	cancel          context.CancelFunc
+	started         bool
+	wg              sync.WaitGroup
+	commandLock     sync.RWMutex
+	poolLock        sync.RWMutex
+	commandSlots    chan struct{}
+	chainLock       sync.Mutex
+	commandChains   map[string]chan struct{}
+	verbose         bool
+	viperConfig     bool
+	shutdownLock    sync.Mutex
+	active          sync.Map
+	configLock      sync.RWMutex
+	addressLock     sync.Mutex
+	watchlist       watchlistCache
+	present         map[string]bool
+	matchLock       sync.Mutex
+	lastMatch       map[string]MatchState
+	matchChanged    bool
+	staleLines      int64
+	startTime       time.Time
+	owner           fileOwner
+	lockFile        *os.File
+	listLockFile    *os.File
+	retryLock       sync.Mutex
+	retries         []RetryAction
+	limiter         addLimiter
+	historyLock     sync.Mutex
+	allowlist       []*net.IPNet
+	geoip           *geoipDB
+	geoipLock       sync.Mutex
+	countries       map[string]string
+	resolver        ptrResolver
+	ptrLock         sync.Mutex
+	hostnames       map[string]string
+	countLock       sync.Mutex
+	matchCounts     map[string]matchCount
+	statsLock       sync.Mutex
+	stats           MatchStats
+	slowLock        sync.Mutex
+	slowCounts      map[string]int
+	disabled        map[string]bool
+	batchLock       sync.Mutex
+	batch           []batchEntry
+	flushNow        chan struct{}
+	sweepNow        chan struct{}
+}
+
+// matches of one address within MatchWindow
+type matchCount struct {
+	Count int
+	Last  time.Time
+}
+
+// most recent line matched by a pattern
+type MatchState struct {
+	Pattern string    `json:"pattern"`
+	Line    string    `json:"line"`
+	Time    time.Time `json:"time"`
+}
+
+// the address must not be part of a longer dotted or word token, so "OpenSSH_1.2.3.4" and "10.1.2.3.4" do not match
+var IP_PATTERN = regexp.MustCompile(`(?:^|[^0-9A-Za-z_.])((?:\d{1,3}\.){3}\d{1,3})(?:$|[^0-9A-Za-z_.]|\.(?:$|[^0-9A-Za-z_]))`)
+
+// the address must not be adjacent to other address or word characters, so "std::string" does not match
+var IP6_PATTERN = regexp.MustCompile(`(?:^|[^0-9A-Za-z_:.])((?:[0-9A-Fa-f]{1,4}:){7}[0-9A-Fa-f]{1,4}|(?:[0-9A-Fa-f]{1,4}:){0,6}[0-9A-Fa-f]{0,4}::(?:[0-9A-Fa-f]{1,4}:){0,6}[0-9A-Fa-f]{0,4})(?:$|[^0-9A-Za-z_:.])`)
+
+// parse an address, returning its canonical form so IPv6 spellings and IPv4-mapped addresses compare equal
+func normalizeAddress(addr string) (string, bool) {
+	ip := net.ParseIP(addr)
+	if ip == nil || ip.IsUnspecified() {
+		return "", false
+	}
+	return ip.String(), true
+}
+
+// parse a CIDR network; an IPv4-mapped IPv6 network is returned as the IPv4 network it covers, as
+// normalizeAddress does for a mapped address, so it is compared with IPv4 addresses
+func parseNetwork(cidr string) (*net.IPNet, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := network.Mask.Size()
+	if v4 := network.IP.To4(); v4 != nil && bits == 8*net.IPv6len && ones >= 96 {
+		return &net.IPNet{IP: v4, Mask: net.CIDRMask(ones-96, 8*net.IPv4len)}, nil
+	}
+	return network, nil
+}
+
+// parse a watchlist entry, either an address or a CIDR network, returning its canonical form
+func normalizeEntry(entry string) (string, bool) {
+	if strings.Contains(entry, "/") {
+		network, err := parseNetwork(entry)
+		if err != nil {
+			return "", false
+		}
+		return network.String(), true
+	}
+	return normalizeAddress(entry)
+}
+
+// return true if addr is an IPv4 or IPv6 address the scanner would act on
+func ValidAddress(addr string) bool {
+	_, ok := normalizeAddress(addr)
+	return ok
+}
+
+// return the canonical form of the first address captured by pattern in line, using the group named ip
+// or group 1 exactly as the scanner does
+func ExtractAddress(pattern *regexp.Regexp, line string) (string, bool) {
+	captures, err := captureAddresses(pattern, 0, line, 1, false)
+	if err != nil || len(captures) == 0 {
+		return "", false
+	}
+	return normalizeAddress(captures[0])
+}
+
+// return the canonical form of the first IPv4 address in line, or failing that the first IPv6 address
+func ExtractAnyAddress(line string) (string, bool) {
+	for _, pattern := range []*regexp.Regexp{IP_PATTERN, IP6_PATTERN} {
+		addr, ok := ExtractAddress(pattern, line)
+		if ok {
+			return addr, true
+		}
+	}
+	return "", false
+}
+
+// split a normalized address or network into its IPv4 or IPv6 bytes and prefix length
+func entryKey(entry string) (net.IP, int) {
+	ip := net.ParseIP(entry)
+	ones := -1
+	if ip == nil {
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, 0
+		}
+		ip = network.IP
+		ones, _ = network.Mask.Size()
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4, ones
+	}
+	return ip, ones
+}
+
+// sort entries numerically, IPv4 before IPv6 and addresses before the networks they start, dropping duplicates
+func sortAddresses(addrs []string) []string {
+	sorted := slices.Clone(addrs)
+	slices.SortFunc(sorted, func(a, b string) int {
+		aIP, aOnes := entryKey(a)
+		bIP, bOnes := entryKey(b)
+		if len(aIP) != len(bIP) {
+			return len(aIP) - len(bIP)
+		}
+		if c := bytes.Compare(aIP, bIP); c != 0 {
+			return c
+		}
+		if aOnes != bOnes {
+			return aOnes - bOnes
+		}
+		return strings.Compare(a, b)
+	})
+	return slices.Compact(sorted)
+}
+
+// return true if SkipPrivate is set and the address or network is private, loopback, link-local, or multicast
+func (s *Scanner) skipAddress(entry string) bool {
+	if !s.SkipPrivate {
+		return false
+	}
+	ip := net.ParseIP(entry)
+	if ip != nil {
+		return privateAddress(ip)
+	}
+	network, err := parseNetwork(entry)
+	if err != nil {
+		return false
 	}
+	return privateNetwork(network)
+}
+
+// return true if ip is private, loopback, link-local, multicast, or unspecified
+func privateAddress(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsMulticast() || ip.IsUnspecified()
+}
+
+// the ranges privateAddress tests for, other than the unspecified addresses
+var privateRanges = func() []*net.IPNet {
+	ranges := []*net.IPNet{}
+	for _, cidr := range []string{
+		"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "127.0.0.0/8", "169.254.0.0/16", "224.0.0.0/4",
+		"fc00::/7", "::1/128", "fe80::/10", "ff00::/8",
+	} {
+		_, network, _ := net.ParseCIDR(cidr)
+		ranges = append(ranges, network)
+	}
+	return ranges
+}()
+
+// return true if the whole network lies within one private range of its own address family
+func privateNetwork(network *net.IPNet) bool {
+	ones, bits := network.Mask.Size()
+	for _, private := range privateRanges {
+		privateOnes, privateBits := private.Mask.Size()
+		if bits == privateBits && ones >= privateOnes && private.Contains(network.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// return the original client of a comma-separated X-Forwarded-For list: the first public address
+// that is not allowlisted, skipping private and trusted proxy addresses, with any port removed
+func (s *Scanner) forwardedClient(list string) (string, bool) {
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		addr, ok := normalizeAddress(field)
+		if !ok {
+			host, _, err := net.SplitHostPort(field)
+			if err != nil {
+				continue
+			}
+			addr, ok = normalizeAddress(host)
+			if !ok {
+				continue
+			}
+		}
+		if privateAddress(net.ParseIP(addr)) {
+			continue
+		}
+		_, trusted := s.allowlisted(addr)
+		if trusted {
+			continue
+		}
+		return addr, true
+	}
+	return "", false
+}
+
+// timeout files are named for their entry with IPv6 colons and CIDR slashes percent-encoded
+func timeoutFilename(addr string) string {
+	return url.QueryEscape(addr)
+}
+
+func filenameAddress(name string) (string, error) {
+	return url.QueryUnescape(name)
+}
+
+// reader optionally replaces the monitored file as the source of log lines
+func NewScanner(logFile, AddressFile, TimeoutDir string, patterns []string, reader ...LineReader) (*Scanner, error) {
+	cfg, err := ConfigFromViper(logFile, AddressFile, TimeoutDir, patterns)
+	if err != nil {
+		return nil, configError(err)
+	}
+	if len(reader) > 0 {
+		cfg.Reader = reader[0]
+	}
+	s, err := NewScannerFromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s.viperConfig = true
+	return s, nil
+}
+
+// build a scanner from cfg without reading viper, creating the address file and timeout directory
+// and locking the directory as NewScanner does. SIGHUP does not reload its configuration.
+func NewScannerFromConfig(cfg Config) (*Scanner, error) {
+	s, err := newScanner(cfg)
+	if err != nil {
+		return nil, configError(err)
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	initialized := false
+	addrs := []string{}
+	if s.DryRun {
+		log.Println("dry-run: the watchlist, timeout files, and commands will not be changed or run")
+		if IsFile(s.AddressFile) {
+			addrs, err = s.readAddressFile()
+			if err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		if !IsDir(s.TimeoutDir) {
+			log.Printf("creating timeout directory: '%s'\n", s.TimeoutDir)
+			err := os.Mkdir(s.TimeoutDir, s.TimeoutDirMode)
+			if err == nil {
+				err = setPermissions(s.TimeoutDir, s.TimeoutDirMode, s.owner)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		if !IsFile(s.AddressFile) {
+			log.Printf("creating address file: '%s'\n", s.AddressFile)
+			err := os.WriteFile(s.AddressFile, []byte(""), s.WatchlistMode)
+			if err == nil {
+				err = setPermissions(s.AddressFile, s.WatchlistMode, s.owner)
+			}
+			if err != nil {
+				return nil, err
+			}
+
+		}
+		err = s.lockInstance()
+		if err != nil {
+			return nil, err
+		}
+		// a scanner that fails to initialize releases the directory
+		defer func() {
+			if !initialized {
+				s.unlockInstance()
+			}
+		}()
+		err = s.upgradeTimeoutFiles()
+		if err != nil {
+			return nil, err
+		}
+		addrs, err = s.readAddressFile()
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, addr := range addrs {
+		s.present[addr] = true
+		if s.skipAddress(addr) {
+			log.Printf("not rearming private address %s in %s\n", addr, s.AddressFile)
+			continue
+		}
+		record, err := readTimeoutFile(filepath.Join(s.TimeoutDir, timeoutFilename(addr)))
+		if err != nil && !os.IsNotExist(err) && !s.DryRun {
+			return nil, err
+		}
+		if err != nil || record.Released {
+			err := s.writeTimeoutFile(addr, "")
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if !s.DryRun {
+		err = s.reconcile(addrs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s.verbose {
+		log.Println(FormatJSON(s))
+	}
+	initialized = true
+	return s, nil
+}
+
+// check the configuration exactly as NewScanner does, without creating, locking or modifying any file
+func CheckConfig(logFile, addressFile, timeoutDir string, patterns []string) error {
+	cfg, err := ConfigFromViper(logFile, addressFile, timeoutDir, patterns)
+	if err != nil {
+		return configError(err)
+	}
+	_, err = newScanner(cfg)
+	return configError(err)
+}
+
+// check cfg and build a new Scanner from it; nothing is written and no goroutine is started
+func newScanner(cfg Config) (*Scanner, error) {
 	s := Scanner{
-		AddressFile:    AddressFile,
-		TimeoutDir:     TimeoutDir,
-		Patterns:       []*regexp.Regexp{},
-		TickInterval:   interval,
-		AddressTimeout: timeout,
-		LogFile:        logFile,
-		reaperStop:     make(chan struct{}, 1),
-		reaperErr:      make(chan error, 1),
-		scannerStop:    make(chan struct{}, 1),
-		scannerErr:     make(chan error, 1),
-		handlerStop:    make(chan struct{}, 1),
-		handlerErr:     make(chan error, 1),
-		tailStdout:     make(chan string, 1),
-		tailStderr:     make(chan string, 1),
-		verbose:        ViperGetBool("verbose"),
-	}
-
-	addCommand := strings.Split(ViperGetString("add_command"), " ")
-	s.AddCommand = addCommand[0]
-	if len(addCommand) > 1 {
-		s.AddArgs = addCommand[1:]
-	}
-
-	deleteCommand := strings.Split(ViperGetString("delete_command"), " ")
-	s.DeleteCommand = deleteCommand[0]
-	if len(deleteCommand) > 1 {
-		s.DeleteArgs = deleteCommand[1:]
+		LogFile:         cfg.LogFile,
+		AddressFile:     cfg.AddressFile,
+		TimeoutDir:      cfg.TimeoutDir,
+		WatchlistMode:   cfg.WatchlistMode,
+		TimeoutDirMode:  cfg.TimeoutDirMode,
+		FileOwner:       cfg.FileOwner,
+		AddressTimeout:  cfg.AddressTimeout,
+		TickInterval:    cfg.TickInterval,
+		IntervalJitter:  cfg.IntervalJitter,
+		AddCommand:      cfg.AddCommand,
+		AddArgs:         cfg.AddArgs,
+		DeleteCommand:   cfg.DeleteCommand,
+		DeleteArgs:      cfg.DeleteArgs,
+		OnMatchCommand:  cfg.OnMatchCommand,
+		OnMatchArgs:     cfg.OnMatchArgs,
+		SoftTimeoutCmd:  cfg.SoftTimeoutCmd,
+		SoftTimeoutArgs: cfg.SoftTimeoutArgs,
+		SoftTimeoutFrac: cfg.SoftTimeoutFrac,
+		TimeLayout:      cfg.TimeLayout,
+		MaxLineAge:      cfg.MaxLineAge,
+		StartupGrace:    cfg.StartupGrace,
+		SkipBeforeStart: cfg.SkipBeforeStart,
+		RetryFile:       cfg.RetryFile,
+		RetryMaxAge:     cfg.RetryMaxAge,
+		HistoryFile:     cfg.HistoryFile,
+		HistoryMaxSize:  cfg.HistoryMaxSize,
+		HistoryKeep:     cfg.HistoryKeep,
+		FollowSymlink:   cfg.FollowSymlink,
+		SymlinkInterval: cfg.SymlinkInterval,
+		MatchFile:       cfg.MatchFile,
+		StatsFile:       cfg.StatsFile,
+		AllowlistFile:   cfg.AllowlistFile,
+		GeoIPDB:         cfg.GeoIPDB,
+		CountryAllow:    countryCodes(cfg.CountryAllow),
+		CountryBlock:    countryCodes(cfg.CountryBlock),
+		ResolvePTR:      cfg.ResolvePTR,
+		MatchAll:        cfg.MatchAll,
+		StrictBounds:    cfg.StrictBounds,
+		MatchPrograms:   cfg.MatchPrograms,
+		AnnotateList:    cfg.AnnotateList,
+		ForceAdd:        cfg.ForceAdd,
+		CleanupOnExit:   cfg.CleanupOnExit,
+		ListMode:        cfg.ListMode,
+		XFFMode:         cfg.XFFMode,
+		BlockPrefixV4:   cfg.BlockPrefixV4,
+		MatchThreshold:  cfg.MatchThreshold,
+		MatchWindow:     cfg.MatchWindow,
+		MinBlock:        cfg.MinBlock,
+		ClockSkewGrace:  cfg.ClockSkewGrace,
+		BackoffFactor:   cfg.BackoffFactor,
+		TimeoutMax:      cfg.TimeoutMax,
+		ControlSocket:   cfg.ControlSocket,
+		ListenAddress:   cfg.ListenAddress,
+		SkipPrivate:     cfg.SkipPrivate,
+		SlidingWindow:   cfg.SlidingWindow,
+		DryRun:          cfg.DryRun,
+		LogFormat:       cfg.LogFormat,
+		InstanceName:    cfg.InstanceName,
+		NotifyURL:       cfg.NotifyURL,
+		MaxWatchlist:    cfg.MaxWatchlist,
+		MaxAddsPerMin:   cfg.MaxAddsPerMin,
+		PFTable:         cfg.PFTable,
+		NotifyTimeout:   cfg.NotifyTimeout,
+		CommandRetries:  cfg.CommandRetries,
+		CommandBackoff:  cfg.CommandBackoff,
+		FollowMode:      cfg.FollowMode,
+		FollowBackend:   cfg.FollowBackend,
+		PollInterval:    cfg.PollInterval,
+		FollowRestarts:  cfg.FollowRestarts,
+		LineBuffer:      cfg.LineBuffer,
+		MaxLineLength:   cfg.MaxLineLength,
+		Sources:         cfg.Sources,
+		FlushInterval:   cfg.FlushInterval,
+		BatchSize:       cfg.BatchSize,
+		CommandWorkers:  cfg.CommandWorkers,
+		MatchBudget:     cfg.MatchBudget,
+		DisableSlow:     cfg.DisableSlow,
+		ShutdownTimeout: cfg.ShutdownTimeout,
+		reader:          cfg.Reader,
+		rules:           make(map[string]PatternRule),
+		results:         make(chan goprocResult, maxGoprocs),
+		flushNow:        make(chan struct{}, 1),
+		sweepNow:        make(chan struct{}, 1),
+		lastMatch:       make(map[string]MatchState),
+		matchCounts:     make(map[string]matchCount),
+		present:         make(map[string]bool),
+		stats:           newMatchStats(),
+		verbose:         cfg.Verbose,
+		stdin:           os.Stdin,
+		resolver:        net.DefaultResolver,
+		hostnames:       make(map[string]string),
+		startTime:       time.Now(),
+	}
+	var err error
+
+	if s.AddressTimeout <= 0 {
+		return nil, fmt.Errorf("timeout must be greater than zero")
+	}
+	if s.TickInterval <= 0 {
+		return nil, fmt.Errorf("interval must be greater than zero")
+	}
+	for _, command := range []string{s.AddCommand, s.DeleteCommand, s.OnMatchCommand, s.SoftTimeoutCmd} {
+		err = lookupCommand(command)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.Patterns, err = compilePatterns(cfg.Patterns)
+	if err != nil {
+		return nil, err
+	}
+	for regex, rule := range cfg.Rules {
+		if !slices.Contains(cfg.Patterns, regex) {
+			return nil, fmt.Errorf("rule for regex '%s' that is not one of the patterns", regex)
+		}
+		for _, command := range []string{rule.AddCommand, rule.DeleteCommand} {
+			err = lookupCommand(command)
+			if err != nil {
+				return nil, err
+			}
+		}
+		s.rules[regex] = rule
+	}
+
+	if s.FollowRestarts < 0 {
+		return nil, fmt.Errorf("follower_restarts must not be negative")
+	}
+	if s.CommandRetries < 0 {
+		return nil, fmt.Errorf("command_retries must not be negative")
+	}
+
+	if s.MaxLineAge != 0 && s.TimeLayout == "" {
+		return nil, fmt.Errorf("max_line_age requires timestamp_layout")
+	}
+	if s.SkipBeforeStart && s.TimeLayout == "" {
+		return nil, fmt.Errorf("skip_before_start requires timestamp_layout")
+	}
+
+	switch s.FollowMode {
+	case "":
+		s.FollowMode = "name"
+	case "name", "descriptor":
+	default:
+		return nil, fmt.Errorf("unknown follow_mode '%s'; expected 'name' or 'descriptor'", s.FollowMode)
+	}
+
+	switch s.FollowBackend {
+	case "":
+		s.FollowBackend = "poll"
+	case "poll":
+	case "inotify":
+		if !inotifySupported {
+			return nil, fmt.Errorf("follow_backend inotify is only supported on Linux")
+		}
+	case "tail":
+		return nil, fmt.Errorf("follow_backend tail is no longer supported; the native follower replaced it, use 'poll' or 'inotify'")
+	default:
+		return nil, fmt.Errorf("unknown follow_backend '%s'; expected 'poll' or 'inotify'", s.FollowBackend)
+	}
+
+	if s.PollInterval <= 0 {
+		return nil, fmt.Errorf("poll_interval_seconds must be greater than zero")
+	}
+	if s.LineBuffer < 0 {
+		return nil, fmt.Errorf("line_buffer must not be negative")
+	}
+	if s.LineBuffer == 0 {
+		s.LineBuffer = defaultLineBuffer
+	}
+	if s.MaxLineLength < 0 {
+		return nil, fmt.Errorf("max_line_length must not be negative")
+	}
+	if s.MaxLineLength == 0 {
+		s.MaxLineLength = defaultMaxLineLength
+	}
+
+	for i, source := range s.Sources {
+		if source.File == "" || source.File == "-" {
+			return nil, fmt.Errorf("sources[%d]: a source must be a file", i)
+		}
+	}
+
+	if s.FollowSymlink && s.LogFile == "-" {
+		return nil, fmt.Errorf("follow_symlink cannot be used with stdin")
+	}
+
+	if s.RetryFile != "" {
+		s.retries, err = ReadRetryQueue(s.RetryFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if s.HistoryMaxSize < 0 {
+		return nil, fmt.Errorf("history_max_size must not be negative")
+	}
+	if s.HistoryKeep < 0 {
+		return nil, fmt.Errorf("history_keep must not be negative")
+	}
+	if s.HistoryKeep == 0 {
+		s.HistoryKeep = defaultHistoryKeep
+	}
+
+	if s.BackoffFactor < 1 {
+		return nil, fmt.Errorf("timeout_backoff_factor must be at least 1")
+	}
+	if s.BackoffFactor > 1 && s.TimeoutMax < s.AddressTimeout {
+		return nil, fmt.Errorf("timeout_max_seconds must not be less than timeout_seconds")
 	}
 
+	if s.MatchThreshold == 0 {
+		s.MatchThreshold = 1
+	}
+	if s.MatchThreshold < 1 {
+		return nil, fmt.Errorf("match_threshold must be at least 1")
+	}
+	if s.MatchThreshold > 1 && s.MatchWindow <= 0 {
+		return nil, fmt.Errorf("match_threshold requires match_window")
+	}
+	if s.ClockSkewGrace < 0 {
+		return nil, fmt.Errorf("clock_skew_grace must not be negative")
+	}
+
+	if s.BlockPrefixV4 == 0 {
+		s.BlockPrefixV4 = 32
+	}
+	if s.BlockPrefixV4 < 1 || s.BlockPrefixV4 > 32 {
+		return nil, fmt.Errorf("block_prefix_v4 must be between 1 and 32")
+	}
+
+	// both modes list matched addresses until they stop appearing; only what the list means differs
+	switch s.ListMode {
+	case "", "block":
+		s.ListMode = "block"
+	case "allow":
+		// strikes and network blocks punish offenders; they would grant returning or neighbouring clients more access
+		if s.BackoffFactor > 1 {
+			return nil, fmt.Errorf("timeout_backoff_factor is not supported with list_mode allow")
+		}
+		if s.BlockPrefixV4 != 32 {
+			return nil, fmt.Errorf("block_prefix_v4 is not supported with list_mode allow")
+		}
+	default:
+		return nil, fmt.Errorf("list_mode must be 'block' or 'allow'")
+	}
+
+	if s.MaxWatchlist < 0 {
+		return nil, fmt.Errorf("max_watchlist_size must not be negative")
+	}
+	if s.MaxAddsPerMin < 0 {
+		return nil, fmt.Errorf("max_adds_per_minute must not be negative")
+	}
+	s.limiter.tokens = float64(s.MaxAddsPerMin)
+	s.limiter.last = s.startTime
+	if s.BatchSize < 0 {
+		return nil, fmt.Errorf("batch_size must not be negative")
+	}
+	if s.CommandWorkers < 0 {
+		return nil, fmt.Errorf("command_workers must not be negative")
+	}
+
+	if s.DisableSlow && s.MatchBudget == 0 {
+		return nil, fmt.Errorf("disable_slow_patterns requires match_budget")
+	}
+	s.resetSlowPatterns()
+
+	if s.SoftTimeoutFrac == 0 {
+		s.SoftTimeoutFrac = defaultSoftFraction
+	}
+	if s.SoftTimeoutFrac <= 0 || s.SoftTimeoutFrac >= 1 {
+		return nil, fmt.Errorf("soft_timeout_fraction must be greater than 0 and less than 1")
+	}
+	if s.IntervalJitter < 0 || s.IntervalJitter >= 1 {
+		return nil, fmt.Errorf("interval_jitter must be at least 0 and less than 1")
+	}
+
+	if s.AllowlistFile != "" {
+		s.allowlist, err = ReadAllowlist(s.AllowlistFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s.GeoIPDB != "" {
+		s.geoip, err = openGeoIP(s.GeoIPDB)
+		if err != nil {
+			return nil, err
+		}
+		s.countries = make(map[string]string)
+	}
+	if s.StatsFile != "" {
+		s.stats, err = ReadStatsFile(s.StatsFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s.MatchFile != "" {
+		matches, err := ReadMatchFile(s.MatchFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, state := range matches {
+			s.lastMatch[state.Pattern] = state
+		}
+	}
+	err = s.setupLogging()
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.checkPermissions()
+	if err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// read key as a Go duration string (example: 24h), or when key is not set, key_seconds as a number of seconds
+func ConfiguredDuration(key string) (time.Duration, error) {
+	var duration time.Duration
+	var err error
+	value := ViperGetString(key)
+	if value != "" {
+		duration, err = time.ParseDuration(value)
+		if err != nil {
+			return 0, fmt.Errorf("ParseDuration (%s) failed: %v", key, err)
+		}
+	} else {
+		key += "_seconds"
+		duration, err = time.ParseDuration(ViperGetString(key) + "s")
+		if err != nil {
+			return 0, fmt.Errorf("ParseDuration (%s) failed: %v", key, err)
+		}
+	}
+	if duration <= 0 {
+		return 0, fmt.Errorf("%s must be greater than zero", key)
+	}
+	return duration, nil
+}
+
+// read the add and delete commands, returning an error if either is not found on PATH
+func readCommands() (string, []string, string, []string, error) {
+	addCommand, addArgs, deleteCommand, deleteArgs, err := parseCommands()
+	if err != nil {
+		return "", nil, "", nil, err
+	}
+	for _, command := range []string{addCommand, deleteCommand} {
+		err := lookupCommand(command)
+		if err != nil {
+			return "", nil, "", nil, err
+		}
+	}
+	return addCommand, addArgs, deleteCommand, deleteArgs, nil
+}
+
+// parse the add and delete commands from either add_command/delete_command or command with add_args/delete_args
+func parseCommands() (string, []string, string, []string, error) {
+	addCommand, addArgs, err := splitCommand(ViperGetString("add_command"))
+	if err != nil {
+		return "", nil, "", nil, fmt.Errorf("add_command: %v", err)
+	}
+	deleteCommand, deleteArgs, err := splitCommand(ViperGetString("delete_command"))
+	if err != nil {
+		return "", nil, "", nil, fmt.Errorf("delete_command: %v", err)
+	}
+
+	baseCommand := ViperGetStringSlice("command")
+	if len(baseCommand) > 0 {
+		if addCommand != "" || deleteCommand != "" {
+			return "", nil, "", nil, fmt.Errorf("command conflicts with add_command/delete_command; configure one or the other")
+		}
+		addCommand, addArgs = structuredCommand(baseCommand, ViperGetStringSlice("add_args"))
+		deleteCommand, deleteArgs = structuredCommand(baseCommand, ViperGetStringSlice("delete_args"))
+	}
+	return addCommand, addArgs, deleteCommand, deleteArgs, nil
+}
+
+// split a command string into the command and its arguments with shell-like quoting: runs of
+// whitespace separate fields, single quotes keep their contents literally, and a backslash
+// escapes the next character outside quotes and a quote or backslash inside double quotes.
+// A blank string is no command.
+func splitCommand(line string) (string, []string, error) {
+	fields := []string{}
+	var field strings.Builder
+	inField := false
+	escaped := false
+	var quote rune
+	for _, c := range line {
+		switch {
+		case escaped:
+			if quote == '"' && c != '"' && c != '\\' {
+				field.WriteRune('\\')
+			}
+			field.WriteRune(c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped = true
+			inField = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				field.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inField = true
+		case unicode.IsSpace(c):
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteRune(c)
+			inField = true
+		}
+	}
+	if escaped {
+		return "", nil, fmt.Errorf("trailing backslash in '%s'", line)
+	}
+	if quote != 0 {
+		return "", nil, fmt.Errorf("unterminated %c quote in '%s'", quote, line)
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	if len(fields) == 0 {
+		return "", nil, nil
+	}
+	return fields[0], fields[1:], nil
+}
+
+// return an error if command is set and not found on PATH
+func lookupCommand(command string) error {
+	if command == "" {
+		return nil
+	}
+	_, err := exec.LookPath(command)
+	if err != nil {
+		return fmt.Errorf("command '%s' not found: %v", command, err)
+	}
+	return nil
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := []*regexp.Regexp{}
 	for _, pattern := range patterns {
 		re, err := regexp.Compile(pattern)
 		if err != nil {
 			return nil, fmt.Errorf("failed regex compile: %v", err)
 		}
-		s.Patterns = append(s.Patterns, re)
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// combine a shared base argv with per-action arguments
+func structuredCommand(base, args []string) (string, []string) {
+	argv := append(append([]string{}, base[1:]...), args...)
+	return base[0], argv
+}
+
+// repeat each argument containing an {ip} placeholder once for each address, or append the
+// addresses if there is none; {pattern} and {timeout} (in seconds) are replaced by the matching
+// regex and the address timeout
+func commandArgs(args []string, addrs []string, pattern string, timeout time.Duration) []string {
+	replacer := strings.NewReplacer("{pattern}", pattern, "{timeout}", strconv.FormatInt(int64(timeout/time.Second), 10))
+	argv := []string{}
+	substituted := false
+	for _, arg := range args {
+		arg = replacer.Replace(arg)
+		if !strings.Contains(arg, "{ip}") {
+			argv = append(argv, arg)
+			continue
+		}
+		for _, addr := range addrs {
+			argv = append(argv, strings.ReplaceAll(arg, "{ip}", addr))
+		}
+		substituted = true
+	}
+	if !substituted {
+		argv = append(argv, addrs...)
+	}
+	return argv
+}
+
+// the IPLSD_* environment given to a command: the event (add, delete, match or soft_timeout), the address or
+// space separated addresses, the pattern, the matched line and the timeout in seconds; values that
+// are not known for the command, such as the line of a delete, are empty
+func commandEnv(event string, addrs []string, pattern, line string, timeout time.Duration) []string {
+	return []string{
+		"IPLSD_EVENT=" + event,
+		"IPLSD_ADDRESS=" + strings.Join(addrs, " "),
+		"IPLSD_PATTERN=" + pattern,
+		"IPLSD_LINE=" + line,
+		"IPLSD_TIMEOUT=" + strconv.FormatInt(int64(timeout/time.Second), 10),
+	}
+}
+
+// contents of a timeout file; a released record remembers the strikes of an expired address
+type TimeoutRecord struct {
+	Address    string    `json:"address"`
+	Pattern    string    `json:"pattern,omitempty"`
+	FirstSeen  time.Time `json:"first_seen"`
+	Blocked    time.Time `json:"blocked,omitzero"`
+	LastSeen   time.Time `json:"last_seen"`
+	Expiration time.Time `json:"expiration"`
+	MatchCount int       `json:"match_count"`
+	Strikes    int       `json:"strikes"`
+	Released   bool      `json:"released,omitempty"`
+	// set once SoftTimeoutCmd has run for the current expiration
+	SoftTimedOut bool `json:"soft_timed_out,omitempty"`
+}
+
+// the time the entry was last added; records written before Blocked was kept use FirstSeen
+func (r TimeoutRecord) blockedSince() time.Time {
+	if r.Blocked.IsZero() {
+		return r.FirstSeen
+	}
+	return r.Blocked
+}
+
+// the timeout for an address matched by pattern and blocked strikes times before,
+// multiplied by BackoffFactor for each strike and capped at TimeoutMax
+func (s *Scanner) backoffTimeout(pattern string, strikes int) time.Duration {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+	timeout := s.AddressTimeout
+	rule, ok := s.rules[pattern]
+	if ok && rule.Timeout > 0 {
+		timeout = rule.Timeout
+	}
+	for i := 0; i < strikes && s.BackoffFactor > 1; i++ {
+		timeout = time.Duration(float64(timeout) * s.BackoffFactor)
+		if timeout >= s.TimeoutMax {
+			return s.TimeoutMax
+		}
+	}
+	return timeout
+}
+
+// record a match of addr by pattern and set its expiration, adding a strike if it was previously released;
+// with SlidingWindow false the expiration of an address already tracked is left unchanged
+func (s *Scanner) writeTimeoutFile(addr, pattern string) error {
+	if s.DryRun {
+		log.Printf("dry-run: would set timeout for %s\n", addr)
+		return nil
+	}
+	filename := filepath.Join(s.TimeoutDir, timeoutFilename(addr))
+	now := time.Now()
+	record, err := readTimeoutFile(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		record = TimeoutRecord{FirstSeen: now, Blocked: now}
+	} else if record.Released {
+		record.Strikes++
+		record.Released = false
+		record.Blocked = now
+	}
+	record.Address = addr
+	if pattern != "" {
+		record.Pattern = pattern
+		record.MatchCount++
+	}
+	// without SlidingWindow a tracked address keeps the expiration set when it was added
+	tracked := err == nil && !record.Released
+	record.LastSeen = now
+	if !tracked || s.SlidingWindow {
+		record.Expiration = now.Add(s.backoffTimeout(record.Pattern, record.Strikes))
+		record.SoftTimedOut = false
+	}
+	return s.writeTimeoutRecord(filename, record)
+}
+
+func (s *Scanner) writeTimeoutRecord(filename string, record TimeoutRecord) error {
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed marshalling timeout record: %v", err)
+	}
+	return writeFileAtomic(filename, append(data, '\n'), s.timeoutFileMode(), s.owner)
+}
+
+// return true if entry is a timeout file rather than a directory or a temporary file being written
+func isTimeoutFile(entry os.DirEntry) bool {
+	return entry.Type().IsRegular() && !strings.HasPrefix(entry.Name(), ".")
+}
+
+// move an unreadable timeout file into the corrupt subdirectory so one bad file never stops the reaper
+func (s *Scanner) quarantineTimeoutFile(name string, cause error) {
+	// a file removed since the directory was read is not corrupt
+	if os.IsNotExist(cause) {
+		return
+	}
+	if s.DryRun {
+		log.Printf("dry-run: would quarantine timeout file '%s': %v\n", name, cause)
+		return
 	}
-	if !IsDir(TimeoutDir) {
-		log.Printf("creating timeout directory: '%s'\n", TimeoutDir)
-		err := os.Mkdir(TimeoutDir, 0700)
+	dir := filepath.Join(s.TimeoutDir, "corrupt")
+	err := os.MkdirAll(dir, 0700)
+	if err == nil {
+		err = os.Rename(filepath.Join(s.TimeoutDir, name), filepath.Join(dir, name))
+	}
+	if err != nil {
+		log.Printf("reaper: skipping unreadable timeout file '%s': %v; quarantine failed: %v\n", name, cause, err)
+		return
+	}
+	log.Printf("reaper: moved unreadable timeout file '%s' to %s: %v\n", name, dir, cause)
+}
+
+// rewrite timeout files holding only a marshalled expiration time as JSON records
+func (s *Scanner) upgradeTimeoutFiles() error {
+	entries, err := os.ReadDir(s.TimeoutDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !isTimeoutFile(entry) {
+			continue
+		}
+		filename := filepath.Join(s.TimeoutDir, entry.Name())
+		data, err := os.ReadFile(filename)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+			continue
+		}
+		addr, err := filenameAddress(entry.Name())
+		if err != nil {
+			s.quarantineTimeoutFile(entry.Name(), err)
+			continue
+		}
+		record, err := readTimeoutFile(filename)
+		if err != nil {
+			s.quarantineTimeoutFile(entry.Name(), err)
+			continue
+		}
+		// the match that wrote the file is assumed to have set a full timeout, and to have been seen
+		// no later than now when the timeout has since been shortened
+		record.Address = addr
+		record.LastSeen = record.Expiration.Add(-s.AddressTimeout)
+		if now := time.Now(); record.LastSeen.After(now) {
+			record.LastSeen = now
+		}
+		record.FirstSeen = record.LastSeen
+		log.Printf("upgrading timeout file: '%s'\n", filename)
+		err = s.writeTimeoutRecord(filename, record)
+		if err != nil {
+			return err
 		}
 	}
-	if !IsFile(AddressFile) {
-		log.Printf("creating address file: '%s'\n", AddressFile)
-		err := os.WriteFile(AddressFile, []byte(""), 0600)
+	return nil
+}
+
+// bring the timeout directory in line with the watchlist: remove timeout files for addresses
+// that are no longer listed, then expire listed addresses whose timeouts have already passed
+func (s *Scanner) reconcile(addrs []string) error {
+	entries, err := os.ReadDir(s.TimeoutDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !isTimeoutFile(entry) {
+			continue
+		}
+		addr, err := filenameAddress(entry.Name())
 		if err != nil {
-			return nil, err
+			s.quarantineTimeoutFile(entry.Name(), err)
+			continue
+		}
+		if slices.Contains(addrs, addr) {
+			continue
 		}
+		record, err := readTimeoutFile(filepath.Join(s.TimeoutDir, entry.Name()))
+		if err != nil {
+			s.quarantineTimeoutFile(entry.Name(), err)
+			continue
+		}
+		// released records hold strikes for addresses that have already been removed
+		if record.Released {
+			continue
+		}
+		log.Printf("reconcile: removing timeout file for %s; not present in %s\n", addr, s.AddressFile)
+		err = s.deleteTimeoutFile(addr)
+		if err != nil {
+			return err
+		}
+	}
+	return s.expire()
+}
+
+// read a timeout file; a file holding only a marshalled expiration time has no strikes
+func readTimeoutFile(filename string) (TimeoutRecord, error) {
+	var record TimeoutRecord
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return record, err
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		err = json.Unmarshal(data, &record)
+	} else {
+		err = record.Expiration.UnmarshalText(data)
+	}
+	if err != nil {
+		return record, fmt.Errorf("failed umarshalling expiration from '%s': %v", filename, err)
+	}
+	return record, nil
+}
+
+// a timeout file; LastSeen is zero for a file holding only an expiration time
+type TimeoutEntry struct {
+	Address    string    `json:"address"`
+	Pattern    string    `json:"pattern,omitempty"`
+	LastSeen   time.Time `json:"last_seen"`
+	Expiration time.Time `json:"expiration"`
+	Strikes    int       `json:"strikes"`
+	Released   bool      `json:"released"`
+}
 
-	}
-	addrs, err := s.readAddressFile()
+// read all timeout files in timeoutDir without modifying them
+func ReadTimeouts(timeoutDir string) ([]TimeoutEntry, error) {
+	entries, err := os.ReadDir(timeoutDir)
 	if err != nil {
 		return nil, err
 	}
-	for _, addr := range addrs {
-		if !IsFile(filepath.Join(TimeoutDir, addr)) {
-			err := s.writeTimeoutFile(addr)
+	timeouts := []TimeoutEntry{}
+	for _, entry := range entries {
+		if isTimeoutFile(entry) {
+			addr, err := filenameAddress(entry.Name())
+			if err != nil {
+				return nil, err
+			}
+			record, err := readTimeoutFile(filepath.Join(timeoutDir, entry.Name()))
 			if err != nil {
 				return nil, err
 			}
+			timeouts = append(timeouts, TimeoutEntry{
+				Address:    addr,
+				Pattern:    record.Pattern,
+				LastSeen:   record.LastSeen,
+				Expiration: record.Expiration,
+				Strikes:    record.Strikes,
+				Released:   record.Released,
+			})
 		}
 	}
-	if ViperGetBool("verbose") {
-		log.Println(FormatJSON(s))
-	}
-	return &s, nil
+	return timeouts, nil
+}
+
+// a watchlist entry with its timeout; Expiration is zero for an entry without a timeout file
+type WatchlistEntry struct {
+	Address    string        `json:"address"`
+	Expiration time.Time     `json:"expiration"`
+	Remaining  time.Duration `json:"remaining"`
+	Strikes    int           `json:"strikes"`
 }
 
-func (s *Scanner) writeTimeoutFile(addr string) error {
-	expiration := time.Now().Add(s.AddressTimeout)
-	data, err := expiration.MarshalText()
+// read the watchlist and the timeout of each entry, sorted by expiration; entries without a timeout come last
+func ListWatchlist(addressFile, timeoutDir string) ([]WatchlistEntry, error) {
+	addrs, err := ReadAddressFile(addressFile)
 	if err != nil {
-		return fmt.Errorf("failed marshalling expiration: %v", err)
+		return nil, err
+	}
+	timeouts, err := ReadTimeouts(timeoutDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	expirations := make(map[string]TimeoutEntry)
+	for _, timeout := range timeouts {
+		expirations[timeout.Address] = timeout
+	}
+	now := time.Now()
+	entries := []WatchlistEntry{}
+	for _, addr := range addrs {
+		entry := WatchlistEntry{Address: addr}
+		timeout, ok := expirations[addr]
+		if ok {
+			entry.Expiration = timeout.Expiration
+			entry.Remaining = max(timeout.Expiration.Sub(now), 0)
+			entry.Strikes = timeout.Strikes
+		}
+		entries = append(entries, entry)
 	}
-	filename := filepath.Join(s.TimeoutDir, addr)
-	err = os.WriteFile(filename, data, 0600)
+	slices.SortStableFunc(entries, func(a, b WatchlistEntry) int {
+		if a.Expiration.IsZero() != b.Expiration.IsZero() {
+			if a.Expiration.IsZero() {
+				return 1
+			}
+			return -1
+		}
+		return a.Expiration.Compare(b.Expiration)
+	})
+	return entries, nil
+}
+
+type SimulatedExpiry struct {
+	Address    string        `json:"address"`
+	LastSeen   time.Time     `json:"last_seen"`
+	Expiration time.Time     `json:"expiration"`
+	Remaining  time.Duration `json:"remaining"`
+	Expired    bool          `json:"expired"`
+}
+
+// recompute each current expiration as newTimeout after the address was last seen, whatever
+// per-pattern timeout, backoff or fixed window set it; a file holding only an expiration time is
+// assumed to have been written with currentTimeout
+func SimulateExpiry(timeoutDir string, currentTimeout, newTimeout time.Duration) ([]SimulatedExpiry, error) {
+	timeouts, err := ReadTimeouts(timeoutDir)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	now := time.Now()
+	results := []SimulatedExpiry{}
+	for _, timeout := range timeouts {
+		if timeout.Released {
+			continue
+		}
+		lastSeen := timeout.LastSeen
+		if lastSeen.IsZero() {
+			lastSeen = timeout.Expiration.Add(-currentTimeout)
+		}
+		expiration := lastSeen.Add(newTimeout)
+		remaining := expiration.Sub(now)
+		if remaining < 0 {
+			remaining = 0
+		}
+		results = append(results, SimulatedExpiry{
+			Address:    timeout.Address,
+			LastSeen:   lastSeen,
+			Expiration: expiration,
+			Remaining:  remaining,
+			Expired:    now.Compare(expiration) >= 0,
+		})
+	}
+	return results, nil
 }
 
 func (s *Scanner) deleteTimeoutFile(addr string) error {
-	filename := filepath.Join(s.TimeoutDir, addr)
+	if s.DryRun {
+		log.Printf("dry-run: would delete timeout for %s\n", addr)
+		return nil
+	}
+	filename := filepath.Join(s.TimeoutDir, timeoutFilename(addr))
 	err := os.Remove(filename)
 	if err != nil {
 		return err
@@ -173,53 +1370,86 @@ func (s *Scanner) shutdown(caller string) {
 	s.active.Store("shutdown", caller)
 
 	if s.verbose {
-		log.Printf("shutdown[%s]", caller)
+		s.event("shutdown", fields{"caller": caller}, "shutdown[%s]", caller)
 	}
 
-	if s.tail == nil {
+	if s.reader == nil {
 		if s.verbose {
-			log.Printf("shutdown[%s]: tail process inactive", caller)
+			log.Printf("shutdown[%s]: reader inactive", caller)
 		}
 	} else {
-		if s.tail.Process != nil {
-			if s.verbose {
-				log.Printf("shutdown[%s]: killing tail process %d\n", caller, s.tail.Process.Pid)
-			}
-			err := s.tail.Process.Kill()
-			if err != nil {
-				log.Printf("shutdown[%s]: tail kill failed: %v", caller, Fatal(err))
-			}
-			err = s.tail.Wait()
-			if err != nil {
-				log.Printf("shutdown[%s]: tail wait returned: %v", caller, err)
-			}
+		if s.verbose {
+			log.Printf("shutdown[%s]: stopping reader\n", caller)
 		}
-		s.tail = nil
+		s.reader.Stop()
 	}
-	_, ok = s.active.Load("reaper")
-	if ok {
-		log.Printf("shutdown[%s]: sendingReaperStop", caller)
-		s.reaperStop <- struct{}{}
-	} else if s.verbose {
-		log.Printf("shutdown[%s]: reaper already stopped", caller)
+	s.stopSources()
+	// each goroutine exits when the context is done
+	s.cancel()
+	deadline := time.Now().Add(s.ShutdownTimeout)
+	if _, ok := s.active.Load("cleanup"); ok {
+		s.cleanup(caller, deadline)
 	}
-	_, ok = s.active.Load("scanner")
-	if ok {
-		log.Printf("shutdown[%s]: sending scannerStop", caller)
-		s.scannerStop <- struct{}{}
-	} else if s.verbose {
-		log.Printf("shutdown[%s]: scanner already stopped", caller)
+	s.waitCommands(caller, deadline)
+}
+
+// with CleanupOnExit set, a SIGINT or SIGTERM removes every watchlist address with DeleteCommand
+// and deletes its timeout file, so a restart starts with an empty watchlist. addresses left when
+// the shutdown deadline passes are kept
+func (s *Scanner) cleanup(caller string, deadline time.Time) {
+	addrs, err := s.readAddressFile()
+	if err != nil {
+		log.Printf("shutdown[%s]: cleanup failed: %v\n", caller, err)
+		return
 	}
-	_, ok = s.active.Load("handler")
-	if ok {
-		log.Printf("shutdown[%s]: sending handlerStop", caller)
-		s.handlerStop <- struct{}{}
-	} else if s.verbose {
-		log.Printf("shutdown[%s]: handler already stopped", caller)
+	removed := 0
+	for _, addr := range addrs {
+		if time.Now().After(deadline) {
+			log.Printf("shutdown[%s]: cleanup stopped after %v; %d addresses left in %s\n", caller, s.ShutdownTimeout, len(addrs)-removed, s.AddressFile)
+			break
+		}
+		record, _ := readTimeoutFile(filepath.Join(s.TimeoutDir, timeoutFilename(addr)))
+		_, err := s.removeAddress(addr, record.Pattern)
+		if err == nil && !s.DryRun {
+			err = s.deleteTimeoutFile(addr)
+		}
+		if err != nil {
+			log.Printf("shutdown[%s]: cleanup failed for %s: %v\n", caller, addr, err)
+			continue
+		}
+		removed++
+	}
+	// the batcher may already have flushed its last batch
+	if s.FlushInterval > 0 {
+		err := s.flushBatch()
+		if err != nil {
+			log.Printf("shutdown[%s]: cleanup batch failed: %v\n", caller, err)
+		}
+	}
+	s.event("cleanup", fields{"removed": removed}, "shutdown[%s]: cleanup removed %d addresses from %s\n", caller, removed, s.AddressFile)
+}
+
+// wait until deadline, ShutdownTimeout after the shutdown began, for running and pooled add and delete
+// commands, so the firewall is not left half updated
+func (s *Scanner) waitCommands(caller string, deadline time.Time) {
+	done := make(chan struct{})
+	go func() {
+		s.poolLock.Lock()
+		s.poolLock.Unlock()
+		s.commandLock.Lock()
+		s.commandLock.Unlock()
+		close(done)
+	}()
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		log.Printf("shutdown[%s]: commands still running after %v\n", caller, s.ShutdownTimeout)
 	}
 }
 
-func (s *Scanner) reaper(startChan chan struct{}) error {
+func (s *Scanner) reaper(ctx context.Context, startChan chan struct{}) error {
 	log.Println("reaper: starting")
 	defer func() {
 		log.Println("reaper: exiting")
@@ -227,266 +1457,1140 @@ func (s *Scanner) reaper(startChan chan struct{}) error {
 		s.shutdown("reaper")
 	}()
 	s.active.Store("reaper", true)
-	ticker := time.NewTicker(s.TickInterval)
+	timer := time.NewTimer(s.nextTick())
 	startChan <- struct{}{}
-	defer ticker.Stop()
+	defer timer.Stop()
 	for {
 		select {
-		case _, ok := <-s.reaperStop:
-			if ok {
-				log.Println("reaper: received reaperStop")
-				return nil
-			} else {
-				log.Println("reaper: reaperStop has closed")
-				return nil
+		case <-ctx.Done():
+			log.Println("reaper: context done")
+			return nil
+		case <-timer.C:
+			timer.Reset(s.nextTick())
+			err := s.sweep()
+			if err != nil {
+				return Fatalf("reaper: %v", err)
+			}
+		case <-s.sweepNow:
+			log.Println("reaper: sweep requested")
+			err := s.sweep()
+			if err != nil {
+				return Fatalf("reaper: %v", err)
+			}
+		}
+	}
+}
+
+// the periodic work of the reaper: retry failed commands and remove expired addresses
+func (s *Scanner) sweep() error {
+	s.pruneMatchCounts()
+	err := s.writeStats()
+	if err != nil {
+		log.Printf("reaper: failed writing stats file: %v\n", err)
+	}
+	err = s.writeMatchFile()
+	if err != nil {
+		log.Printf("reaper: failed writing match file: %v\n", err)
+	}
+	err = s.retryPending()
+	if err != nil {
+		return err
+	}
+	return s.expire()
+}
+
+// ask the reaper to sweep now rather than at its next tick
+func (s *Scanner) Sweep() {
+	select {
+	case s.sweepNow <- struct{}{}:
+	default:
+	}
+}
+
+// return TickInterval varied at random by up to IntervalJitter of itself, so a fleet of scanners sharing
+// an interval drift apart instead of sweeping together
+func (s *Scanner) nextTick() time.Duration {
+	if s.IntervalJitter == 0 {
+		return s.TickInterval
+	}
+	return time.Duration(float64(s.TickInterval) * (1 + s.IntervalJitter*(2*rand.Float64()-1)))
+}
+
+// remove expired addresses; with backoff their timeout files are kept as released records until TimeoutMax has passed
+func (s *Scanner) expire() error {
+	log.Println("reaper: checking expirations")
+	if s.DryRun && !IsDir(s.TimeoutDir) {
+		return nil
+	}
+	entries, err := os.ReadDir(s.TimeoutDir)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	expired := []TimeoutRecord{}
+	for _, entry := range entries {
+		if isTimeoutFile(entry) {
+			addr, err := filenameAddress(entry.Name())
+			if err != nil {
+				s.quarantineTimeoutFile(entry.Name(), err)
+				continue
 			}
-		case <-ticker.C:
-			log.Println("reaper: checking expirations")
-			entries, err := os.ReadDir(s.TimeoutDir)
+			record, err := readTimeoutFile(filepath.Join(s.TimeoutDir, entry.Name()))
 			if err != nil {
-				return Fatal(err)
-			}
-			expiredAddrs := []string{}
-			for _, entry := range entries {
-				if entry.Type().IsRegular() {
-					addr := entry.Name()
-					filename := filepath.Join(s.TimeoutDir, addr)
-					timeData, err := os.ReadFile(filename)
+				s.quarantineTimeoutFile(entry.Name(), err)
+				continue
+			}
+			record.Address = addr
+			record = s.correctClockStep(record, now)
+			if record.Released {
+				if now.Sub(record.Expiration) >= s.TimeoutMax {
+					log.Printf("reaper: forgetting %d strikes for %s\n", record.Strikes, addr)
+					err := s.deleteTimeoutFile(addr)
 					if err != nil {
-						return Fatal(err)
+						return err
+					}
+				}
+			} else if s.expired(record, now) {
+				if held := s.MinBlock - now.Sub(record.blockedSince()); held > 0 {
+					log.Printf("reaper: keeping expired %s for %v of min_block_duration\n", addr, held.Round(time.Second))
+					continue
+				}
+				expired = append(expired, record)
+			} else {
+				log.Printf("reaper: active %s %s\n", addr, record.Expiration.Format(time.RFC3339Nano))
+				s.softTimeout(record, now)
+			}
+		}
+	}
+
+	for _, record := range expired {
+		addr := record.Address
+		if s.DryRun {
+			log.Printf("dry-run: would expire %s\n", addr)
+			continue
+		}
+		action, err := s.removeAddress(addr, record.Pattern)
+		if err != nil {
+			return fmt.Errorf("removeAddress failed: %v", err)
+		}
+		if s.BackoffFactor > 1 {
+			filename := filepath.Join(s.TimeoutDir, timeoutFilename(addr))
+			record, err := readTimeoutFile(filename)
+			if err != nil {
+				return err
+			}
+			record.Released = true
+			err = s.writeTimeoutRecord(filename, record)
+			if err != nil {
+				return err
+			}
+		} else {
+			err = s.deleteTimeoutFile(addr)
+			if err != nil {
+				return err
+			}
+		}
+		s.metrics.expired.Add(1)
+		s.notify("expire", addr, record.Pattern, record.Expiration.Sub(record.LastSeen))
+		s.journal("expire", addr, record.Pattern, record.Expiration.Sub(record.LastSeen))
+		s.event("expire", fields{"address": addr, "pattern": record.Pattern, "action": action}, "reaper: expired IP %s %s %s\n", addr, action, s.AddressFile)
+	}
+	return nil
+}
+
+func (s *Scanner) scanner(ctx context.Context, startChan chan struct{}) error {
+
+	defer func() {
+		log.Println("scanner: exiting")
+		s.active.Delete("scanner")
+		s.shutdown("scanner")
+	}()
+	log.Printf("scanner: started monitoring log file: %s\n", s.LogFile)
+	s.active.Store("scanner", true)
+
+	target := s.LogFile
+	var symlinkCheck <-chan time.Time
+	if s.FollowSymlink {
+		var err error
+		target, err = filepath.EvalSymlinks(s.LogFile)
+		if err != nil {
+			// follow the link itself until the symlink check finds its target
+			log.Printf("scanner: failed resolving symlink: %v; waiting for %s\n", err, s.LogFile)
+			target = s.LogFile
+		} else {
+			log.Printf("scanner: %s links to %s\n", s.LogFile, target)
+		}
+		ticker := time.NewTicker(s.SymlinkInterval)
+		defer ticker.Stop()
+		symlinkCheck = ticker.C
+	}
+	// the end of stdin or a supplied reader ends the run; a file follower only exits when stopped
+	following := s.reader == nil && s.LogFile != "-"
+	switch {
+	case s.reader != nil:
+		log.Println("scanner: reading lines from the supplied reader")
+		s.tailStdout = s.reader.Lines()
+		s.tailStderr = s.reader.Errors()
+	case s.LogFile == "-":
+		s.startReader(newIOReader(s.stdin, s.LineBuffer, s.MaxLineLength))
+	default:
+		err := s.startFollower(target, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(s.Sources) > 0 {
+		s.startSources()
+	}
+	evenLines := s.evenSourceLines()
+
+	startChan <- struct{}{}
+	restarts := 0
+	stderrOpen := true
+	stdoutOpen := true
+	for {
+		for stderrOpen || stdoutOpen {
+			line, ok := s.prioritySourceLine()
+			if ok {
+				err := s.processLine(line)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				log.Println("scanner: context done")
+				return nil
+			case line := <-evenLines:
+				err := s.processLine(line)
+				if err != nil {
+					return err
+				}
+			case <-s.sourceReady:
+			case line, ok := <-s.tailStdout:
+				if !ok {
+					if stdoutOpen && s.verbose {
+						log.Println("scanner: follower lines have closed")
 					}
-					var expiration time.Time
-					err = expiration.UnmarshalText(timeData)
+					stdoutOpen = false
+				} else {
+					restarts = 0
+					err := s.processLine(line)
 					if err != nil {
-						return Fatalf("reaper: failed umarshalling expiration from '%s': %v", filename, err)
+						return err
 					}
-					if time.Now().Compare(expiration) >= 0 {
-						expiredAddrs = append(expiredAddrs, addr)
-					} else {
-						log.Printf("reaper: active %s %s\n", addr, string(timeData))
+				}
+
+			case line, ok := <-s.tailStderr:
+				if !ok {
+					if stderrOpen && s.verbose {
+						log.Println("scanner: follower errors have closed")
 					}
+					stderrOpen = false
+				} else {
+					log.Printf("scanner: follower: %s\n", line)
 				}
-			}
 
-			for _, addr := range expiredAddrs {
-				action, err := s.removeAddress(addr)
+			case <-symlinkCheck:
+				newTarget, err := filepath.EvalSymlinks(s.LogFile)
 				if err != nil {
-					return Fatalf("reaper: removeAddress failed: %v", err)
+					log.Printf("scanner: failed resolving symlink: %v", err)
+				} else if newTarget != target {
+					log.Printf("scanner: %s now links to %s; restarting follower\n", s.LogFile, newTarget)
+					target = newTarget
+					err := s.restartFollower(target)
+					if err != nil {
+						return err
+					}
+					stdoutOpen = true
+					stderrOpen = true
 				}
-				err = s.deleteTimeoutFile(addr)
-				if err != nil {
-					return Fatal(err)
+			}
+		}
+		if !following || s.shuttingDown() {
+			return nil
+		}
+		// the follower exited without being stopped by shutdown
+		if restarts >= s.FollowRestarts {
+			return fmt.Errorf("scanner: follower for %s exited %d times; giving up", target, restarts+1)
+		}
+		restarts++
+		delay := min(followRestartDelay<<(restarts-1), time.Minute)
+		log.Printf("scanner: follower for %s exited unexpectedly; restarting in %v (%d of %d)\n", target, delay, restarts, s.FollowRestarts)
+		select {
+		case <-ctx.Done():
+			log.Println("scanner: context done")
+			return nil
+		case <-time.After(delay):
+		}
+		started, err := s.resumeFollower(target)
+		if err != nil {
+			return err
+		}
+		if !started {
+			return nil
+		}
+		stdoutOpen = true
+		stderrOpen = true
+	}
+}
+
+// the delay before the first restart of a follower that exited unexpectedly; it doubles for each
+// further restart until a line is read
+const followRestartDelay = time.Second
+
+// return true once shutdown has been called
+func (s *Scanner) shuttingDown() bool {
+	_, ok := s.active.Load("shutdown")
+	return ok
+}
+
+// follow filename again from its end after the follower exited; returns false during shutdown
+func (s *Scanner) resumeFollower(filename string) (bool, error) {
+	s.shutdownLock.Lock()
+	defer s.shutdownLock.Unlock()
+	if s.shuttingDown() {
+		return false, nil
+	}
+	return true, s.startFollower(filename, false)
+}
+
+// parse the leading timestamp of a log line using TimeLayout
+func (s *Scanner) lineTime(line string) (time.Time, bool) {
+	if s.TimeLayout == "" {
+		return time.Time{}, false
+	}
+	layout := strings.Fields(s.TimeLayout)
+	fields := strings.Fields(line)
+	if len(fields) < len(layout) {
+		return time.Time{}, false
+	}
+	stamp, err := time.ParseInLocation(strings.Join(layout, " "), strings.Join(fields[:len(layout)], " "), time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if stamp.Year() == 0 {
+		// syslog style timestamps have no year; assume the most recent one
+		now := time.Now()
+		stamp = stamp.AddDate(now.Year(), 0, 0)
+		if stamp.After(now.Add(24 * time.Hour)) {
+			stamp = stamp.AddDate(-1, 0, 0)
+		}
+	}
+	return stamp, true
+}
+
+// return the line age and true if it exceeds MaxLineAge; lines without a parseable timestamp are current
+func (s *Scanner) lineAge(line string) (time.Duration, bool) {
+	if s.MaxLineAge == 0 {
+		return 0, false
+	}
+	stamp, ok := s.lineTime(line)
+	if !ok {
+		return 0, false
+	}
+	age := time.Since(stamp)
+	return age, age > s.MaxLineAge
+}
+
+// return the reason and true if a match in line is not acted on because the scanner has just started:
+// the line's timestamp is before startup with SkipBeforeStart, or StartupGrace has not yet passed
+func (s *Scanner) startupSkip(line string) (string, bool) {
+	if s.SkipBeforeStart {
+		stamp, ok := s.lineTime(line)
+		// timestamps are often whole seconds, so a line from the second of startup is current
+		if ok && stamp.Before(s.startTime.Truncate(time.Second)) {
+			return "before_start", true
+		}
+	}
+	if s.StartupGrace > 0 && time.Since(s.startTime) < s.StartupGrace {
+		return "startup_grace", true
+	}
+	return "", false
+}
+
+// record the most recent line matched by pattern; MatchFile is written by writeMatchFile
+func (s *Scanner) setLastMatch(pattern *regexp.Regexp, line string) {
+	s.matchLock.Lock()
+	defer s.matchLock.Unlock()
+	s.lastMatch[pattern.String()] = MatchState{
+		Pattern: pattern.String(),
+		Line:    line,
+		Time:    time.Now(),
+	}
+	s.matchChanged = true
+}
+
+// persist the last matches to MatchFile if configured and changed since it was last written;
+// called on each sweep and when the scanner exits, so a flood of matches is not a flood of writes
+func (s *Scanner) writeMatchFile() error {
+	if s.MatchFile == "" {
+		return nil
+	}
+	s.matchLock.Lock()
+	defer s.matchLock.Unlock()
+	if !s.matchChanged {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.lastMatches(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed marshalling last matches: %v", err)
+	}
+	err = writeFileAtomic(s.MatchFile, append(data, '\n'), 0600, noOwner)
+	if err != nil {
+		return err
+	}
+	s.matchChanged = false
+	return nil
+}
+
+// return the most recent matched line for each pattern that has matched
+func (s *Scanner) LastMatches() []MatchState {
+	s.matchLock.Lock()
+	defer s.matchLock.Unlock()
+	return s.lastMatches()
+}
+
+// caller must hold matchLock
+func (s *Scanner) lastMatches() []MatchState {
+	matches := []MatchState{}
+	for _, pattern := range s.Patterns {
+		state, ok := s.lastMatch[pattern.String()]
+		if ok {
+			matches = append(matches, state)
+		}
+	}
+	return matches
+}
+
+// read the last match file written by a running scanner; a missing file has no matches
+func ReadMatchFile(filename string) ([]MatchState, error) {
+	matches := []MatchState{}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return matches, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, &matches)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing match file '%s': %v", filename, err)
+	}
+	return matches, nil
+}
+
+// false when line[start:end] continues a longer token: a letter or digit touches it, or a dot
+// followed by a digit, as in 10.0.0.1234 or v1.2.3.4build
+func standalone(line string, start, end int) bool {
+	return !continuesToken(line, start-1, -1) && !continuesToken(line, end, 1)
+}
+
+// true when line[i] extends a token outward in direction step
+func continuesToken(line string, i, step int) bool {
+	if i < 0 || i >= len(line) {
+		return false
+	}
+	c := rune(line[i])
+	if c == '.' {
+		next := i + step
+		return next >= 0 && next < len(line) && unicode.IsDigit(rune(line[next]))
+	}
+	return c == '_' || unicode.IsLetter(c) || unicode.IsDigit(c)
+}
+
+// return the text captured by group in up to n matches of pattern, all matches when n is -1; when group
+// is zero the group named ip or group 1 is used, and a group beyond the pattern's capture groups is an error.
+// With strict set, a capture that is part of a longer token is skipped
+func captureAddresses(pattern *regexp.Regexp, group int, line string, n int, strict bool) ([]string, error) {
+	if group == 0 {
+		group = pattern.SubexpIndex("ip")
+		if group < 0 {
+			group = 1
+		}
+	}
+	limit := n
+	if strict {
+		// an embedded match is skipped, so a later standalone one may be needed
+		limit = -1
+	}
+	matches := pattern.FindAllStringSubmatchIndex(line, limit)
+	if len(matches) > 0 && group > pattern.NumSubexp() {
+		return nil, fmt.Errorf("ip_group %d is out of range; pattern has %d groups", group, pattern.NumSubexp())
+	}
+	captures := []string{}
+	for _, match := range matches {
+		start, end := match[2*group], match[2*group+1]
+		if start < 0 || (strict && !standalone(line, start, end)) {
+			continue
+		}
+		captures = append(captures, line[start:end])
+		if len(captures) == n {
+			break
+		}
+	}
+	return captures, nil
+}
+
+// an address extracted from a log line and the first pattern that matched it
+type lineMatch struct {
+	index   int
+	pattern *regexp.Regexp
+	addr    string
+}
+
+// a capture of a pattern in a log line; with XFFMode the client address taken from it
+type lineCapture struct {
+	index   int
+	pattern *regexp.Regexp
+	capture string
+}
+
+// the captures of each pattern in a log line from a program in MatchPrograms, in pattern order; by default
+// only the first match of each pattern is used, with MatchAll every match.  Nothing but the match budget is
+// updated, so PatternTester sees what the scanner does.
+func (s *Scanner) lineCaptures(line string) []lineCapture {
+	if !s.programSelected(line) {
+		return []lineCapture{}
+	}
+	s.configLock.RLock()
+	patterns := s.Patterns
+	rules := s.rules
+	s.configLock.RUnlock()
+	captured := []lineCapture{}
+	limit := 1
+	if s.MatchAll {
+		limit = -1
+	}
+	timer := s.startMatchTimer()
+	defer s.checkMatchBudget(timer, patterns)
+	for i, pattern := range patterns {
+		if !prefilter(pattern, line) || s.patternDisabled(pattern) {
+			continue
+		}
+		started := timer.now()
+		captures, err := captureAddresses(pattern, rules[pattern.String()].IPGroup, line, limit, s.StrictBounds)
+		timer.record(pattern, started)
+		if err != nil {
+			log.Printf("scanner: skipping match of '%s': %v\n", pattern, err)
+			continue
+		}
+		for _, capture := range captures {
+			if s.XFFMode {
+				client, ok := s.forwardedClient(capture)
+				if !ok {
+					if s.verbose {
+						log.Printf("scanner: no public client address in '%s'\n", capture)
+					}
+					continue
 				}
-				log.Printf("reaper: expired IP %s %s %s\n", addr, action, s.AddressFile)
+				capture = client
+			}
+			captured = append(captured, lineCapture{index: i, pattern: pattern, capture: capture})
+		}
+	}
+	return captured
+}
+
+// match a log line against each pattern, returning each extracted address once with the first pattern matching it
+func (s *Scanner) lineMatches(line string) ([]lineMatch, error) {
+	matches := []lineMatch{}
+	seen := make(map[string]bool)
+	for _, captured := range s.lineCaptures(line) {
+		addr, ok := normalizeAddress(captured.capture)
+		if !ok {
+			if s.verbose {
+				log.Printf("scanner: ignoring invalid address '%s'\n", captured.capture)
 			}
+			continue
+		}
+		s.metrics.matches.Add(1)
+		s.recordMatch(captured.pattern.String(), addr)
+		s.setLastMatch(captured.pattern, line)
+		if !seen[addr] {
+			seen[addr] = true
+			matches = append(matches, lineMatch{index: captured.index, pattern: captured.pattern, addr: addr})
+		}
+	}
+	return matches, nil
+}
+
+// match a log line against each pattern and act once on each extracted address
+func (s *Scanner) processLine(line string) error {
+	s.metrics.lines.Add(1)
+	matches, err := s.lineMatches(line)
+	if err != nil {
+		return err
+	}
+	for _, match := range matches {
+		err := s.processMatch(line, match)
+		if err != nil {
+			return err
 		}
-
 	}
-	return Fatalf("unexpected exit")
+	return nil
 }
 
-func (s *Scanner) scanner(startChan chan struct{}) error {
-
-	defer func() {
-		log.Println("scanner: exiting")
-		s.active.Delete("scanner")
-		s.shutdown("scanner")
-	}()
-	log.Printf("scanner: started monitoring log file: %s\n", s.LogFile)
-	s.active.Store("scanner", true)
-
-	s.tail = exec.Command("tail", "-f", s.LogFile)
-	stdout, err := s.tail.StdoutPipe()
-	if err != nil {
-		return fmt.Errorf("scanner: failed opening stdout pipe: %v", err)
+// act on an address extracted from line
+func (s *Scanner) processMatch(line string, match lineMatch) error {
+	addr := match.addr
+	pattern := match.pattern
+	age, stale := s.lineAge(line)
+	if stale {
+		s.staleLines++
+		s.event("ignore", fields{"address": addr, "pattern": pattern.String(), "reason": "stale"}, "scanner: IP %s ignored; line age %v exceeds max_line_age\n", addr, age.Round(time.Second))
+		return nil
 	}
-	stderr, err := s.tail.StderrPipe()
-	if err != nil {
-		return fmt.Errorf("scanner: failed opening stderr pipe: %v", err)
+	skipped, ok := s.startupSkip(line)
+	if ok {
+		s.event("ignore", fields{"address": addr, "pattern": pattern.String(), "reason": skipped}, "scanner: IP %s ignored; %s\n", addr, strings.ReplaceAll(skipped, "_", " "))
+		return nil
+	}
+	if s.skipAddress(addr) {
+		if s.verbose {
+			s.event("ignore", fields{"address": addr, "pattern": pattern.String(), "reason": "private"}, "scanner: IP %s ignored; private or reserved address\n", addr)
+		}
+		return nil
+	}
+	network, ok := s.allowlisted(addr)
+	if ok {
+		s.event("ignore", fields{"address": addr, "pattern": pattern.String(), "reason": "allowlisted"}, "scanner: IP %s ignored; allowlisted by %s\n", addr, network)
+		return nil
+	}
+	country := s.country(addr)
+	reason := s.countryFilter(country)
+	if reason != "" {
+		s.event("ignore", fields{"address": addr, "pattern": pattern.String(), "reason": "country", "country": country}, "scanner: IP %s ignored; country '%s' %s\n", addr, country, reason)
+		return nil
+	}
+	s.onMatch(addr, pattern.String(), line)
+	if s.observed(pattern.String()) {
+		values := fields{"address": addr, "pattern": pattern.String(), "action": "observed"}
+		if country != "" {
+			values["country"] = country
+		}
+		s.event("observe", values, "scanner: IP %s observed by pattern '%s'; not added to %s\n", addr, pattern, s.AddressFile)
+		s.notify("observe", addr, pattern.String(), 0)
+		return nil
+	}
+	count, ok := s.countMatch(addr)
+	if !ok {
+		s.event("ignore", fields{"address": addr, "pattern": pattern.String(), "reason": "threshold", "count": count}, "scanner: IP %s match %d of %d within %v\n", addr, count, s.MatchThreshold, s.MatchWindow)
+		return nil
 	}
-	err = s.tail.Start()
+	entry := s.blockEntry(addr)
+	// name the matching pattern so false positives can be traced to their regex
+	matched := ""
+	if s.verbose {
+		matched = fmt.Sprintf(" by pattern %d '%s'", match.index, pattern)
+	}
+	// a throttled entry gets no timeout file, so the reaper never expires an entry that was not added
+	if !s.isPresent(entry) && !s.allowAdd(entry) {
+		if s.verbose {
+			s.event("match", fields{"address": entry, "pattern": pattern.String(), "action": "throttled; not added to"}, "scanner: IP %s throttled; not added to %s%s\n", entry, s.AddressFile, matched)
+		}
+		return nil
+	}
+	// update or create the timeout file
+	err := s.writeTimeoutFile(entry, pattern.String())
 	if err != nil {
-		return fmt.Errorf("scanner: failed spawning tail command: %v", err)
+		return fmt.Errorf("scanner: writeTimeoutFile: %v", err)
 	}
-
-	go func() {
-		s.wg.Add(1)
-		defer s.wg.Done()
-		defer close(s.tailStderr)
+	// a flood of matches for an active entry only refreshes its timeout
+	if s.isPresent(entry) {
 		if s.verbose {
-			defer log.Printf("scanner: tail stderr reader exiting")
-			log.Printf("scanner: tail stderr reader started")
+			s.event("match", fields{"address": entry, "pattern": pattern.String(), "action": "refreshed in"}, "scanner: IP %s refreshed in %s%s\n", entry, s.AddressFile, matched)
 		}
-		reader := bufio.NewReader(stderr)
-		for {
-			buf, err := reader.ReadString('\n')
-			if err != nil {
-				log.Printf("scanner: tailpipe stderr: %v", err)
-				return
-			}
-			line := strings.TrimSpace(buf)
-			s.tailStderr <- line
+		return nil
+	}
+	// add the entry to the AddressFile if not present
+	action, err := s.addAddress(entry, pattern.String(), line)
+	if err != nil {
+		return fmt.Errorf("scanner: addAddress: %v", err)
+	}
+	event := "match"
+	if action == "added to" {
+		event = "add"
+	}
+	values := fields{"address": entry, "pattern": pattern.String(), "action": action}
+	if country != "" {
+		values["country"] = country
+		matched = fmt.Sprintf(" [%s]%s", country, matched)
+	}
+	if !s.ResolvePTR {
+		s.event(event, values, "scanner: IP %s %s %s%s\n", entry, action, s.AddressFile, matched)
+		return nil
+	}
+	// a slow PTR lookup delays only this log line, never the matching of later lines
+	go func() {
+		host := s.hostname(entry)
+		if host != "" {
+			values["hostname"] = host
+			matched = fmt.Sprintf(" (%s)%s", host, matched)
 		}
+		s.event(event, values, "scanner: IP %s %s %s%s\n", entry, action, s.AddressFile, matched)
 	}()
+	return nil
+}
+
+// count a match of addr, returning the count and true once it reaches MatchThreshold within MatchWindow
+func (s *Scanner) countMatch(addr string) (int, bool) {
+	if s.MatchThreshold == 1 {
+		return 1, true
+	}
+	s.countLock.Lock()
+	defer s.countLock.Unlock()
+	now := time.Now()
+	state := s.matchCounts[addr]
+	if now.Sub(state.Last) > s.MatchWindow {
+		state.Count = 0
+	}
+	state.Count++
+	state.Last = now
+	s.matchCounts[addr] = state
+	return state.Count, state.Count >= s.MatchThreshold
+}
+
+// forget match counts whose window has elapsed
+func (s *Scanner) pruneMatchCounts() {
+	s.countLock.Lock()
+	defer s.countLock.Unlock()
+	now := time.Now()
+	for addr, state := range s.matchCounts {
+		if now.Sub(state.Last) > s.MatchWindow {
+			delete(s.matchCounts, addr)
+		}
+	}
+}
+
+// return the watchlist entry for addr: the enclosing BlockPrefixV4 network for IPv4, otherwise the address
+func (s *Scanner) blockEntry(addr string) string {
+	ip := net.ParseIP(addr).To4()
+	if ip == nil || s.BlockPrefixV4 == 32 {
+		return addr
+	}
+	network := &net.IPNet{IP: ip.Mask(net.CIDRMask(s.BlockPrefixV4, 32)), Mask: net.CIDRMask(s.BlockPrefixV4, 32)}
+	// never block a network containing an allowlisted address
+	for _, allowed := range s.allowlist {
+		if network.Contains(allowed.IP) || allowed.Contains(network.IP) {
+			log.Printf("scanner: %s overlaps allowlisted %s; blocking %s only\n", network, allowed, addr)
+			return addr
+		}
+	}
+	return network.String()
+}
 
+// read lines from reader, feeding new tailStdout and tailStderr channels
+func (s *Scanner) startReader(reader LineReader) {
+	s.shutdownLock.Lock()
+	defer s.shutdownLock.Unlock()
+	s.reader = reader
+	s.tailStdout = reader.Lines()
+	s.tailStderr = reader.Errors()
+	_, ok := s.active.Load("shutdown")
+	if ok {
+		reader.Stop()
+	}
+}
+
+// follow filename, feeding new tailStdout and tailStderr channels
+func (s *Scanner) startFollower(filename string, fromStart bool) error {
+	f := newFollower(filename, s.FollowMode == "name", fromStart, s.PollInterval, s.LineBuffer, s.MaxLineLength)
+	f.inotify = s.FollowBackend == "inotify"
+	s.reader = f
+	s.tailStdout = f.lines
+	s.tailStderr = f.errors
+	s.wg.Add(1)
 	go func() {
-		s.wg.Add(1)
 		defer s.wg.Done()
-		defer close(s.tailStdout)
 		if s.verbose {
-			defer log.Printf("scanner: tail stdout reader exiting")
-			log.Printf("scanner: tail stdout reader started")
-		}
-		reader := bufio.NewReader(stdout)
-		for {
-			buf, err := reader.ReadString('\n')
-			if err != nil {
-				log.Printf("scanner: tailpipe stdout: %v", err)
-				return
-			}
-			line := strings.TrimSpace(buf)
-			s.tailStdout <- line
+			defer log.Printf("scanner: follower exiting")
+			log.Printf("scanner: following %s\n", filename)
 		}
+		f.run()
 	}()
+	return nil
+}
 
-	startChan <- struct{}{}
-	stderrOpen := true
-	stdoutOpen := true
-	for stderrOpen || stdoutOpen {
+// finish the running follower, process its remaining lines, then follow filename from its first line
+func (s *Scanner) restartFollower(filename string) error {
+	s.shutdownLock.Lock()
+	_, ok := s.active.Load("shutdown")
+	if ok {
+		s.shutdownLock.Unlock()
+		return nil
+	}
+	f, ok := s.reader.(*follower)
+	if ok {
+		f.Finish()
+	}
+	s.shutdownLock.Unlock()
+
+	// the follower closes its channels after delivering the remaining lines
+	lines := s.tailStdout
+	errors := s.tailStderr
+	for lines != nil || errors != nil {
 		select {
-		case line, ok := <-s.tailStdout:
+		case line, ok := <-lines:
 			if !ok {
-				if stdoutOpen && s.verbose {
-					log.Println("scanner: stdout tailpipe has closed")
-				}
-				stdoutOpen = false
-			} else {
-				for _, pattern := range s.Patterns {
-					match := pattern.FindStringSubmatch(line)
-					if len(match) > 1 {
-						addr := match[1]
-						// update or create the timeout file
-						err := s.writeTimeoutFile(addr)
-						if err != nil {
-							return fmt.Errorf("scanner: writeTimeoutFile: %v", err)
-						}
-						// add the address to the AddressFile if not present
-						action, err := s.addAddress(addr)
-						if err != nil {
-							return fmt.Errorf("scanner: addAddress: %v", err)
-						}
-						log.Printf("scanner: IP %s %s %s\n", addr, action, s.AddressFile)
-					}
-				}
+				lines = nil
+				continue
 			}
-
-		case line, ok := <-s.tailStderr:
+			err := s.processLine(line)
+			if err != nil {
+				return err
+			}
+		case line, ok := <-errors:
 			if !ok {
-				if stderrOpen && s.verbose {
-					log.Println("scanner: stderr tailpipe has closed")
-				}
-				stderrOpen = false
-			} else {
-				log.Printf("scanner: tail: %s\n", line)
+				errors = nil
+				continue
 			}
+			log.Printf("scanner: follower: %s\n", line)
 		}
 	}
-	return nil
+
+	s.shutdownLock.Lock()
+	defer s.shutdownLock.Unlock()
+	_, ok = s.active.Load("shutdown")
+	if ok {
+		return nil
+	}
+	return s.startFollower(filename, true)
 }
 
-func (s *Scanner) readAddressFile() ([]string, error) {
-	addrs := []string{}
-	file, err := os.Open(s.AddressFile)
+// read a watchlist file, returning its entries sorted and without duplicates; blank lines, # comment
+// lines and a trailing # annotation on an entry are ignored
+func ReadAddressFile(filename string) ([]string, error) {
+	watchlist, err := readWatchlistFile(filename)
 	if err != nil {
 		return []string{}, err
 	}
+	return watchlist.addrs, nil
+}
+
+// read a watchlist file, keeping its comment lines and the annotation of each entry
+func readWatchlistFile(filename string) (*watchlistFile, error) {
+	watchlist := &watchlistFile{notes: make(map[string]string)}
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
 	defer file.Close()
+	addrs := []string{}
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
-		addr := strings.TrimSpace(scanner.Text())
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			watchlist.comments = append(watchlist.comments, line)
+			continue
+		}
+		addr, note, _ := strings.Cut(line, "#")
+		addr = strings.TrimSpace(addr)
 		if addr != "" {
-			if IP_PATTERN.MatchString(addr) {
-				addrs = append(addrs, addr)
+			normalized, ok := normalizeEntry(addr)
+			if ok {
+				addrs = append(addrs, normalized)
 			} else {
-				return nil, fmt.Errorf("unexpected address '%s' found in address list file: %s", addr, s.AddressFile)
+				return nil, fmt.Errorf("unexpected address '%s' found in address list file: %s", addr, filename)
+			}
+			if note = strings.TrimSpace(note); note != "" {
+				watchlist.notes[normalized] = note
 			}
 		}
 	}
 	err = scanner.Err()
 	if err != nil {
-		return []string{}, fmt.Errorf("failed reading address file '%s': %v", s.AddressFile, err)
+		return nil, fmt.Errorf("failed reading address file '%s': %v", filename, err)
+	}
+	watchlist.addrs = sortAddresses(addrs)
+	return watchlist, nil
+}
+
+// return true if addr has been added to the address file and not since removed, by the scanner
+// or by an external edit of the file
+func (s *Scanner) isPresent(addr string) bool {
+	s.addressLock.Lock()
+	defer s.addressLock.Unlock()
+	// on error addAddress reports the failure
+	_, err := s.loadWatchlist()
+	if err != nil {
+		return false
+	}
+	return s.present[addr]
+}
+
+// replace the address file atomically, sorted and without duplicates, so a crash or full disk never
+// leaves it partially written; comment lines are written first and each entry keeps its annotation
+func (s *Scanner) writeAddressFile(addrs []string, comments []string, notes map[string]string) error {
+	lines := slices.Clone(comments)
+	for _, addr := range sortAddresses(addrs) {
+		if note := notes[addr]; note != "" {
+			addr += " # " + note
+		}
+		lines = append(lines, addr)
+	}
+	return writeFileAtomic(s.AddressFile, []byte(strings.Join(lines, "\n")+"\n"), s.WatchlistMode, s.owner)
+}
+
+// replaced by tests to interrupt writeFileAtomic
+var renameFile = os.Rename
+
+// write data to a temporary file in the same directory as filename, then rename it over filename
+func writeFileAtomic(filename string, data []byte, perm os.FileMode, owner fileOwner) error {
+	file, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	tempName := file.Name()
+	defer os.Remove(tempName)
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err != nil {
+		return fmt.Errorf("failed writing '%s': %v", tempName, err)
+	}
+	if closeErr != nil {
+		return fmt.Errorf("failed closing '%s': %v", tempName, closeErr)
+	}
+	err = setPermissions(tempName, perm, owner)
+	if err != nil {
+		return err
+	}
+	return renameFile(tempName, filename)
+}
+
+// return the command and its arguments for an add or delete of addr matched by pattern
+func (s *Scanner) command(action, addr, pattern string) (string, []string) {
+	return s.batchCommand(action, []string{addr}, pattern, s.recordTimeout(addr))
+}
+
+// return the command and its arguments for an add or delete of addrs matched by pattern with timeout
+func (s *Scanner) batchCommand(action string, addrs []string, pattern string, timeout time.Duration) (string, []string) {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+	rule := s.rules[pattern]
+	if action == "add" {
+		if rule.AddCommand != "" {
+			return rule.AddCommand, commandArgs(rule.AddArgs, addrs, pattern, timeout)
+		}
+		return s.AddCommand, commandArgs(s.AddArgs, addrs, pattern, timeout)
+	}
+	if rule.DeleteCommand != "" {
+		return rule.DeleteCommand, commandArgs(rule.DeleteArgs, addrs, pattern, timeout)
 	}
-	return addrs, nil
+	return s.DeleteCommand, commandArgs(s.DeleteArgs, addrs, pattern, timeout)
 }
 
 // add address if not present, return true if address already exists
-func (s *Scanner) addAddress(addr string) (string, error) {
-	if s.AddCommand != "" {
-		err := s.exec(s.AddCommand, append(s.AddArgs, addr))
-		if err != nil {
-			return "", err
+func (s *Scanner) addAddress(addr, pattern, line string) (string, error) {
+	if s.DryRun {
+		log.Printf("dry-run: would add %s to %s; %s\n", addr, s.AddressFile, s.describeBackend("add", addr, pattern))
+		return "added (dry-run) to", nil
+	}
+	// an address already listed was handled when it was added, unless ForceAdd repeats the command
+	if !s.ForceAdd {
+		s.addressLock.Lock()
+		watchlist, err := s.loadWatchlist()
+		listed := err == nil && watchlist.set[addr]
+		if listed {
+			s.present[addr] = true
+		}
+		s.addressLock.Unlock()
+		if listed {
+			return "already present in", nil
 		}
 	}
-	addrs, err := s.readAddressFile()
+	err := s.evict(addr)
+	if err != nil {
+		return "", err
+	}
+	// the watchlist is updated even when the command fails
+	err = s.runBackend("add", addr, pattern, line)
+	if err != nil {
+		return "", err
+	}
+	// serialize the read-modify-write so concurrent adds and removes never clobber each other
+	s.addressLock.Lock()
+	defer s.addressLock.Unlock()
+	watchlist, err := s.loadWatchlist()
 	if err != nil {
 		return "", err
 	}
-	if slices.Contains(addrs, addr) {
+	if watchlist.set[addr] {
+		s.present[addr] = true
 		return "already present in", nil
 	}
-	addrs = append(addrs, addr)
-	err = os.WriteFile(s.AddressFile, []byte(strings.Join(addrs, "\n")+"\n"), 0600)
+	s.annotate(addr, pattern)
+	err = s.saveWatchlist(append(slices.Clone(watchlist.addrs), addr))
 	if err != nil {
 		return "", err
 	}
+	s.present[addr] = true
+	s.metrics.added.Add(1)
+	timeout := s.recordTimeout(addr)
+	s.notify("add", addr, pattern, timeout)
+	s.journal("add", addr, pattern, timeout)
 	return "added to", nil
 }
 
-// add address if not present, return true if address already exists
-func (s *Scanner) removeAddress(addr string) (string, error) {
-	if s.DeleteCommand != "" {
-		err := s.exec(s.DeleteCommand, append(s.DeleteArgs, addr))
+// make room for addr when the watchlist is at MaxWatchlist by removing the entries that expire first
+func (s *Scanner) evict(addr string) error {
+	if s.MaxWatchlist == 0 {
+		return nil
+	}
+	for {
+		addrs, err := s.readAddressFile()
+		if err != nil {
+			return err
+		}
+		if len(addrs) < s.MaxWatchlist || slices.Contains(addrs, addr) {
+			return nil
+		}
+		victim, record := s.earliestExpiration(addrs)
+		action, err := s.removeAddress(victim, record.Pattern)
 		if err != nil {
-			return "", err
+			return err
+		}
+		err = s.deleteTimeoutFile(victim)
+		if err != nil && !os.IsNotExist(err) {
+			return err
 		}
+		s.notify("evict", victim, record.Pattern, record.Expiration.Sub(record.LastSeen))
+		s.event("evict", fields{"address": victim, "pattern": record.Pattern, "action": action, "expiration": record.Expiration}, "scanner: evicted IP %s %s %s; watchlist is at max_watchlist_size %d\n", victim, action, s.AddressFile, s.MaxWatchlist)
 	}
-	addrs, err := s.readAddressFile()
+}
+
+// return the watchlist entry with the earliest expiration; entries without a timeout file come first
+func (s *Scanner) earliestExpiration(addrs []string) (string, TimeoutRecord) {
+	var victim string
+	var earliest TimeoutRecord
+	for i, addr := range addrs {
+		record, err := readTimeoutFile(filepath.Join(s.TimeoutDir, timeoutFilename(addr)))
+		if err != nil {
+			return addr, TimeoutRecord{Address: addr}
+		}
+		if i == 0 || record.Expiration.Before(earliest.Expiration) {
+			victim = addr
+			earliest = record
+		}
+	}
+	return victim, earliest
+}
+
+// remove address if present
+func (s *Scanner) removeAddress(addr, pattern string) (string, error) {
+	if s.DryRun {
+		log.Printf("dry-run: would delete %s from %s; %s\n", addr, s.AddressFile, s.describeBackend("delete", addr, pattern))
+		return "deleted (dry-run) from", nil
+	}
+	// the watchlist is updated even when the command fails
+	err := s.runBackend("delete", addr, pattern, "")
 	if err != nil {
 		return "", err
 	}
-	if !slices.Contains(addrs, addr) {
+	s.addressLock.Lock()
+	defer s.addressLock.Unlock()
+	watchlist, err := s.loadWatchlist()
+	if err != nil {
+		return "", err
+	}
+	delete(s.present, addr)
+	if !watchlist.set[addr] {
 		return "not present in", nil
 	}
-	i := slices.Index(addrs, addr)
-	addrs = slices.Delete(addrs, i, i+1)
-	err = os.WriteFile(s.AddressFile, []byte(strings.Join(addrs, "\n")+"\n"), 0600)
+	addrs := slices.DeleteFunc(slices.Clone(watchlist.addrs), func(entry string) bool { return entry == addr })
+	err = s.saveWatchlist(addrs)
 	if err != nil {
 		return "", err
 	}
 	return "deleted from", nil
 }
 
-func (s *Scanner) exec(command string, args []string) error {
-	log.Printf("scanner: %s %s\n", command, strings.Join(args, " "))
+// add or delete addr in PFTable when it is set, otherwise run the add or delete command or
+// queue it for the next batch; line is the log line that caused an add, if any.
+// Returns false when no command was run.
+func (s *Scanner) backend(action, addr, pattern, line string) (bool, error) {
+	if s.PFTable != "" {
+		return true, pfTable(action, s.PFTable, addr)
+	}
+	if s.FlushInterval > 0 {
+		s.queueBatch(action, addr, pattern)
+		return false, nil
+	}
+	timeout := s.recordTimeout(addr)
+	command, args := s.batchCommand(action, []string{addr}, pattern, timeout)
+	if command == "" {
+		return false, nil
+	}
+	return true, s.exec(command, args, commandEnv(action, []string{addr}, pattern, line, timeout))
+}
+
+// describe what backend would do for a dry run
+func (s *Scanner) describeBackend(action, addr, pattern string) string {
+	if s.PFTable != "" {
+		return fmt.Sprintf("pf table: %s %s", s.PFTable, action)
+	}
+	command, args := s.command(action, addr, pattern)
+	return fmt.Sprintf("command: %s %s", command, strings.Join(args, " "))
+}
+
+// run a command with env added to its environment, retrying up to CommandRetries times on failure
+// with a delay starting at CommandBackoff and doubling
+func (s *Scanner) exec(command string, args, env []string) error {
+	if s.DryRun {
+		log.Printf("dry-run: would run %s %s\n", command, strings.Join(args, " "))
+		return nil
+	}
+	// held shared while a command runs so shutdown can wait for it
+	s.commandLock.RLock()
+	defer s.commandLock.RUnlock()
+	var err error
+	delay := s.CommandBackoff
+	for attempt := 0; attempt <= s.CommandRetries; attempt++ {
+		if attempt > 0 {
+			log.Printf("scanner: retrying %s in %v (attempt %d of %d): %v\n", command, delay, attempt+1, s.CommandRetries+1, err)
+			select {
+			case <-s.ctx.Done():
+				return err
+			case <-time.After(delay):
+			}
+			delay *= 2
+		}
+		err = s.run(command, args, env)
+		if err == nil {
+			return nil
+		}
+	}
+	s.metrics.commandErrors.Add(1)
+	return err
+}
+
+// env is not logged; it may carry log line content
+func (s *Scanner) run(command string, args, env []string) error {
+	s.event("command", fields{"command": command, "args": args}, "scanner: %s %s\n", command, strings.Join(args, " "))
 	cmd := exec.Command(command, args...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
 	var stdout bytes.Buffer
 	var stderr bytes.Buffer
-	cmd.Stdout = bufio.NewWriter(&stdout)
-	cmd.Stderr = bufio.NewWriter(&stderr)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
 	err := cmd.Run()
-	if err != nil {
-		return err
-	}
 	if stdout.Len() > 0 {
 		log.Printf("[%s]: %s", command, stdout.String())
 	}
 	if stderr.Len() > 0 {
 		log.Printf("[%s]: %s", command, stderr.String())
 	}
-	return nil
+	return err
 }
 
-func (s *Scanner) handler(startChan chan struct{}) error {
+func (s *Scanner) handler(ctx context.Context, startChan chan struct{}) error {
 	defer func() {
 		log.Println("handler: exiting")
 		s.active.Delete("handler")
@@ -496,8 +2600,16 @@ func (s *Scanner) handler(startChan chan struct{}) error {
 	s.active.Store("handler", true)
 	sigint := make(chan os.Signal, 1)
 	signal.Notify(sigint, syscall.SIGINT)
+	defer signal.Stop(sigint)
 	sigterm := make(chan os.Signal, 1)
 	signal.Notify(sigterm, syscall.SIGTERM)
+	defer signal.Stop(sigterm)
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+	sigusr1 := make(chan os.Signal, 1)
+	notifySweepSignal(sigusr1)
+	defer signal.Stop(sigusr1)
 	if s.verbose {
 		fmt.Println("CTRL-C to exit")
 	}
@@ -506,45 +2618,121 @@ func (s *Scanner) handler(startChan chan struct{}) error {
 		select {
 		case <-sigint:
 			log.Println("handler: received SIGINT")
+			s.cleanupOnExit()
 			return nil
 		case <-sigterm:
 			log.Println("handler: received SIGTERM")
+			s.cleanupOnExit()
 			return nil
-		case _, ok := <-s.handlerStop:
-			if ok {
-				log.Println("handler: received handlerStop")
-				return nil
-			} else {
-				log.Println("handler: handlerStop has closed")
-				return nil
+		case <-sighup:
+			log.Println("handler: received SIGHUP")
+			err := s.reload()
+			if err != nil {
+				log.Printf("handler: reload failed; keeping current config: %v\n", err)
 			}
+		case <-sigusr1:
+			log.Println("handler: received SIGUSR1")
+			s.Sweep()
+		case <-ctx.Done():
+			log.Println("handler: context done")
+			return nil
 		}
 	}
-	return Fatalf("unexpected exit")
 }
 
-func (s *Scanner) Start() error {
-	reaperStarted := make(chan struct{})
-	go func() {
-		s.wg.Add(1)
-		defer s.wg.Done()
-		s.reaperErr <- s.reaper(reaperStarted)
-	}()
-	<-reaperStarted
-	scannerStarted := make(chan struct{})
-	go func() {
-		s.wg.Add(1)
-		defer s.wg.Done()
-		s.scannerErr <- s.scanner(scannerStarted)
-	}()
-	<-scannerStarted
-	handlerStarted := make(chan struct{})
+// have the shutdown that follows a stop signal remove every address when CleanupOnExit is set
+func (s *Scanner) cleanupOnExit() {
+	if s.CleanupOnExit {
+		s.active.Store("cleanup", true)
+	}
+}
+
+// re-read the config file and replace the patterns, commands, and timeout in place
+func (s *Scanner) reload() error {
+	if !s.viperConfig {
+		return fmt.Errorf("configured by NewScannerFromConfig; nothing to reload")
+	}
+	err := viper.ReadInConfig()
+	if err != nil {
+		return err
+	}
+	timeout, err := ConfiguredDuration("timeout")
+	if err != nil {
+		return err
+	}
+	addCommand, addArgs, deleteCommand, deleteArgs, err := readCommands()
+	if err != nil {
+		return err
+	}
+	onMatchCommand, onMatchArgs, err := readOnMatchCommand()
+	if err != nil {
+		return err
+	}
+	softTimeoutCmd, softTimeoutArgs, err := readSoftTimeoutCommand()
+	if err != nil {
+		return err
+	}
+	patterns, rules, err := readPatternRules(ViperGetStringSlice("regex"))
+	if err != nil {
+		return err
+	}
+	// slowLock is taken before configLock is held
+	s.resetSlowPatterns()
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+	// lastMatches reads Patterns holding only matchLock
+	s.matchLock.Lock()
+	defer s.matchLock.Unlock()
+	s.Patterns = patterns
+	s.rules = rules
+	s.AddCommand = addCommand
+	s.AddArgs = addArgs
+	s.DeleteCommand = deleteCommand
+	s.DeleteArgs = deleteArgs
+	s.OnMatchCommand = onMatchCommand
+	s.OnMatchArgs = onMatchArgs
+	s.SoftTimeoutCmd = softTimeoutCmd
+	s.SoftTimeoutArgs = softTimeoutArgs
+	s.AddressTimeout = timeout
+	log.Printf("handler: reloaded %d patterns from %s\n", len(patterns), viper.ConfigFileUsed())
+	return nil
+}
+
+// the value returned by one of the scanner's goroutines when it exits
+type goprocResult struct {
+	name string
+	err  error
+}
+
+// reaper, scanner, handler, control, batcher and metrics; results is buffered for all of them
+const maxGoprocs = 6
+
+// run fn in a goroutine, returning once it has signalled that it started; its result is collected by Run
+func (s *Scanner) startGoproc(name string, fn func(context.Context, chan struct{}) error) {
+	started := make(chan struct{})
+	s.goprocs++
+	s.wg.Add(1)
 	go func() {
-		s.wg.Add(1)
 		defer s.wg.Done()
-		s.handlerErr <- s.handler(handlerStarted)
+		s.results <- goprocResult{name: name, err: fn(s.ctx, started)}
 	}()
-	<-handlerStarted
+	<-started
+}
+
+func (s *Scanner) Start() error {
+	s.startPool()
+	s.startGoproc("reaper", s.reaper)
+	s.startGoproc("scanner", s.scanner)
+	s.startGoproc("handler", s.handler)
+	if s.ControlSocket != "" {
+		s.startGoproc("control", s.control)
+	}
+	if s.FlushInterval > 0 {
+		s.startGoproc("batcher", s.batcher)
+	}
+	if s.ListenAddress != "" {
+		s.startGoproc("metrics", s.metricsServer)
+	}
 	s.started = true
 	return nil
 }
@@ -563,55 +2751,60 @@ func (s *Scanner) Run() error {
 	s.wg.Wait()
 	if s.verbose {
 		log.Println("run: all goprocs have exited")
+		for _, state := range s.LastMatches() {
+			log.Printf("run: last match [%s] %s %s\n", state.Pattern, state.Time.Format(time.RFC3339), state.Line)
+		}
 	}
-	var ret error
-	for done := false; !done; {
-		select {
-		case err, ok := <-s.reaperErr:
-			if ok {
-				if err != nil {
-					if ret == nil {
-						ret = err
-					} else {
-						log.Printf("reaper: %v", err)
-					}
-				}
-			}
-		case err, ok := <-s.scannerErr:
-			if ok {
-				if err != nil {
-					if ret == nil {
-						ret = err
-					} else {
-						log.Printf("scanner: %v", err)
-					}
-				}
-			}
-		case err, ok := <-s.handlerErr:
-			if ok {
-				if err != nil {
-					if ret == nil {
-						ret = err
-					} else {
-						log.Printf("handler: %v", err)
-					}
-				}
-			}
-		default:
-			done = true
+	s.logSummary()
+	if s.staleLines > 0 {
+		log.Printf("run: ignored %d matches in lines older than max_line_age\n", s.staleLines)
+	}
+	err := s.writeStats()
+	if err != nil {
+		log.Printf("run: failed writing stats file: %v\n", err)
+	}
+	err = s.writeMatchFile()
+	if err != nil {
+		log.Printf("run: failed writing match file: %v\n", err)
+	}
+	if s.verbose {
+		stats := s.Stats()
+		for _, count := range TopCounts(stats.Patterns, 0) {
+			log.Printf("run: pattern matches %d [%s]\n", count.Count, count.Key)
+		}
+		for _, count := range TopCounts(stats.Addresses, 10) {
+			log.Printf("run: address hits %d %s\n", count.Count, count.Key)
 		}
 	}
+	// every goroutine has sent its result before it exited, so exactly one is read for each
+	errs := []error{}
+	for range s.goprocs {
+		result := <-s.results
+		if result.err != nil {
+			log.Printf("run: %s exited: %v\n", result.name, result.err)
+			errs = append(errs, result.err)
+		}
+	}
+	s.goprocs = 0
+	s.unlockInstance()
+	return errors.Join(errs...)
+}
 
-	close(s.reaperErr)
-	close(s.scannerErr)
-	close(s.handlerErr)
-	return ret
+// log the totals of the run for post-mortem analysis from the log alone
+func (s *Scanner) logSummary() {
+	uptime := time.Since(s.startTime).Round(time.Second)
+	values := fields{
+		"lines":          s.metrics.lines.Load(),
+		"matches":        s.metrics.matches.Load(),
+		"added":          s.metrics.added.Load(),
+		"expired":        s.metrics.expired.Load(),
+		"command_errors": s.metrics.commandErrors.Load(),
+		"uptime":         uptime.String(),
+	}
+	s.event("summary", values, "run: summary: %d lines, %d matches, %d added, %d expired, %d command errors, uptime %v\n", values["lines"], values["matches"], values["added"], values["expired"], values["command_errors"], uptime)
 }
 
 func (s *Scanner) Stop() error {
 	s.shutdown("stop")
-	close(s.reaperStop)
-	close(s.scannerStop)
-	close(s.handlerStop)
 	return nil
 }
@@ -0,0 +1,3061 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+func initTestConfig(t testing.TB) string {
+	viper.Reset()
+	Init("iplsd", "test", filepath.Join("testdata", "config.yaml"))
+	dir := t.TempDir()
+	ViperSet("monitored_file", filepath.Join(dir, "logfile"))
+	ViperSet("address_file", filepath.Join(dir, "watchlist"))
+	ViperSet("timeout_dir", filepath.Join(dir, "timeout"))
+	return dir
+}
+
+func newTestScanner(t testing.TB, patterns ...string) *Scanner {
+	if len(patterns) == 0 {
+		patterns = []string{IP_PATTERN.String()}
+	}
+	s, err := NewScanner(
+		ViperGetString("monitored_file"),
+		ViperGetString("address_file"),
+		ViperGetString("timeout_dir"),
+		patterns,
+	)
+	require.Nil(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestTimeoutFilename(t *testing.T) {
+	for _, addr := range []string{"192.0.2.1", "2001:db8::1"} {
+		name := timeoutFilename(addr)
+		require.NotContains(t, name, ":")
+		decoded, err := filenameAddress(name)
+		require.Nil(t, err)
+		require.Equal(t, addr, decoded)
+	}
+}
+
+func TestMixedFamilyLine(t *testing.T) {
+	initTestConfig(t)
+	s := newTestScanner(t, IP_PATTERN.String(), IP6_PATTERN.String())
+	err := s.processLine("sshd[42]: failed login from 192.0.2.7 via 2001:db8::1 port 22")
+	require.Nil(t, err)
+	err = s.processLine("sshd[42]: failed login from 2001:0db8:0:0::1 port 22")
+	require.Nil(t, err)
+	addrs, err := s.readAddressFile()
+	require.Nil(t, err)
+	require.Equal(t, []string{"192.0.2.7", "2001:db8::1"}, addrs)
+	require.FileExists(t, filepath.Join(s.TimeoutDir, timeoutFilename("2001:db8::1")))
+	timeouts, err := ReadTimeouts(s.TimeoutDir)
+	require.Nil(t, err)
+	require.Len(t, timeouts, 2)
+	_, err = s.removeAddress("2001:db8::1", "")
+	require.Nil(t, err)
+	data, err := os.ReadFile(s.AddressFile)
+	require.Nil(t, err)
+	require.Equal(t, "192.0.2.7\n", string(data))
+}
+
+func TestLastMatch(t *testing.T) {
+	dir := initTestConfig(t)
+	matchFile := filepath.Join(dir, "matches.json")
+	ViperSet("match_file", matchFile)
+	s := newTestScanner(t, `from ((?:\d{1,3}\.){3}\d{1,3})`, `user=(\w+)`)
+	require.Empty(t, s.LastMatches())
+	s.setLastMatch(s.Patterns[0], "failed from 192.0.2.1")
+	s.setLastMatch(s.Patterns[0], "failed from 192.0.2.2")
+	matches := s.LastMatches()
+	require.Len(t, matches, 1)
+	require.Equal(t, s.Patterns[0].String(), matches[0].Pattern)
+	require.Equal(t, "failed from 192.0.2.2", matches[0].Line)
+	// matches are persisted by the sweep, not as they happen
+	require.NoFileExists(t, matchFile)
+	require.Nil(t, s.sweep())
+
+	persisted, err := ReadMatchFile(matchFile)
+	require.Nil(t, err)
+	require.Equal(t, matches[0].Line, persisted[0].Line)
+	// an unchanged state is not rewritten
+	require.Nil(t, os.Remove(matchFile))
+	require.Nil(t, s.writeMatchFile())
+	require.NoFileExists(t, matchFile)
+	s.setLastMatch(s.Patterns[0], "failed from 192.0.2.2")
+	require.Nil(t, s.writeMatchFile())
+	require.FileExists(t, matchFile)
+
+	// a restarted scanner reloads the persisted state
+	require.Nil(t, s.Close())
+	s = newTestScanner(t, `from ((?:\d{1,3}\.){3}\d{1,3})`, `user=(\w+)`)
+	require.Equal(t, "failed from 192.0.2.2", s.LastMatches()[0].Line)
+}
+
+func TestLineTime(t *testing.T) {
+	initTestConfig(t)
+	s := newTestScanner(t)
+	now := time.Now().Truncate(time.Second)
+	recent := now.Add(-time.Hour)
+	future := now.Add(48 * time.Hour)
+	tests := []struct {
+		name   string
+		layout string
+		line   string
+		ok     bool
+		want   time.Time
+	}{
+		{"no layout", "", recent.Format(time.Stamp) + " host sshd: x", false, time.Time{}},
+		{"syslog", time.Stamp, recent.Format(time.Stamp) + " host sshd[1]: failed", true, recent},
+		{"syslog rollover", time.Stamp, future.Format(time.Stamp) + " host sshd[1]: failed", true, future.AddDate(-1, 0, 0)},
+		{"rfc3339", time.RFC3339, recent.Format(time.RFC3339) + " host sshd[1]: failed", true, recent},
+		{"unparseable", time.Stamp, "garbage line", false, time.Time{}},
+		{"short line", time.Stamp, "Jan", false, time.Time{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s.TimeLayout = test.layout
+			stamp, ok := s.lineTime(test.line)
+			require.Equal(t, test.ok, ok)
+			if ok {
+				require.True(t, test.want.Equal(stamp), "want %v got %v", test.want, stamp)
+			}
+		})
+	}
+}
+
+func TestMaxLineAgeRequiresLayout(t *testing.T) {
+	initTestConfig(t)
+	ViperSet("max_line_age", "1h")
+	_, err := NewScanner(ViperGetString("monitored_file"), ViperGetString("address_file"), ViperGetString("timeout_dir"), []string{IP_PATTERN.String()})
+	require.NotNil(t, err)
+	ViperSet("timestamp_layout", time.Stamp)
+	s := newTestScanner(t)
+	_, stale := s.lineAge(time.Now().Add(-2*time.Hour).Format(time.Stamp) + " host sshd: from 192.0.2.1")
+	require.True(t, stale)
+}
+
+func TestSimulateExpiry(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	// written with a 24h timeout: last seen 1h, 6h and 20h ago
+	for addr, lastSeen := range map[string]time.Duration{
+		"192.0.2.1": time.Hour,
+		"192.0.2.2": 6 * time.Hour,
+		"192.0.2.3": 20 * time.Hour,
+	} {
+		data, err := now.Add(-lastSeen).Add(24 * time.Hour).MarshalText()
+		require.Nil(t, err)
+		require.Nil(t, os.WriteFile(filepath.Join(dir, addr), data, 0600))
+	}
+	count := func(results []SimulatedExpiry) (int, int) {
+		var expired, remaining int
+		for _, result := range results {
+			if result.Expired {
+				expired++
+			} else {
+				remaining++
+			}
+		}
+		return expired, remaining
+	}
+	results, err := SimulateExpiry(dir, 24*time.Hour, 4*time.Hour)
+	require.Nil(t, err)
+	expired, remaining := count(results)
+	require.Equal(t, 2, expired)
+	require.Equal(t, 1, remaining)
+
+	results, err = SimulateExpiry(dir, 24*time.Hour, 48*time.Hour)
+	require.Nil(t, err)
+	expired, remaining = count(results)
+	require.Equal(t, 0, expired)
+	require.Equal(t, 3, remaining)
+
+	// records set by per-pattern timeouts are recomputed from when they were last seen
+	dir = t.TempDir()
+	for addr, record := range map[string]struct {
+		pattern  string
+		timeout  time.Duration
+		lastSeen time.Duration
+	}{
+		"192.0.2.1": {"spam from (\\S+)", 7 * 24 * time.Hour, 6 * time.Hour},
+		"192.0.2.2": {"probe from (\\S+)", time.Hour, 30 * time.Minute},
+		"192.0.2.3": {"", 24 * time.Hour, time.Hour},
+	} {
+		lastSeen := now.Add(-record.lastSeen)
+		data, err := json.Marshal(TimeoutRecord{Address: addr, Pattern: record.pattern, LastSeen: lastSeen, Expiration: lastSeen.Add(record.timeout)})
+		require.Nil(t, err)
+		require.Nil(t, os.WriteFile(filepath.Join(dir, addr), data, 0600))
+	}
+	results, err = SimulateExpiry(dir, 24*time.Hour, 4*time.Hour)
+	require.Nil(t, err)
+	require.Len(t, results, 3)
+	for _, result := range results {
+		switch result.Address {
+		case "192.0.2.1":
+			require.True(t, result.Expired)
+			require.WithinDuration(t, now.Add(-2*time.Hour), result.Expiration, time.Second)
+		case "192.0.2.2":
+			require.False(t, result.Expired)
+			require.WithinDuration(t, now.Add(210*time.Minute), result.Expiration, time.Second)
+		case "192.0.2.3":
+			require.False(t, result.Expired)
+			require.WithinDuration(t, now.Add(3*time.Hour), result.Expiration, time.Second)
+		}
+	}
+}
+
+func appendLine(t *testing.T, filename, line string) {
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	require.Nil(t, err)
+	defer file.Close()
+	_, err = file.WriteString(line + "\n")
+	require.Nil(t, err)
+}
+
+func requireAddresses(t *testing.T, s *Scanner, expected ...string) {
+	require.Eventually(t, func() bool {
+		addrs, err := s.readAddressFile()
+		return err == nil && slices.Equal(expected, addrs)
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestSymlinkRepoint(t *testing.T) {
+	dir := initTestConfig(t)
+	first := filepath.Join(dir, "first.log")
+	second := filepath.Join(dir, "second.log")
+	link := filepath.Join(dir, "current")
+	appendLine(t, first, "startup")
+	require.Nil(t, os.Symlink(first, link))
+	ViperSet("monitored_file", link)
+	ViperSet("follow_symlink", true)
+	ViperSet("symlink_check_seconds", "0.1")
+	s := newTestScanner(t, `from ((?:\d{1,3}\.){3}\d{1,3})`)
+
+	result := startTestScanner(t, s)
+	appendLine(t, first, "failed from 192.0.2.1")
+	requireAddresses(t, s, "192.0.2.1")
+
+	// lines already in the new target are read once the link moves
+	appendLine(t, second, "failed from 192.0.2.2")
+	require.Nil(t, os.Remove(link))
+	require.Nil(t, os.Symlink(second, link))
+	requireAddresses(t, s, "192.0.2.1", "192.0.2.2")
+	appendLine(t, second, "failed from 192.0.2.3")
+	requireAddresses(t, s, "192.0.2.1", "192.0.2.2", "192.0.2.3")
+
+	s.shutdown("test")
+	require.Nil(t, <-result)
+}
+
+func TestStructuredCommand(t *testing.T) {
+	initTestConfig(t)
+	ViperSet("command", []string{"true", "-t", "blocklist"})
+	ViperSet("add_args", []string{"-T", "add"})
+	ViperSet("delete_args", []string{"-T", "delete", "{ip}", "-q"})
+	s := newTestScanner(t)
+	require.Equal(t, "true", s.AddCommand)
+	require.Equal(t, []string{"-t", "blocklist", "-T", "add", "192.0.2.1"}, commandArgs(s.AddArgs, []string{"192.0.2.1"}, "", 0))
+	require.Equal(t, "true", s.DeleteCommand)
+	require.Equal(t, []string{"-t", "blocklist", "-T", "delete", "192.0.2.1", "-q"}, commandArgs(s.DeleteArgs, []string{"192.0.2.1"}, "", 0))
+	// composing the argv never modifies the configured arguments
+	require.Equal(t, []string{"-t", "blocklist", "-T", "add"}, s.AddArgs)
+}
+
+func TestSplitCommand(t *testing.T) {
+	for _, test := range []struct {
+		line    string
+		command string
+		args    []string
+	}{
+		{"", "", nil},
+		{"   ", "", nil},
+		{"pfctl", "pfctl", []string{}},
+		{"  pfctl   -t  blocklist -T add  ", "pfctl", []string{"-t", "blocklist", "-T", "add"}},
+		{`mycmd --comment "blocked by iplsd" -t table`, "mycmd", []string{"--comment", "blocked by iplsd", "-t", "table"}},
+		{`mycmd --tag 'a  b' ""`, "mycmd", []string{"--tag", "a  b", ""}},
+		{`mycmd --comment 'said "hi"' -t table`, "mycmd", []string{"--comment", `said "hi"`, "-t", "table"}},
+		{`mycmd --comment "it's \"quoted\"" \\n`, "mycmd", []string{"--comment", `it's "quoted"`, `\n`}},
+		{`mycmd blocked\ by\ iplsd 'back\slash' "keep\n"`, "mycmd", []string{"blocked by iplsd", `back\slash`, `keep\n`}},
+	} {
+		command, args, err := splitCommand(test.line)
+		require.Nil(t, err, test.line)
+		require.Equal(t, test.command, command, test.line)
+		require.Equal(t, test.args, args, test.line)
+	}
+	_, _, err := splitCommand(`mycmd "unterminated`)
+	require.ErrorContains(t, err, "unterminated")
+	_, _, err = splitCommand(`mycmd trailing\`)
+	require.ErrorContains(t, err, "trailing backslash")
+
+	initTestConfig(t)
+	ViperSet("add_command", "  true   -t   blocklist  ")
+	ViperSet("delete_command", "   ")
+	s := newTestScanner(t)
+	require.Equal(t, "true", s.AddCommand)
+	require.Equal(t, []string{"-t", "blocklist"}, s.AddArgs)
+	require.Equal(t, "", s.DeleteCommand)
+	require.Empty(t, s.DeleteArgs)
+
+	initTestConfig(t)
+	ViperSet("patterns", []any{map[string]any{"regex": `spam ((?:\d{1,3}\.){3}\d{1,3})`, "add_command": `true --comment "blocked by iplsd"`}})
+	s = newTestScanner(t)
+	require.Equal(t, []string{"--comment", "blocked by iplsd"}, s.rules[`spam ((?:\d{1,3}\.){3}\d{1,3})`].AddArgs)
+}
+
+func TestCommandPlaceholders(t *testing.T) {
+	require.Equal(t, []string{"-t", "blocklist", "-T", "add", "192.0.2.1"}, commandArgs([]string{"-t", "blocklist", "-T", "add"}, []string{"192.0.2.1"}, "p", time.Hour))
+	require.Equal(t, []string{"-T", "add", "192.0.2.1", "-t", "blocklist"}, commandArgs([]string{"-T", "add", "{ip}", "-t", "blocklist"}, []string{"192.0.2.1"}, "p", time.Hour))
+	require.Equal(t, []string{"--comment", "p for 3600s", "192.0.2.1"}, commandArgs([]string{"--comment", "{pattern} for {timeout}s"}, []string{"192.0.2.1"}, "p", time.Hour))
+
+	dir := initTestConfig(t)
+	output := filepath.Join(dir, "args")
+	script := filepath.Join(dir, "add")
+	require.Nil(t, os.WriteFile(script, []byte("#!/bin/sh\necho \"$@\" > "+output+"\n"), 0700))
+	ViperSet("add_command", script+" {ip} {timeout} {pattern}")
+	s := newTestScanner(t, `from ((?:\d{1,3}\.){3}\d{1,3})`)
+	require.Nil(t, s.processLine("failed from 192.0.2.1"))
+	data, err := os.ReadFile(output)
+	require.Nil(t, err)
+	require.Equal(t, fmt.Sprintf("192.0.2.1 %d %s\n", int64(s.AddressTimeout/time.Second), s.Patterns[0]), string(data))
+}
+
+func TestCommandConfigErrors(t *testing.T) {
+	newScanner := func() error {
+		_, err := NewScanner(ViperGetString("monitored_file"), ViperGetString("address_file"), ViperGetString("timeout_dir"), []string{IP_PATTERN.String()})
+		return err
+	}
+	initTestConfig(t)
+	ViperSet("command", []string{"true"})
+	ViperSet("add_command", "true")
+	require.ErrorContains(t, newScanner(), "conflicts")
+
+	initTestConfig(t)
+	ViperSet("command", []string{"iplsd-no-such-command"})
+	require.ErrorContains(t, newScanner(), "not found")
+
+	initTestConfig(t)
+	ViperSet("delete_command", "iplsd-no-such-command -x")
+	require.ErrorContains(t, newScanner(), "not found")
+}
+
+func TestInvalidIPv6Candidates(t *testing.T) {
+	initTestConfig(t)
+	s := newTestScanner(t, IP6_PATTERN.String())
+	for _, line := range []string{"std::string", "garbage::text", "addr 2001:db8::1: done", "listening on :: port 22"} {
+		require.Nil(t, s.processLine(line))
+	}
+	addrs, err := s.readAddressFile()
+	require.Nil(t, err)
+	require.Empty(t, addrs)
+	timeouts, err := ReadTimeouts(s.TimeoutDir)
+	require.Nil(t, err)
+	require.Empty(t, timeouts)
+
+	require.Nil(t, os.WriteFile(s.AddressFile, []byte("d::x\n"), 0600))
+	_, err = s.readAddressFile()
+	require.NotNil(t, err)
+}
+
+func startTestScanner(t *testing.T, s *Scanner) chan error {
+	started := make(chan struct{}, 1)
+	result := make(chan error, 1)
+	go func() {
+		result <- s.scanner(s.ctx, started)
+	}()
+	<-started
+	time.Sleep(200 * time.Millisecond)
+	return result
+}
+
+func TestLogRotation(t *testing.T) {
+	dir := initTestConfig(t)
+	logFile := filepath.Join(dir, "logfile")
+	appendLine(t, logFile, "startup")
+	s := newTestScanner(t, `from ((?:\d{1,3}\.){3}\d{1,3})`)
+	require.Equal(t, "name", s.FollowMode)
+	result := startTestScanner(t, s)
+	appendLine(t, logFile, "failed from 192.0.2.1")
+	requireAddresses(t, s, "192.0.2.1")
+
+	require.Nil(t, os.Rename(logFile, logFile+".0"))
+	appendLine(t, logFile, "failed from 192.0.2.2")
+	requireAddresses(t, s, "192.0.2.1", "192.0.2.2")
+
+	s.shutdown("test")
+	require.Nil(t, <-result)
+}
+
+func TestFollowerRestart(t *testing.T) {
+	dir := initTestConfig(t)
+	logFile := filepath.Join(dir, "logfile")
+	appendLine(t, logFile, "startup")
+	ViperSet("follower_restarts", 1)
+	s := newTestScanner(t, `from ((?:\d{1,3}\.){3}\d{1,3})`)
+	result := startTestScanner(t, s)
+	appendLine(t, logFile, "failed from 192.0.2.1")
+	requireAddresses(t, s, "192.0.2.1")
+
+	// a follower that exits without a shutdown is restarted
+	s.shutdownLock.Lock()
+	s.reader.Stop()
+	s.shutdownLock.Unlock()
+	time.Sleep(followRestartDelay + 200*time.Millisecond)
+	appendLine(t, logFile, "failed from 192.0.2.2")
+	requireAddresses(t, s, "192.0.2.1", "192.0.2.2")
+
+	// a line was read since the restart, so the next exit is restarted too
+	s.shutdownLock.Lock()
+	s.reader.Stop()
+	s.shutdownLock.Unlock()
+	time.Sleep(followRestartDelay + 200*time.Millisecond)
+	appendLine(t, logFile, "failed from 192.0.2.3")
+	requireAddresses(t, s, "192.0.2.1", "192.0.2.2", "192.0.2.3")
+
+	// with no line read since the last restart, the restart limit is reached
+	for range 2 {
+		s.shutdownLock.Lock()
+		s.reader.Stop()
+		s.shutdownLock.Unlock()
+		time.Sleep(followRestartDelay + 200*time.Millisecond)
+	}
+	select {
+	case err := <-result:
+		require.ErrorContains(t, err, "exited 2 times; giving up")
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "scanner did not give up")
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yaml")
+	writeConfig := func(regex string) {
+		config := "iplsd:\n  interval_seconds: 1\n  timeout_seconds: 5\n  poll_interval_seconds: 0.05\n  regex:\n    - '" + regex + "'\n"
+		require.Nil(t, os.WriteFile(configFile, []byte(config), 0600))
+	}
+	writeConfig(`first ((?:\d{1,3}\.){3}\d{1,3})`)
+	viper.Reset()
+	Init("iplsd", "test", configFile)
+	logFile := filepath.Join(dir, "logfile")
+	appendLine(t, logFile, "startup")
+	s, err := NewScanner(logFile, filepath.Join(dir, "watchlist"), filepath.Join(dir, "timeout"), ViperGetStringSlice("regex"))
+	require.Nil(t, err)
+
+	result := startTestScanner(t, s)
+	handlerStarted := make(chan struct{}, 1)
+	handlerResult := make(chan error, 1)
+	go func() {
+		handlerResult <- s.handler(s.ctx, handlerStarted)
+	}()
+	<-handlerStarted
+
+	appendLine(t, logFile, "first 192.0.2.1")
+	requireAddresses(t, s, "192.0.2.1")
+
+	writeConfig(`second ((?:\d{1,3}\.){3}\d{1,3})`)
+	require.Nil(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	require.Eventually(t, func() bool {
+		s.configLock.RLock()
+		defer s.configLock.RUnlock()
+		return s.Patterns[0].String() == `second ((?:\d{1,3}\.){3}\d{1,3})`
+	}, 5*time.Second, 50*time.Millisecond)
+	appendLine(t, logFile, "second 192.0.2.2")
+	requireAddresses(t, s, "192.0.2.1", "192.0.2.2")
+
+	// an invalid pattern keeps the current set
+	writeConfig(`second (`)
+	require.Nil(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	time.Sleep(200 * time.Millisecond)
+	appendLine(t, logFile, "second 192.0.2.3")
+	requireAddresses(t, s, "192.0.2.1", "192.0.2.2", "192.0.2.3")
+
+	s.shutdown("test")
+	require.Nil(t, <-result)
+	require.Nil(t, <-handlerResult)
+}
+
+func TestAllowlist(t *testing.T) {
+	dir := initTestConfig(t)
+	allowlist := filepath.Join(dir, "allowlist")
+	err := os.WriteFile(allowlist, []byte("# trusted networks\n10.0.0.0/8\n192.0.2.9 # monitor\n2001:db8:1::/48\n"), 0600)
+	require.Nil(t, err)
+	ViperSet("allowlist_file", allowlist)
+	s := newTestScanner(t, IP_PATTERN.String(), IP6_PATTERN.String())
+	for _, line := range []string{
+		"failed from 10.1.2.3",
+		"failed from 192.0.2.9",
+		"failed from 2001:db8:1::5",
+		"failed from 192.0.2.10",
+	} {
+		require.Nil(t, s.processLine(line))
+	}
+	addrs, err := s.readAddressFile()
+	require.Nil(t, err)
+	require.Equal(t, []string{"192.0.2.10"}, addrs)
+	require.NoFileExists(t, filepath.Join(s.TimeoutDir, timeoutFilename("10.1.2.3")))
+
+	err = os.WriteFile(allowlist, []byte("10.0.0.0/33\n"), 0600)
+	require.Nil(t, err)
+	_, err = ReadAllowlist(allowlist)
+	require.NotNil(t, err)
+}
+
+func TestMixedFamilyRanges(t *testing.T) {
+	dir := initTestConfig(t)
+	allowlist := filepath.Join(dir, "allowlist")
+	// each range only covers addresses of its own family; mapped IPv4 entries cover IPv4 addresses
+	err := os.WriteFile(allowlist, []byte("::/0\n2001:db8:1::/48\n::ffff:192.0.2.0/120\n::ffff:198.51.100.9\n"), 0600)
+	require.Nil(t, err)
+	ViperSet("allowlist_file", allowlist)
+	s := newTestScanner(t, IP_PATTERN.String(), IP6_PATTERN.String())
+	for _, line := range []string{
+		"failed from 192.0.2.5",
+		"failed from 198.51.100.9",
+		"failed from 198.51.100.10",
+		"failed from 2001:db8:1::5",
+		"failed from 2001:db8:2::5",
+		"failed from ::1",
+		"failed from fd12:3456::1",
+		"failed from fe80::1",
+	} {
+		require.Nil(t, s.processLine(line))
+	}
+	requireAddresses(t, s, "198.51.100.10")
+
+	initTestConfig(t)
+	s = newTestScanner(t)
+	for _, entry := range []string{"::1", "fd00::/8", "fe80::/64", "ff02::/16", "10.0.0.0/8", "::ffff:10.1.0.0/112"} {
+		require.True(t, s.skipAddress(entry), entry)
+	}
+	// networks reaching outside a private range are not skipped
+	for _, entry := range []string{"2001:db8::1", "fc00::/6", "::/0", "0.0.0.0/0", "::ffff:0.0.0.0/96", "126.0.0.0/7"} {
+		require.False(t, s.skipAddress(entry), entry)
+	}
+	entry, ok := normalizeEntry("::ffff:192.0.2.0/120")
+	require.True(t, ok)
+	require.Equal(t, "192.0.2.0/24", entry)
+}
+
+func TestBlockPrefix(t *testing.T) {
+	dir := initTestConfig(t)
+	allowlist := filepath.Join(dir, "allowlist")
+	require.Nil(t, os.WriteFile(allowlist, []byte("198.51.100.1\n"), 0600))
+	ViperSet("allowlist_file", allowlist)
+	ViperSet("block_prefix_v4", 24)
+	s := newTestScanner(t, IP_PATTERN.String(), IP6_PATTERN.String())
+	for _, line := range []string{
+		"failed from 192.0.2.7",
+		"failed from 192.0.2.99",
+		"failed from 198.51.100.20",
+		"failed from 2001:db8::1",
+	} {
+		require.Nil(t, s.processLine(line))
+	}
+	addrs, err := s.readAddressFile()
+	require.Nil(t, err)
+	require.Equal(t, []string{"192.0.2.0/24", "198.51.100.20", "2001:db8::1"}, addrs)
+	timeouts, err := ReadTimeouts(s.TimeoutDir)
+	require.Nil(t, err)
+	require.Len(t, timeouts, 3)
+	require.Contains(t, []string{timeouts[0].Address, timeouts[1].Address, timeouts[2].Address}, "192.0.2.0/24")
+
+	action, err := s.removeAddress("192.0.2.0/24", "")
+	require.Nil(t, err)
+	require.Equal(t, "deleted from", action)
+
+	initTestConfig(t)
+	ViperSet("block_prefix_v4", 33)
+	_, err = NewScanner(ViperGetString("monitored_file"), ViperGetString("address_file"), ViperGetString("timeout_dir"), []string{})
+	require.ErrorContains(t, err, "block_prefix_v4")
+}
+
+func TestMatchThreshold(t *testing.T) {
+	initTestConfig(t)
+	ViperSet("match_threshold", 3)
+	ViperSet("match_window", "200ms")
+	s := newTestScanner(t)
+
+	// below the threshold nothing is added
+	require.Nil(t, s.processLine("failed from 192.0.2.1"))
+	require.Nil(t, s.processLine("failed from 192.0.2.1"))
+	requireAddresses(t, s)
+	require.NoFileExists(t, filepath.Join(s.TimeoutDir, timeoutFilename("192.0.2.1")))
+
+	// the count restarts once the window elapses
+	time.Sleep(300 * time.Millisecond)
+	require.Nil(t, s.processLine("failed from 192.0.2.1"))
+	requireAddresses(t, s)
+
+	// at the threshold the address is added
+	require.Nil(t, s.processLine("failed from 192.0.2.1"))
+	require.Nil(t, s.processLine("failed from 192.0.2.1"))
+	requireAddresses(t, s, "192.0.2.1")
+
+	time.Sleep(300 * time.Millisecond)
+	s.pruneMatchCounts()
+	require.Empty(t, s.matchCounts)
+
+	initTestConfig(t)
+	ViperSet("match_threshold", 3)
+	_, err := NewScanner(ViperGetString("monitored_file"), ViperGetString("address_file"), ViperGetString("timeout_dir"), []string{})
+	require.ErrorContains(t, err, "match_window")
+}
+
+func TestTimeoutBackoff(t *testing.T) {
+	initTestConfig(t)
+	ViperSet("timeout_seconds", "100")
+	ViperSet("timeout_backoff_factor", "2")
+	ViperSet("timeout_max_seconds", "300")
+	s := newTestScanner(t)
+	filename := filepath.Join(s.TimeoutDir, timeoutFilename("192.0.2.1"))
+
+	// expire the current record, then match the address again
+	strike := func(expectedStrikes int, expectedTimeout time.Duration) {
+		require.Nil(t, s.processLine("failed from 192.0.2.1"))
+		record, err := readTimeoutFile(filename)
+		require.Nil(t, err)
+		require.Equal(t, expectedStrikes, record.Strikes)
+		require.WithinDuration(t, time.Now().Add(expectedTimeout), record.Expiration, 5*time.Second)
+		record.Expiration = time.Now().Add(-time.Second)
+		require.Nil(t, s.writeTimeoutRecord(filename, record))
+		require.Nil(t, s.expire())
+		requireAddresses(t, s)
+		record, err = readTimeoutFile(filename)
+		require.Nil(t, err)
+		require.True(t, record.Released)
+	}
+	strike(0, 100*time.Second)
+	strike(1, 200*time.Second)
+	strike(2, 300*time.Second)
+
+	// released strikes are forgotten once timeout_max has passed
+	record, err := readTimeoutFile(filename)
+	require.Nil(t, err)
+	record.Expiration = time.Now().Add(-301 * time.Second)
+	require.Nil(t, s.writeTimeoutRecord(filename, record))
+	require.Nil(t, s.expire())
+	require.NoFileExists(t, filename)
+
+	// a plain timestamp file has no strikes
+	expiration := time.Now().Add(s.AddressTimeout).Truncate(time.Second)
+	data, err := expiration.MarshalText()
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(filename, data, 0600))
+	record, err = readTimeoutFile(filename)
+	require.Nil(t, err)
+	require.Equal(t, 0, record.Strikes)
+	require.True(t, expiration.Equal(record.Expiration))
+}
+
+func TestTimeoutRecord(t *testing.T) {
+	initTestConfig(t)
+	s := newTestScanner(t, `from ((?:\d{1,3}\.){3}\d{1,3})`)
+	require.Nil(t, s.processLine("failed from 192.0.2.1"))
+	require.Nil(t, s.processLine("failed from 192.0.2.1"))
+	filename := filepath.Join(s.TimeoutDir, timeoutFilename("192.0.2.1"))
+	record, err := readTimeoutFile(filename)
+	require.Nil(t, err)
+	require.Equal(t, "192.0.2.1", record.Address)
+	require.Equal(t, s.Patterns[0].String(), record.Pattern)
+	require.Equal(t, 2, record.MatchCount)
+	require.False(t, record.LastSeen.Before(record.FirstSeen))
+	require.Equal(t, record.LastSeen.Add(s.AddressTimeout), record.Expiration)
+
+	// plain timestamp files are upgraded when the scanner starts
+	legacy := filepath.Join(s.TimeoutDir, timeoutFilename("2001:db8::1"))
+	expiration := time.Now().Add(s.AddressTimeout).Truncate(time.Second)
+	data, err := expiration.MarshalText()
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(legacy, data, 0600))
+	require.Nil(t, os.WriteFile(s.AddressFile, []byte("192.0.2.1\n2001:db8::1\n"), 0600))
+	require.Nil(t, s.Close())
+	s = newTestScanner(t)
+	data, err = os.ReadFile(legacy)
+	require.Nil(t, err)
+	require.Contains(t, string(data), `"address": "2001:db8::1"`)
+	record, err = readTimeoutFile(legacy)
+	require.Nil(t, err)
+	require.True(t, expiration.Equal(record.Expiration))
+	require.True(t, expiration.Add(-s.AddressTimeout).Equal(record.FirstSeen))
+}
+
+func TestAtomicAddressFile(t *testing.T) {
+	initTestConfig(t)
+	s := newTestScanner(t)
+	require.Nil(t, s.processLine("failed from 192.0.2.1"))
+	original, err := os.ReadFile(s.AddressFile)
+	require.Nil(t, err)
+
+	// interrupt the write after the temporary file is complete but before it replaces the watchlist
+	defer func() { renameFile = os.Rename }()
+	renameFile = func(tempName, filename string) error {
+		require.Equal(t, filepath.Dir(filename), filepath.Dir(tempName))
+		data, err := os.ReadFile(tempName)
+		require.Nil(t, err)
+		require.Equal(t, "192.0.2.1\n192.0.2.2\n", string(data))
+		current, err := os.ReadFile(filename)
+		require.Nil(t, err)
+		require.Equal(t, original, current)
+		return os.ErrPermission
+	}
+	_, err = s.addAddress("192.0.2.2", "", "")
+	require.ErrorIs(t, err, os.ErrPermission)
+	current, err := os.ReadFile(s.AddressFile)
+	require.Nil(t, err)
+	require.Equal(t, original, current)
+	entries, err := os.ReadDir(filepath.Dir(s.AddressFile))
+	require.Nil(t, err)
+	for _, entry := range entries {
+		require.NotContains(t, entry.Name(), ".watchlist.")
+	}
+
+	renameFile = os.Rename
+	_, err = s.addAddress("192.0.2.2", "", "")
+	require.Nil(t, err)
+	requireAddresses(t, s, "192.0.2.1", "192.0.2.2")
+	info, err := os.Stat(s.AddressFile)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestConcurrentAddressUpdates(t *testing.T) {
+	initTestConfig(t)
+	s := newTestScanner(t)
+	for i := 0; i < 20; i++ {
+		_, err := s.addAddress(fmt.Sprintf("198.51.100.%d", i), "", "")
+		require.Nil(t, err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 80)
+	for i := 0; i < 20; i++ {
+		wg.Add(4)
+		go func() {
+			defer wg.Done()
+			_, err := s.addAddress(fmt.Sprintf("192.0.2.%d", i), "", "")
+			errs <- err
+		}()
+		go func() {
+			defer wg.Done()
+			// a duplicate add of the same address
+			_, err := s.addAddress(fmt.Sprintf("192.0.2.%d", i), "", "")
+			errs <- err
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := s.removeAddress(fmt.Sprintf("198.51.100.%d", i), "")
+			errs <- err
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := s.removeAddress(fmt.Sprintf("203.0.113.%d", i), "")
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.Nil(t, err)
+	}
+	addrs, err := s.readAddressFile()
+	require.Nil(t, err)
+	expected := []string{}
+	for i := 0; i < 20; i++ {
+		expected = append(expected, fmt.Sprintf("192.0.2.%d", i))
+	}
+	slices.Sort(addrs)
+	slices.Sort(expected)
+	require.Equal(t, expected, addrs)
+}
+
+func TestControlSocket(t *testing.T) {
+	dir := initTestConfig(t)
+	ViperSet("control_socket", filepath.Join(dir, "control.sock"))
+	s := newTestScanner(t)
+	started := make(chan struct{})
+	result := make(chan error, 1)
+	go func() {
+		result <- s.control(s.ctx, started)
+	}()
+	<-started
+
+	conn, err := net.Dial("unix", s.ControlSocket)
+	require.Nil(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	request := func(command string) []string {
+		_, err := conn.Write([]byte(command + "\n"))
+		require.Nil(t, err)
+		lines := []string{}
+		for {
+			line, err := reader.ReadString('\n')
+			require.Nil(t, err)
+			line = strings.TrimSpace(line)
+			lines = append(lines, line)
+			if line == "OK" || strings.HasPrefix(line, "ERROR") {
+				return lines
+			}
+		}
+	}
+
+	require.Equal(t, []string{"OK"}, request("LIST"))
+	require.Equal(t, []string{"192.0.2.1 added to watchlist", "OK"}, request("ADD 192.0.2.1"))
+	requireAddresses(t, s, "192.0.2.1")
+	lines := request("list")
+	require.Len(t, lines, 2)
+	require.Equal(t, "192.0.2.1 5s", lines[0])
+	require.Contains(t, request("STATUS"), "addresses 1")
+	require.Equal(t, []string{"ERROR invalid address 'bogus'"}, request("ADD bogus"))
+	require.Equal(t, []string{"192.0.2.1 deleted from watchlist", "OK"}, request("REMOVE 192.0.2.1"))
+	require.Equal(t, []string{"OK"}, request("LIST"))
+	request("ADD 192.0.2.2")
+	request("ADD 192.0.2.3")
+	require.Equal(t, []string{"2 addresses flushed from watchlist", "OK"}, request("FLUSH"))
+	requireAddresses(t, s)
+	timeouts, err := ReadTimeouts(s.TimeoutDir)
+	require.Nil(t, err)
+	require.Empty(t, timeouts)
+
+	s.shutdown("test")
+	require.Nil(t, <-result)
+	require.NoFileExists(t, s.ControlSocket)
+}
+
+func TestMetrics(t *testing.T) {
+	initTestConfig(t)
+	ViperSet("listen_address", "127.0.0.1:0")
+	s := newTestScanner(t)
+	started := make(chan struct{})
+	result := make(chan error, 1)
+	go func() {
+		result <- s.metricsServer(s.ctx, started)
+	}()
+	<-started
+	url := "http://" + s.metricsListener.Addr().String()
+
+	get := func(path string) (int, string) {
+		response, err := http.Get(url + path)
+		require.Nil(t, err)
+		defer response.Body.Close()
+		body, err := io.ReadAll(response.Body)
+		require.Nil(t, err)
+		return response.StatusCode, string(body)
+	}
+
+	_, body := get("/metrics")
+	require.Contains(t, body, "iplsd_matches_total 0\n")
+	require.Contains(t, body, "iplsd_watchlist_size 0\n")
+	require.Nil(t, s.processLine("failed from 192.0.2.1"))
+	_, body = get("/metrics")
+	require.Contains(t, body, "iplsd_lines_total 1\n")
+	require.Contains(t, body, "iplsd_matches_total 1\n")
+	require.Contains(t, body, "iplsd_addresses_added_total 1\n")
+	require.Contains(t, body, "iplsd_watchlist_size 1\n")
+	require.Contains(t, body, "# TYPE iplsd_watchlist_size gauge\n")
+
+	status, _ := get("/healthz")
+	require.Equal(t, http.StatusServiceUnavailable, status)
+	s.active.Store("scanner", true)
+	s.active.Store("reaper", true)
+	status, _ = get("/healthz")
+	require.Equal(t, http.StatusOK, status)
+	s.active.Delete("scanner")
+	s.active.Delete("reaper")
+
+	s.shutdown("test")
+	require.Nil(t, <-result)
+}
+
+func TestPatternRules(t *testing.T) {
+	dir := initTestConfig(t)
+	ViperSet("add_command", "touch "+filepath.Join(dir, "default-{ip}"))
+	ViperSet("patterns", []any{
+		`sshd from ((?:\d{1,3}\.){3}\d{1,3})`,
+		map[string]any{
+			"regex":           `spam from ((?:\d{1,3}\.){3}\d{1,3})`,
+			"timeout_seconds": 604800,
+			"add_command":     "touch " + filepath.Join(dir, "spam-{ip}"),
+		},
+	})
+	s := newTestScanner(t, `flat ((?:\d{1,3}\.){3}\d{1,3})`)
+	require.Len(t, s.Patterns, 3)
+
+	require.Nil(t, s.processLine("sshd from 192.0.2.1"))
+	require.Nil(t, s.processLine("spam from 192.0.2.2"))
+	require.FileExists(t, filepath.Join(dir, "default-192.0.2.1"))
+	require.FileExists(t, filepath.Join(dir, "spam-192.0.2.2"))
+	require.NoFileExists(t, filepath.Join(dir, "default-192.0.2.2"))
+
+	record, err := readTimeoutFile(filepath.Join(s.TimeoutDir, timeoutFilename("192.0.2.1")))
+	require.Nil(t, err)
+	require.Equal(t, s.AddressTimeout, record.Expiration.Sub(record.LastSeen))
+	record, err = readTimeoutFile(filepath.Join(s.TimeoutDir, timeoutFilename("192.0.2.2")))
+	require.Nil(t, err)
+	require.Equal(t, 7*24*time.Hour, record.Expiration.Sub(record.LastSeen))
+
+	initTestConfig(t)
+	ViperSet("patterns", []any{map[string]any{"regex": "x", "timeout": 10}})
+	_, err = NewScanner(ViperGetString("monitored_file"), ViperGetString("address_file"), ViperGetString("timeout_dir"), []string{})
+	require.ErrorContains(t, err, "unknown key 'timeout'")
+}
+
+func TestObservePattern(t *testing.T) {
+	initTestConfig(t)
+	ViperSet("patterns", []any{
+		map[string]any{"regex": `probe from ((?:\d{1,3}\.){3}\d{1,3})`, "mode": "observe"},
+		map[string]any{"regex": `failed from ((?:\d{1,3}\.){3}\d{1,3})`, "mode": "block"},
+	})
+	s, err := NewScanner(ViperGetString("monitored_file"), ViperGetString("address_file"), ViperGetString("timeout_dir"), []string{})
+	require.Nil(t, err)
+	defer s.Close()
+	var logged syncBuffer
+	writer := log.Writer()
+	defer log.SetOutput(writer)
+	log.SetOutput(&logged)
+	require.Nil(t, s.processLine("probe from 192.0.2.1"))
+	require.Nil(t, s.processLine("failed from 192.0.2.2"))
+	require.Contains(t, logged.String(), "scanner: IP 192.0.2.1 observed by pattern 'probe from")
+	requireAddresses(t, s, "192.0.2.2")
+	require.NoFileExists(t, filepath.Join(s.TimeoutDir, timeoutFilename("192.0.2.1")))
+
+	initTestConfig(t)
+	ViperSet("patterns", []any{map[string]any{"regex": "x", "mode": "watch"}})
+	_, err = NewScanner(ViperGetString("monitored_file"), ViperGetString("address_file"), ViperGetString("timeout_dir"), []string{})
+	require.ErrorContains(t, err, "mode must be 'block' or 'observe'")
+}
+
+func TestInvalidIPv4Candidates(t *testing.T) {
+	initTestConfig(t)
+	s := newTestScanner(t)
+	for _, line := range []string{
+		"failed from 999.888.777.666",
+		"failed from 256.1.1.1 port 22",
+		"failed from 1.2.3.04",
+		"client OpenSSH_9.1.2.3 connected",
+		"route 10.1.2.3.4 updated",
+	} {
+		require.Nil(t, s.processLine(line))
+	}
+	requireAddresses(t, s)
+	timeouts, err := ReadTimeouts(s.TimeoutDir)
+	require.Nil(t, err)
+	require.Empty(t, timeouts)
+
+	for _, line := range []string{"failed from 192.0.2.1.", "failed [192.0.2.2]:22", "192.0.2.3"} {
+		require.Nil(t, s.processLine(line))
+	}
+	requireAddresses(t, s, "192.0.2.1", "192.0.2.2", "192.0.2.3")
+
+	require.Nil(t, os.WriteFile(s.AddressFile, []byte("192.0.2.1\n999.1.1.1\n"), 0600))
+	_, err = s.readAddressFile()
+	require.ErrorContains(t, err, "999.1.1.1")
+}
+
+func TestSkipPrivate(t *testing.T) {
+	initTestConfig(t)
+	s := newTestScanner(t, IP_PATTERN.String(), IP6_PATTERN.String())
+	require.True(t, s.SkipPrivate)
+	lines := []string{
+		"failed from 127.0.0.1",
+		"failed from 10.1.2.3",
+		"failed from 172.16.5.4",
+		"failed from 192.168.1.1",
+		"failed from 169.254.0.1",
+		"failed from 224.0.0.1",
+		"failed from ::1",
+		"failed from fe80::1",
+		"failed from fd00::1",
+	}
+	for _, line := range lines {
+		require.Nil(t, s.processLine(line))
+	}
+	requireAddresses(t, s)
+
+	// existing private entries are not rearmed at startup
+	require.Nil(t, os.WriteFile(s.AddressFile, []byte("10.1.2.3\n192.0.2.1\n"), 0600))
+	require.Nil(t, s.Close())
+	s = newTestScanner(t)
+	require.NoFileExists(t, filepath.Join(s.TimeoutDir, timeoutFilename("10.1.2.3")))
+	require.FileExists(t, filepath.Join(s.TimeoutDir, timeoutFilename("192.0.2.1")))
+
+	ViperSet("skip_private", false)
+	require.Nil(t, s.Close())
+	s = newTestScanner(t)
+	require.Nil(t, s.processLine("failed from 192.168.1.1"))
+	require.Nil(t, s.processLine("failed from 127.0.0.1"))
+	requireAddresses(t, s, "10.1.2.3", "127.0.0.1", "192.0.2.1", "192.168.1.1")
+}
+
+func requireRunExits(t *testing.T, s *Scanner) {
+	result := make(chan error, 1)
+	go func() {
+		result <- s.Run()
+	}()
+	select {
+	case err := <-result:
+		require.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "goroutines did not exit after cancel")
+	}
+	for _, name := range []string{"reaper", "scanner", "handler", "control", "metrics"} {
+		_, ok := s.active.Load(name)
+		require.False(t, ok, name)
+	}
+}
+
+func TestContextCancel(t *testing.T) {
+	dir := initTestConfig(t)
+	appendLine(t, ViperGetString("monitored_file"), "startup")
+	ViperSet("control_socket", filepath.Join(dir, "control.sock"))
+	ViperSet("listen_address", "127.0.0.1:0")
+	s := newTestScanner(t)
+	require.Nil(t, s.Start())
+	for _, name := range []string{"reaper", "scanner", "handler", "control", "metrics"} {
+		_, ok := s.active.Load(name)
+		require.True(t, ok, name)
+	}
+	s.cancel()
+	requireRunExits(t, s)
+
+	s = newTestScanner(t)
+	require.Nil(t, s.Start())
+	require.Nil(t, s.Stop())
+	requireRunExits(t, s)
+}
+
+func TestConcurrentShutdown(t *testing.T) {
+	initTestConfig(t)
+	appendLine(t, ViperGetString("monitored_file"), "startup")
+	s := newTestScanner(t)
+	require.Nil(t, s.Start())
+	done := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for _, caller := range []string{"reaper", "handler", "scanner", "reaper"} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.shutdown(caller)
+			}()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Stop()
+		}()
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		require.Fail(t, "shutdown blocked")
+	}
+	requireRunExits(t, s)
+}
+
+func TestDuplicateMatchDebounce(t *testing.T) {
+	dir := initTestConfig(t)
+	countFile := filepath.Join(dir, "count")
+	ViperSet("command", []string{"sh", "-c", "echo {ip} >> " + countFile})
+	s := newTestScanner(t)
+	for i := 0; i < 20; i++ {
+		require.Nil(t, s.processLine("failed from 192.0.2.1"))
+	}
+	requireAddresses(t, s, "192.0.2.1")
+	data, err := os.ReadFile(countFile)
+	require.Nil(t, err)
+	require.Equal(t, "192.0.2.1\n", string(data))
+
+	// the delete shares the command, so removal and the next match each run it once more
+	_, err = s.removeAddress("192.0.2.1", "")
+	require.Nil(t, err)
+	require.Nil(t, s.processLine("failed from 192.0.2.1"))
+	data, err = os.ReadFile(countFile)
+	require.Nil(t, err)
+	require.Equal(t, "192.0.2.1\n192.0.2.1\n192.0.2.1\n", string(data))
+}
+
+func TestDryRun(t *testing.T) {
+	dir := initTestConfig(t)
+	countFile := filepath.Join(dir, "count")
+	ViperSet("command", []string{"sh", "-c", "echo {ip} >> " + countFile})
+	ViperSet("dry_run", true)
+	s := newTestScanner(t)
+	require.NoFileExists(t, s.AddressFile)
+	require.NoDirExists(t, s.TimeoutDir)
+	require.Nil(t, s.processLine("failed from 192.0.2.1"))
+	action, err := s.removeAddress("192.0.2.1", "")
+	require.Nil(t, err)
+	require.Contains(t, action, "dry-run")
+	require.NoFileExists(t, countFile)
+	require.NoFileExists(t, s.AddressFile)
+	require.NoDirExists(t, s.TimeoutDir)
+	require.Nil(t, s.expire())
+
+	// an existing watchlist is read but never written
+	require.Nil(t, os.WriteFile(s.AddressFile, []byte("192.0.2.9\n"), 0600))
+	s = newTestScanner(t)
+	require.Nil(t, s.processLine("failed from 192.0.2.2"))
+	data, err := os.ReadFile(s.AddressFile)
+	require.Nil(t, err)
+	require.Equal(t, "192.0.2.9\n", string(data))
+	require.NoFileExists(t, countFile)
+}
+
+func TestCommandRetry(t *testing.T) {
+	dir := initTestConfig(t)
+	ViperSet("command_retries", 2)
+	ViperSet("command_retry_delay", "10ms")
+	s := newTestScanner(t)
+	// fails on the first run, succeeds once the marker exists
+	marker := filepath.Join(dir, "marker")
+	flaky := []string{"-c", "test -f " + marker + " || { touch " + marker + "; exit 1; }"}
+	require.Nil(t, s.exec("sh", flaky, nil))
+	require.FileExists(t, marker)
+	require.Equal(t, int64(0), s.metrics.commandErrors.Load())
+
+	require.NotNil(t, s.exec("false", []string{}, nil))
+	require.Equal(t, int64(1), s.metrics.commandErrors.Load())
+
+	initTestConfig(t)
+	ViperSet("command_retries", 1)
+	ViperSet("command_retry_delay", "soon")
+	_, err := NewScanner(ViperGetString("monitored_file"), ViperGetString("address_file"), ViperGetString("timeout_dir"), []string{})
+	require.ErrorContains(t, err, "command_retry_delay")
+}
+
+func TestCommandFailureNotFatal(t *testing.T) {
+	dir := initTestConfig(t)
+	logFile := filepath.Join(dir, "logfile")
+	appendLine(t, logFile, "startup")
+	ViperSet("add_command", "false")
+	s := newTestScanner(t, `from ((?:\d{1,3}\.){3}\d{1,3})`)
+	result := startTestScanner(t, s)
+	appendLine(t, logFile, "failed from 192.0.2.1")
+	appendLine(t, logFile, "failed from 192.0.2.2")
+	requireAddresses(t, s, "192.0.2.1", "192.0.2.2")
+	require.Equal(t, int64(2), s.metrics.commandErrors.Load())
+	select {
+	case err := <-result:
+		require.Fail(t, "scanner exited", "%v", err)
+	default:
+	}
+	s.shutdown("test")
+	require.Nil(t, <-result)
+}
+
+func TestStdin(t *testing.T) {
+	initTestConfig(t)
+	ViperSet("monitored_file", "-")
+	s := newTestScanner(t, `from ((?:\d{1,3}\.){3}\d{1,3})`)
+	reader, writer := io.Pipe()
+	s.stdin = reader
+	result := startTestScanner(t, s)
+	_, err := io.WriteString(writer, "failed from 192.0.2.1\nnoise\nfailed from 192.0.2.2\n")
+	require.Nil(t, err)
+	requireAddresses(t, s, "192.0.2.1", "192.0.2.2")
+	// the scanner exits at end of input
+	require.Nil(t, writer.Close())
+	require.Nil(t, <-result)
+}
+
+// synthetic line source fed directly by a test
+type testReader struct {
+	lines  chan string
+	errors chan string
+}
+
+func (r *testReader) Lines() <-chan string  { return r.lines }
+func (r *testReader) Errors() <-chan string { return r.errors }
+func (r *testReader) Stop()                 {}
+
+func TestLineReader(t *testing.T) {
+	initTestConfig(t)
+	reader := &testReader{lines: make(chan string), errors: make(chan string)}
+	s, err := NewScanner(
+		ViperGetString("monitored_file"),
+		ViperGetString("address_file"),
+		ViperGetString("timeout_dir"),
+		[]string{`from ((?:\d{1,3}\.){3}\d{1,3})`},
+		reader,
+	)
+	require.Nil(t, err)
+	started := make(chan struct{}, 1)
+	result := make(chan error, 1)
+	go func() {
+		result <- s.scanner(s.ctx, started)
+	}()
+	<-started
+	reader.lines <- "failed from 192.0.2.1"
+	reader.errors <- "a reader error is only logged"
+	reader.lines <- "failed from 192.0.2.2"
+	close(reader.lines)
+	close(reader.errors)
+	require.Nil(t, <-result)
+	addrs, err := s.readAddressFile()
+	require.Nil(t, err)
+	require.Equal(t, []string{"192.0.2.1", "192.0.2.2"}, addrs)
+}
+
+func TestJSONLog(t *testing.T) {
+	initTestConfig(t)
+	var output bytes.Buffer
+	flags := log.Flags()
+	writer := log.Writer()
+	defer func() {
+		log.SetFlags(flags)
+		log.SetOutput(writer)
+	}()
+	log.SetOutput(&output)
+	ViperSet("log_format", "json")
+	ViperSet("verbose", true)
+	s := newTestScanner(t, `from ((?:\d{1,3}\.){3}\d{1,3})`)
+	require.Nil(t, s.processLine("failed from 192.0.2.1"))
+	require.Nil(t, s.processLine("failed from 192.0.2.1"))
+
+	events := []map[string]any{}
+	for _, line := range strings.Split(strings.TrimSpace(output.String()), "\n") {
+		record := map[string]any{}
+		require.Nil(t, json.Unmarshal([]byte(line), &record), line)
+		require.Contains(t, record, "timestamp")
+		require.Contains(t, record, "message")
+		if record["address"] != nil {
+			events = append(events, record)
+		}
+	}
+	require.Len(t, events, 2)
+	require.Equal(t, "add", events[0]["event"])
+	require.Equal(t, "192.0.2.1", events[0]["address"])
+	require.Equal(t, s.Patterns[0].String(), events[0]["pattern"])
+	require.Equal(t, "added to", events[0]["action"])
+	require.Equal(t, "match", events[1]["event"])
+	require.Equal(t, "refreshed in", events[1]["action"])
+}
+
+func TestNotify(t *testing.T) {
+	initTestConfig(t)
+	received := make(chan Notification, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var notification Notification
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		require.Nil(t, json.NewDecoder(r.Body).Decode(&notification))
+		received <- notification
+	}))
+	defer server.Close()
+	ViperSet("notify_url", server.URL)
+	ViperSet("notify_timeout_seconds", "5")
+	s := newTestScanner(t, `from ((?:\d{1,3}\.){3}\d{1,3})`)
+	require.Nil(t, s.processLine("failed from 192.0.2.1"))
+	select {
+	case notification := <-received:
+		require.Equal(t, "add", notification.Event)
+		require.Equal(t, "192.0.2.1", notification.Address)
+		require.Equal(t, s.Patterns[0].String(), notification.Pattern)
+		require.Equal(t, int64(s.AddressTimeout/time.Second), notification.Timeout)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "notification not received")
+	}
+}
+
+func TestMaxWatchlistSize(t *testing.T) {
+	initTestConfig(t)
+	ViperSet("max_watchlist_size", 3)
+	s := newTestScanner(t, `from ((?:\d{1,3}\.){3}\d{1,3})`)
+	for _, addr := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		require.Nil(t, s.processLine("failed from "+addr))
+	}
+	requireAddresses(t, s, "192.0.2.1", "192.0.2.2", "192.0.2.3")
+
+	// refresh the first address so the second expires first
+	time.Sleep(10 * time.Millisecond)
+	require.Nil(t, s.processLine("failed from 192.0.2.1"))
+	require.Nil(t, s.processLine("failed from 192.0.2.4"))
+	requireAddresses(t, s, "192.0.2.1", "192.0.2.3", "192.0.2.4")
+	_, err := os.Stat(filepath.Join(s.TimeoutDir, timeoutFilename("192.0.2.2")))
+	require.True(t, os.IsNotExist(err))
+	require.False(t, s.isPresent("192.0.2.2"))
+}
+
+func TestSortedWatchlist(t *testing.T) {
+	initTestConfig(t)
+	s := newTestScanner(t, `from ((?:\d{1,3}\.){3}\d{1,3})`)
+	input := "10.0.0.10\n2001:db8::1\n10.0.0.2\n192.0.2.0/24\n10.0.0.10\n9.9.9.9\n192.0.2.0\n10.0.0.2\n"
+	require.Nil(t, os.WriteFile(s.AddressFile, []byte(input), 0600))
+	expected := []string{"9.9.9.9", "10.0.0.2", "10.0.0.10", "192.0.2.0", "192.0.2.0/24", "2001:db8::1"}
+	addrs, err := s.readAddressFile()
+	require.Nil(t, err)
+	require.Equal(t, expected, addrs)
+
+	_, err = s.removeAddress("9.9.9.9", "")
+	require.Nil(t, err)
+	data, err := os.ReadFile(s.AddressFile)
+	require.Nil(t, err)
+	require.Equal(t, strings.Join(expected[1:], "\n")+"\n", string(data))
+
+	_, err = s.addAddress("10.0.0.3", "", "")
+	require.Nil(t, err)
+	requireAddresses(t, s, "10.0.0.2", "10.0.0.3", "10.0.0.10", "192.0.2.0", "192.0.2.0/24", "2001:db8::1")
+}
+
+func TestReconcile(t *testing.T) {
+	initTestConfig(t)
+	s := newTestScanner(t, `from ((?:\d{1,3}\.){3}\d{1,3})`)
+	for _, addr := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		require.Nil(t, s.processLine("failed from "+addr))
+	}
+
+	// 192.0.2.1 was removed by hand, 192.0.2.2 expired while the scanner was down,
+	// and 192.0.2.4 was added by hand without a timeout file
+	require.Nil(t, os.WriteFile(s.AddressFile, []byte("192.0.2.2\n192.0.2.3\n192.0.2.4\n"), 0600))
+	filename := filepath.Join(s.TimeoutDir, timeoutFilename("192.0.2.2"))
+	record, err := readTimeoutFile(filename)
+	require.Nil(t, err)
+	record.Expiration = time.Now().Add(-time.Minute)
+	require.Nil(t, s.writeTimeoutRecord(filename, record))
+
+	require.Nil(t, s.Close())
+	s = newTestScanner(t)
+	requireAddresses(t, s, "192.0.2.3", "192.0.2.4")
+	timeouts, err := ReadTimeouts(s.TimeoutDir)
+	require.Nil(t, err)
+	addrs := []string{}
+	for _, timeout := range timeouts {
+		addrs = append(addrs, timeout.Address)
+	}
+	require.ElementsMatch(t, []string{"192.0.2.3", "192.0.2.4"}, addrs)
+	require.False(t, s.isPresent("192.0.2.2"))
+}
+
+func TestNamedCaptureGroup(t *testing.T) {
+	initTestConfig(t)
+	s := newTestScanner(t, `user=(\w+) port=(\d+) from (?P<ip>(?:\d{1,3}\.){3}\d{1,3})`, `legacy ((?:\d{1,3}\.){3}\d{1,3}) user=(\w+)`)
+	require.Nil(t, s.processLine("user=root port=22 from 192.0.2.1"))
+	require.Nil(t, s.processLine("legacy 192.0.2.2 user=admin"))
+	requireAddresses(t, s, "192.0.2.1", "192.0.2.2")
+}
+
+func TestIPGroup(t *testing.T) {
+	initTestConfig(t)
+	ViperSet("patterns", []any{
+		map[string]any{
+			"regex":    `user=(\w+) from ((?:\d{1,3}\.){3}\d{1,3})`,
+			"ip_group": 2,
+		},
+		map[string]any{
+			"regex":    `bad (\w+) from ((?:\d{1,3}\.){3}\d{1,3})`,
+			"ip_group": 5,
+		},
+	})
+	s := newTestScanner(t, `user=(\w+) from ((?:\d{1,3}\.){3}\d{1,3})`)
+	require.Nil(t, s.processLine("user=root from 192.0.2.1"))
+	require.Nil(t, s.processLine("bad user from 192.0.2.2"))
+	requireAddresses(t, s, "192.0.2.1")
+
+	initTestConfig(t)
+	ViperSet("patterns", []any{map[string]any{"regex": "x", "ip_group": 0}})
+	_, err := NewScanner(ViperGetString("monitored_file"), ViperGetString("address_file"), ViperGetString("timeout_dir"), []string{})
+	require.ErrorContains(t, err, "ip_group must be a positive integer")
+}
+
+func TestMatchLogPattern(t *testing.T) {
+	initTestConfig(t)
+	var output bytes.Buffer
+	writer := log.Writer()
+	defer log.SetOutput(writer)
+	log.SetOutput(&output)
+	ViperSet("verbose", true)
+	s := newTestScanner(t, `sshd from ((?:\d{1,3}\.){3}\d{1,3})`, `smtp from ((?:\d{1,3}\.){3}\d{1,3})`)
+	require.Nil(t, s.processLine("smtp from 192.0.2.1"))
+	require.Contains(t, output.String(), "IP 192.0.2.1 added to "+s.AddressFile+" by pattern 1 '"+s.Patterns[1].String()+"'")
+}
+
+func TestMissingLogFile(t *testing.T) {
+	for _, mode := range []string{"name", "descriptor"} {
+		dir := initTestConfig(t)
+		logFile := filepath.Join(dir, "logfile")
+		ViperSet("follow_mode", mode)
+		s := newTestScanner(t, `from ((?:\d{1,3}\.){3}\d{1,3})`)
+		result := startTestScanner(t, s)
+		time.Sleep(time.Second)
+		select {
+		case err := <-result:
+			require.Fail(t, "scanner exited", "mode %s: %v", mode, err)
+		default:
+		}
+		appendLine(t, logFile, "failed from 192.0.2.1")
+		requireAddresses(t, s, "192.0.2.1")
+		s.shutdown("test")
+		require.Nil(t, <-result)
+	}
+}
+
+func TestConfiguredDuration(t *testing.T) {
+	initTestConfig(t)
+	ViperSet("timeout_seconds", "86400")
+	ViperSet("interval_seconds", "0.5")
+	s := newTestScanner(t)
+	require.Equal(t, 24*time.Hour, s.AddressTimeout)
+	require.Equal(t, 500*time.Millisecond, s.TickInterval)
+
+	ViperSet("timeout", "168h")
+	ViperSet("interval", "10m")
+	require.Nil(t, s.Close())
+	s = newTestScanner(t)
+	require.Equal(t, 168*time.Hour, s.AddressTimeout)
+	require.Equal(t, 10*time.Minute, s.TickInterval)
+
+	ViperSet("timeout", "1 day")
+	_, err := NewScanner(ViperGetString("monitored_file"), ViperGetString("address_file"), ViperGetString("timeout_dir"), []string{})
+	require.ErrorContains(t, err, "ParseDuration (timeout) failed")
+
+	ViperSet("timeout", "")
+	ViperSet("timeout_seconds", "0")
+	_, err = ConfiguredDuration("timeout")
+	require.ErrorContains(t, err, "timeout_seconds must be greater than zero")
+}
+
+func TestValidate(t *testing.T) {
+	dir := initTestConfig(t)
+	notDir := filepath.Join(dir, "file")
+	require.Nil(t, os.WriteFile(notDir, []byte{}, 0600))
+	ViperSet("timeout", "1 day")
+	ViperSet("match_window", "5 minutes")
+	ViperSet("add_command", "/nonexistent/add")
+	ViperSet("delete_command", "/nonexistent/delete")
+	ViperSet("timeout_dir", filepath.Join(notDir, "timeout"))
+	_, err := NewScanner(ViperGetString("monitored_file"), ViperGetString("address_file"), ViperGetString("timeout_dir"), []string{"(unclosed", "ok ((?:\\d{1,3}\\.){3}\\d{1,3})"})
+	require.NotNil(t, err)
+	for _, message := range []string{
+		"ParseDuration (timeout) failed",
+		"ParseDuration (match_window) failed",
+		"command '/nonexistent/add' not found",
+		"command '/nonexistent/delete' not found",
+		"regex '(unclosed' does not compile",
+		"cannot use directory '" + filepath.Join(notDir, "timeout") + "'",
+	} {
+		require.ErrorContains(t, err, message)
+	}
+}
+
+func TestPFTableConfig(t *testing.T) {
+	initTestConfig(t)
+	ViperSet("pf_table", strings.Repeat("t", 40))
+	_, err := NewScanner(ViperGetString("monitored_file"), ViperGetString("address_file"), ViperGetString("timeout_dir"), []string{})
+	if pfSupported {
+		require.ErrorContains(t, err, "is longer than")
+	} else {
+		require.ErrorContains(t, err, "only supported on OpenBSD")
+	}
+}
+
+func TestBatchCommands(t *testing.T) {
+	dir := initTestConfig(t)
+	output := filepath.Join(dir, "commands")
+	script := filepath.Join(dir, "command")
+	require.Nil(t, os.WriteFile(script, []byte("#!/bin/sh\necho \"$@\" >> "+output+"\n"), 0700))
+	ViperSet("add_command", script+" -T add")
+	ViperSet("delete_command", script+" -T delete")
+	ViperSet("flush_interval", "1h")
+	s := newTestScanner(t, `from ((?:\d{1,3}\.){3}\d{1,3})`)
+	for i := 1; i <= 5; i++ {
+		require.Nil(t, s.processLine(fmt.Sprintf("failed from 192.0.2.%d", i)))
+	}
+	requireAddresses(t, s, "192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4", "192.0.2.5")
+	require.NoFileExists(t, output)
+
+	// a delete of an address whose add is still queued cancels both
+	_, err := s.removeAddress("192.0.2.5", s.Patterns[0].String())
+	require.Nil(t, err)
+	require.Nil(t, s.flushBatch())
+	data, err := os.ReadFile(output)
+	require.Nil(t, err)
+	require.Equal(t, "-T add 192.0.2.1 192.0.2.2 192.0.2.3 192.0.2.4\n", string(data))
+
+	// reaching batch_size wakes the batcher before flush_interval
+	require.Nil(t, os.Remove(output))
+	ViperSet("batch_size", 2)
+	require.Nil(t, s.Close())
+	s = newTestScanner(t, `from ((?:\d{1,3}\.){3}\d{1,3})`)
+	started := make(chan struct{}, 1)
+	result := make(chan error, 1)
+	go func() {
+		result <- s.batcher(s.ctx, started)
+	}()
+	<-started
+	require.Nil(t, s.processLine("failed from 192.0.2.6"))
+	require.Nil(t, s.processLine("failed from 192.0.2.7"))
+	require.Eventually(t, func() bool {
+		data, err := os.ReadFile(output)
+		return err == nil && string(data) == "-T add 192.0.2.6 192.0.2.7\n"
+	}, 5*time.Second, 50*time.Millisecond)
+	s.shutdown("test")
+	require.Nil(t, <-result)
+}
+
+func TestMatchStats(t *testing.T) {
+	dir := initTestConfig(t)
+	ViperSet("stats_file", filepath.Join(dir, "stats.json"))
+	sshd := `sshd from ((?:\d{1,3}\.){3}\d{1,3})`
+	smtp := `smtp from ((?:\d{1,3}\.){3}\d{1,3})`
+	s := newTestScanner(t, sshd, smtp)
+	require.Nil(t, s.Start())
+	for _, line := range []string{"sshd from 192.0.2.1", "sshd from 192.0.2.1", "smtp from 192.0.2.2", "sshd from 192.0.2.2", "sshd from 192.0.2.1"} {
+		require.Nil(t, s.processLine(line))
+	}
+	require.Nil(t, s.Stop())
+	requireRunExits(t, s)
+
+	s = newTestScanner(t, sshd, smtp)
+	stats := s.Stats()
+	require.Equal(t, map[string]int64{sshd: 4, smtp: 1}, stats.Patterns)
+	require.Equal(t, map[string]int64{"192.0.2.1": 3, "192.0.2.2": 2}, stats.Addresses)
+
+	lines, err := s.controlCommand("STATUS", nil)
+	require.Nil(t, err)
+	require.Contains(t, lines, "pattern_matches 4 "+sshd)
+	require.Contains(t, lines, "address_hits 3 192.0.2.1")
+}
+
+// PTR resolver answering from a fixed map and counting lookups
+type stubResolver struct {
+	lock    sync.Mutex
+	names   map[string]string
+	lookups int
+}
+
+func (r *stubResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.lookups++
+	name, ok := r.names[addr]
+	if !ok {
+		return nil, fmt.Errorf("lookup %s: no such host", addr)
+	}
+	return []string{name + "."}, nil
+}
+
+// log output written by background goroutines and read by the test
+type syncBuffer struct {
+	lock   sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(data []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buffer.Write(data)
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buffer.String()
+}
+
+func TestResolvePTR(t *testing.T) {
+	initTestConfig(t)
+	var output syncBuffer
+	writer := log.Writer()
+	defer log.SetOutput(writer)
+	log.SetOutput(&output)
+	ViperSet("resolve_ptr", true)
+	s := newTestScanner(t)
+	resolver := &stubResolver{names: map[string]string{"192.0.2.1": "scanner.example.net"}}
+	s.resolver = resolver
+	require.Nil(t, s.processLine("failed from 192.0.2.1"))
+	require.Nil(t, s.processLine("failed from 192.0.2.2"))
+	require.Eventually(t, func() bool {
+		return strings.Contains(output.String(), "IP 192.0.2.1 added to "+s.AddressFile+" (scanner.example.net)") &&
+			strings.Contains(output.String(), "IP 192.0.2.2 added to "+s.AddressFile+"\n")
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, "scanner.example.net", s.hostname("192.0.2.1"))
+	require.Equal(t, "", s.hostname("192.0.2.2"))
+	resolver.lock.Lock()
+	defer resolver.lock.Unlock()
+	require.Equal(t, 2, resolver.lookups)
+}
+
+func TestOverlappingPatterns(t *testing.T) {
+	dir := initTestConfig(t)
+	output := filepath.Join(dir, "args")
+	script := filepath.Join(dir, "add")
+	require.Nil(t, os.WriteFile(script, []byte("#!/bin/sh\necho \"$@\" >> "+output+"\n"), 0700))
+	ViperSet("add_command", script)
+	ViperSet("match_threshold", 2)
+	ViperSet("match_window", "1m")
+	s := newTestScanner(t, `failed from ((?:\d{1,3}\.){3}\d{1,3})`, `from ((?:\d{1,3}\.){3}\d{1,3})`)
+	// one line counts as one match even when both patterns extract the address
+	require.Nil(t, s.processLine("failed from 192.0.2.1"))
+	require.NoFileExists(t, output)
+	require.Nil(t, s.processLine("failed from 192.0.2.1"))
+	data, err := os.ReadFile(output)
+	require.Nil(t, err)
+	require.Equal(t, "192.0.2.1\n", string(data))
+	require.Equal(t, int64(4), s.metrics.matches.Load())
+}
+
+func TestMatchAll(t *testing.T) {
+	line := "proxy 192.0.2.1 client 198.51.100.2 upstream 203.0.113.3"
+	initTestConfig(t)
+	s := newTestScanner(t)
+	require.Nil(t, s.processLine(line))
+	addrs, err := s.readAddressFile()
+	require.Nil(t, err)
+	require.Equal(t, []string{"192.0.2.1"}, addrs)
+
+	initTestConfig(t)
+	ViperSet("match_all", true)
+	s = newTestScanner(t, IP_PATTERN.String(), `client ((?:\d{1,3}\.){3}\d{1,3})`)
+	require.Nil(t, s.processLine(line))
+	addrs, err = s.readAddressFile()
+	require.Nil(t, err)
+	require.Equal(t, []string{"192.0.2.1", "198.51.100.2", "203.0.113.3"}, addrs)
+	timeouts, err := ReadTimeouts(s.TimeoutDir)
+	require.Nil(t, err)
+	require.Len(t, timeouts, 3)
+}
+
+func TestXFFMode(t *testing.T) {
+	dir := initTestConfig(t)
+	allowlist := filepath.Join(dir, "allowlist")
+	require.Nil(t, os.WriteFile(allowlist, []byte("198.51.100.0/24 # cdn\n"), 0600))
+	ViperSet("allowlist_file", allowlist)
+	ViperSet("xff_mode", true)
+	s := newTestScanner(t, `X-Forwarded-For: ([^"]+)"`)
+	for _, line := range []string{
+		`GET / "X-Forwarded-For: 10.0.0.5, 192.168.1.1, 192.0.2.7"`,
+		`GET / "X-Forwarded-For: 198.51.100.9, [2001:db8::5]:443, 203.0.113.1"`,
+		`GET / "X-Forwarded-For: unknown, 172.16.0.1"`,
+	} {
+		require.Nil(t, s.processLine(line))
+	}
+	addrs, err := s.readAddressFile()
+	require.Nil(t, err)
+	require.Equal(t, []string{"192.0.2.7", "2001:db8::5"}, addrs)
+
+	client, ok := s.forwardedClient("127.0.0.1,fe80::1")
+	require.False(t, ok)
+	require.Equal(t, "", client)
+}
+
+func TestListMode(t *testing.T) {
+	for _, mode := range []string{"block", "allow"} {
+		dir := initTestConfig(t)
+		output := filepath.Join(dir, "commands")
+		script := filepath.Join(dir, "command")
+		require.Nil(t, os.WriteFile(script, []byte("#!/bin/sh\necho \"$@\" >> "+output+"\n"), 0700))
+		ViperSet("add_command", script+" add")
+		ViperSet("delete_command", script+" delete")
+		ViperSet("list_mode", mode)
+		s := newTestScanner(t)
+		require.Equal(t, mode, s.ListMode)
+		require.Nil(t, s.processLine("client 192.0.2.1"))
+		requireAddresses(t, s, "192.0.2.1")
+		filename := filepath.Join(s.TimeoutDir, timeoutFilename("192.0.2.1"))
+		record, err := readTimeoutFile(filename)
+		require.Nil(t, err)
+		record.Expiration = time.Now().Add(-time.Second)
+		require.Nil(t, s.writeTimeoutRecord(filename, record))
+		require.Nil(t, s.expire())
+		requireAddresses(t, s)
+		data, err := os.ReadFile(output)
+		require.Nil(t, err)
+		require.Equal(t, "add 192.0.2.1\ndelete 192.0.2.1\n", string(data))
+	}
+
+	newScanner := func() error {
+		_, err := NewScanner(ViperGetString("monitored_file"), ViperGetString("address_file"), ViperGetString("timeout_dir"), []string{IP_PATTERN.String()})
+		return err
+	}
+	initTestConfig(t)
+	ViperSet("list_mode", "allow")
+	ViperSet("timeout_backoff_factor", "2")
+	ViperSet("timeout_max_seconds", "300")
+	require.ErrorContains(t, newScanner(), "timeout_backoff_factor is not supported with list_mode allow")
+	initTestConfig(t)
+	ViperSet("list_mode", "allow")
+	ViperSet("block_prefix_v4", 24)
+	require.ErrorContains(t, newScanner(), "block_prefix_v4 is not supported with list_mode allow")
+	initTestConfig(t)
+	ViperSet("list_mode", "deny")
+	require.ErrorContains(t, newScanner(), "list_mode must be 'block' or 'allow'")
+}
+
+func TestSlidingWindow(t *testing.T) {
+	for _, sliding := range []bool{true, false} {
+		initTestConfig(t)
+		ViperSet("timeout_seconds", "100")
+		ViperSet("sliding_window", sliding)
+		s := newTestScanner(t)
+		require.Nil(t, s.processLine("failed from 192.0.2.1"))
+		filename := filepath.Join(s.TimeoutDir, timeoutFilename("192.0.2.1"))
+		record, err := readTimeoutFile(filename)
+		require.Nil(t, err)
+		added := time.Now().Add(-50 * time.Second)
+		record.Expiration = added.Add(100 * time.Second)
+		require.Nil(t, s.writeTimeoutRecord(filename, record))
+		require.Nil(t, s.processLine("failed from 192.0.2.1"))
+		record, err = readTimeoutFile(filename)
+		require.Nil(t, err)
+		require.Equal(t, 2, record.MatchCount)
+		if sliding {
+			require.WithinDuration(t, time.Now().Add(100*time.Second), record.Expiration, 5*time.Second)
+		} else {
+			require.WithinDuration(t, added.Add(100*time.Second), record.Expiration, time.Second)
+		}
+	}
+}
+
+func TestFollowBackend(t *testing.T) {
+	initTestConfig(t)
+	ViperSet("follow_backend", "tail")
+	_, err := NewScanner(ViperGetString("monitored_file"), ViperGetString("address_file"), ViperGetString("timeout_dir"), []string{})
+	require.ErrorContains(t, err, "no longer supported")
+	if !inotifySupported {
+		return
+	}
+
+	dir := initTestConfig(t)
+	logFile := filepath.Join(dir, "logfile")
+	appendLine(t, logFile, "startup")
+	ViperSet("follow_backend", "inotify")
+	ViperSet("poll_interval_seconds", "60")
+	s := newTestScanner(t, `from ((?:\d{1,3}\.){3}\d{1,3})`)
+	result := startTestScanner(t, s)
+	appendLine(t, logFile, "failed from 192.0.2.1")
+	require.Eventually(t, func() bool {
+		addrs, err := s.readAddressFile()
+		return err == nil && slices.Equal(addrs, []string{"192.0.2.1"})
+	}, time.Second, 10*time.Millisecond)
+	s.shutdown("test")
+	require.Nil(t, <-result)
+}
+
+func TestShutdownWaitsForCommands(t *testing.T) {
+	for _, timeout := range []time.Duration{5 * time.Second, 200 * time.Millisecond} {
+		dir := initTestConfig(t)
+		started := filepath.Join(dir, "started")
+		finished := filepath.Join(dir, "finished")
+		script := filepath.Join(dir, "add")
+		require.Nil(t, os.WriteFile(script, []byte("#!/bin/sh\ntouch "+started+"\nsleep 1\ntouch "+finished+"\n"), 0700))
+		ViperSet("add_command", script)
+		ViperSet("shutdown_timeout", timeout.String())
+		s := newTestScanner(t)
+		require.Nil(t, s.Start())
+		go s.processLine("failed from 192.0.2.1")
+		require.Eventually(t, func() bool {
+			_, err := os.Stat(started)
+			return err == nil
+		}, 5*time.Second, 10*time.Millisecond)
+		begin := time.Now()
+		require.Nil(t, s.Stop())
+		if timeout > time.Second {
+			require.FileExists(t, finished)
+		} else {
+			require.NoFileExists(t, finished)
+			require.Less(t, time.Since(begin), time.Second)
+		}
+		requireRunExits(t, s)
+		require.Eventually(t, func() bool {
+			_, err := os.Stat(finished)
+			return err == nil
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+}
+
+func TestStartupSkip(t *testing.T) {
+	initTestConfig(t)
+	ViperSet("skip_before_start", true)
+	_, err := NewScanner(ViperGetString("monitored_file"), ViperGetString("address_file"), ViperGetString("timeout_dir"), []string{IP_PATTERN.String()})
+	require.ErrorContains(t, err, "skip_before_start requires timestamp_layout")
+	ViperSet("timestamp_layout", time.RFC3339)
+	s := newTestScanner(t)
+	old := time.Now().Add(-time.Minute).Format(time.RFC3339)
+	current := time.Now().Format(time.RFC3339)
+	require.Nil(t, s.processLine(old+" sshd: failed from 192.0.2.1"))
+	require.Nil(t, s.processLine(current+" sshd: failed from 192.0.2.2"))
+	require.Nil(t, s.processLine("sshd: failed from 192.0.2.3"))
+	requireAddresses(t, s, "192.0.2.2", "192.0.2.3")
+
+	// matches are counted but not acted on until startup_grace has passed
+	initTestConfig(t)
+	ViperSet("startup_grace", "1h")
+	s = newTestScanner(t)
+	require.Nil(t, s.processLine("sshd: failed from 192.0.2.1"))
+	requireAddresses(t, s)
+	require.Equal(t, int64(1), s.Stats().Addresses["192.0.2.1"])
+	s.startTime = s.startTime.Add(-2 * time.Hour)
+	require.Nil(t, s.processLine("sshd: failed from 192.0.2.1"))
+	requireAddresses(t, s, "192.0.2.1")
+}
+
+func TestExportedAddressHelpers(t *testing.T) {
+	require.True(t, ValidAddress("192.0.2.1"))
+	require.True(t, ValidAddress("2001:db8::1"))
+	require.False(t, ValidAddress("0.0.0.0"))
+	require.False(t, ValidAddress("192.0.2.0/24"))
+	require.False(t, ValidAddress("192.0.2.256"))
+
+	addr, ok := ExtractAddress(IP_PATTERN, "sshd: failed from 192.0.2.7 port 22")
+	require.True(t, ok)
+	require.Equal(t, "192.0.2.7", addr)
+	_, ok = ExtractAddress(IP_PATTERN, "OpenSSH_1.2.3.4 banner")
+	require.False(t, ok)
+	addr, ok = ExtractAddress(regexp.MustCompile(`client=(?P<ip>\S+) proxy=\S+`), "client=2001:0db8:0:0::1 proxy=192.0.2.1")
+	require.True(t, ok)
+	require.Equal(t, "2001:db8::1", addr)
+
+	addr, ok = ExtractAnyAddress("failed from 2001:db8::5 via 192.0.2.8")
+	require.True(t, ok)
+	require.Equal(t, "192.0.2.8", addr)
+	addr, ok = ExtractAnyAddress("failed from 2001:db8::5")
+	require.True(t, ok)
+	require.Equal(t, "2001:db8::5", addr)
+	_, ok = ExtractAnyAddress("std::string")
+	require.False(t, ok)
+}
+
+func TestCorruptTimeoutFile(t *testing.T) {
+	initTestConfig(t)
+	s := newTestScanner(t)
+	require.Nil(t, s.Start())
+	require.Nil(t, s.processLine("failed from 192.0.2.1"))
+	require.Nil(t, s.processLine("failed from 192.0.2.2"))
+	filename := filepath.Join(s.TimeoutDir, timeoutFilename("192.0.2.1"))
+	record, err := readTimeoutFile(filename)
+	require.Nil(t, err)
+	record.Expiration = time.Now().Add(-time.Second)
+	require.Nil(t, s.writeTimeoutRecord(filename, record))
+	corrupt := filepath.Join(s.TimeoutDir, timeoutFilename("192.0.2.2"))
+	require.Nil(t, os.WriteFile(corrupt, []byte("{\"expiration\": "), 0600))
+
+	// the reaper expires the valid entry, moves the garbage aside, and keeps running
+	requireAddresses(t, s, "192.0.2.2")
+	// the timeout file is deleted after the address file is written
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(filename)
+		return os.IsNotExist(err)
+	}, 5*time.Second, 50*time.Millisecond)
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(s.TimeoutDir, "corrupt", timeoutFilename("192.0.2.2")))
+		return err == nil
+	}, 5*time.Second, 50*time.Millisecond)
+	require.NoFileExists(t, corrupt)
+	_, ok := s.active.Load("reaper")
+	require.True(t, ok)
+	require.Nil(t, s.Stop())
+	requireRunExits(t, s)
+}
+
+func TestTimeoutFileWriteRace(t *testing.T) {
+	initTestConfig(t)
+	ViperSet("timeout", "1h")
+	s := newTestScanner(t)
+	addrs := []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}
+	for _, addr := range addrs {
+		require.Nil(t, s.processLine("failed from "+addr))
+	}
+	done := make(chan struct{})
+	writes := make(chan int, 1)
+	writeErr := make(chan error, 1)
+	go func() {
+		count := 0
+		for {
+			select {
+			case <-done:
+				writes <- count
+				writeErr <- nil
+				return
+			default:
+			}
+			for _, addr := range addrs {
+				err := s.writeTimeoutFile(addr, IP_PATTERN.String())
+				if err != nil {
+					writes <- count
+					writeErr <- err
+					return
+				}
+				count++
+			}
+		}
+	}()
+	// the reaper never sees a partly written file, so nothing is quarantined or expired
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		require.Nil(t, s.expire())
+	}
+	close(done)
+	require.Greater(t, <-writes, 100)
+	require.Nil(t, <-writeErr)
+	require.NoDirExists(t, filepath.Join(s.TimeoutDir, "corrupt"))
+	requireAddresses(t, s, addrs...)
+}
+
+func TestIntervalJitter(t *testing.T) {
+	initTestConfig(t)
+	ViperSet("interval_seconds", "600")
+	s := newTestScanner(t)
+	require.Equal(t, 600*time.Second, s.nextTick())
+
+	ViperSet("interval_jitter", "0.1")
+	require.Nil(t, s.Close())
+	s = newTestScanner(t)
+	intervals := map[time.Duration]bool{}
+	for range 1000 {
+		interval := s.nextTick()
+		require.GreaterOrEqual(t, interval, 540*time.Second)
+		require.LessOrEqual(t, interval, 660*time.Second)
+		intervals[interval] = true
+	}
+	require.Greater(t, len(intervals), 1)
+
+	ViperSet("interval_jitter", "1.5")
+	_, err := NewScanner(ViperGetString("monitored_file"), ViperGetString("address_file"), ViperGetString("timeout_dir"), []string{})
+	require.ErrorContains(t, err, "interval_jitter")
+}
+
+func TestSweep(t *testing.T) {
+	initTestConfig(t)
+	ViperSet("interval_seconds", "3600")
+	s := newTestScanner(t)
+	require.Nil(t, s.Start())
+	expireNow := func(addr string) {
+		require.Nil(t, s.processLine("failed from "+addr))
+		filename := filepath.Join(s.TimeoutDir, timeoutFilename(addr))
+		record, err := readTimeoutFile(filename)
+		require.Nil(t, err)
+		record.Expiration = time.Now().Add(-time.Second)
+		require.Nil(t, s.writeTimeoutRecord(filename, record))
+	}
+
+	expireNow("192.0.2.1")
+	lines, err := s.controlCommand("SWEEP", nil)
+	require.Nil(t, err)
+	require.Equal(t, []string{"sweep requested"}, lines)
+	requireAddresses(t, s)
+
+	expireNow("192.0.2.2")
+	require.Nil(t, syscall.Kill(os.Getpid(), syscall.SIGUSR1))
+	requireAddresses(t, s)
+
+	require.Nil(t, s.Stop())
+	requireRunExits(t, s)
+}
+
+func TestFileModes(t *testing.T) {
+	dir := initTestConfig(t)
+	ViperSet("watchlist_mode", "0640")
+	ViperSet("timeout_dir_mode", "0750")
+	s := newTestScanner(t)
+	requireMode := func(path string, mode os.FileMode) {
+		info, err := os.Stat(path)
+		require.Nil(t, err)
+		require.Equal(t, mode, info.Mode().Perm(), path)
+	}
+	requireMode(s.AddressFile, 0640)
+	requireMode(s.TimeoutDir, 0750)
+	require.Nil(t, s.processLine("failed from 192.0.2.1"))
+	requireMode(s.AddressFile, 0640)
+	requireMode(filepath.Join(s.TimeoutDir, timeoutFilename("192.0.2.1")), 0640)
+	require.Nil(t, s.Close())
+
+	initTestConfig(t)
+	ViperSet("address_file", filepath.Join(dir, "watchlist"))
+	s = newTestScanner(t)
+	require.Nil(t, s.processLine("failed from 192.0.2.2"))
+	requireMode(s.AddressFile, 0600)
+
+	initTestConfig(t)
+	ViperSet("watchlist_mode", "rw-r-----")
+	ViperSet("timeout_dir_mode", "01777")
+	ViperSet("file_owner", "iplsd-no-such-user")
+	err := Validate(ViperGetString("address_file"), ViperGetString("timeout_dir"), nil)
+	require.ErrorContains(t, err, "watchlist_mode 'rw-r-----' is not an octal permission mode")
+	require.ErrorContains(t, err, "timeout_dir_mode '01777' is not an octal permission mode")
+	require.ErrorContains(t, err, "file_owner")
+}
+
+func TestTimeoutDirLock(t *testing.T) {
+	initTestConfig(t)
+	s := newTestScanner(t)
+	data, err := os.ReadFile(filepath.Join(s.TimeoutDir, lockFilename))
+	require.Nil(t, err)
+	require.Equal(t, fmt.Sprintf("%d\n", os.Getpid()), string(data))
+
+	// a second instance against the same directory is refused while the first holds it
+	_, err = NewScanner(ViperGetString("monitored_file"), ViperGetString("address_file"), ViperGetString("timeout_dir"), []string{IP_PATTERN.String()})
+	require.ErrorContains(t, err, "is in use by another iplsd instance")
+
+	// the lock file is not read as a timeout file
+	timeouts, err := ReadTimeouts(s.TimeoutDir)
+	require.Nil(t, err)
+	require.Empty(t, timeouts)
+
+	require.Nil(t, s.Close())
+	s = newTestScanner(t)
+	require.Nil(t, s.Start())
+	require.Nil(t, s.Stop())
+	requireRunExits(t, s)
+	s, err = NewScanner(ViperGetString("monitored_file"), ViperGetString("address_file"), ViperGetString("timeout_dir"), []string{IP_PATTERN.String()})
+	require.Nil(t, err)
+
+	// a second instance sharing only the watchlist is refused too
+	_, err = NewScanner(ViperGetString("monitored_file"), ViperGetString("address_file"), filepath.Join(t.TempDir(), "timeout"), []string{IP_PATTERN.String()})
+	require.ErrorContains(t, err, "address_file '"+s.AddressFile+"' is in use by another iplsd instance")
+	// and one sharing only the timeout directory
+	_, err = NewScanner(ViperGetString("monitored_file"), filepath.Join(t.TempDir(), "watchlist"), ViperGetString("timeout_dir"), []string{IP_PATTERN.String()})
+	require.ErrorContains(t, err, "timeout_dir '"+s.TimeoutDir+"' is in use by another iplsd instance")
+	require.Nil(t, s.Close())
+	// a refused instance releases the watchlist lock it took
+	other := filepath.Join(t.TempDir(), "watchlist")
+	s = newTestScanner(t)
+	_, err = NewScanner(ViperGetString("monitored_file"), other, ViperGetString("timeout_dir"), []string{IP_PATTERN.String()})
+	require.NotNil(t, err)
+	require.Nil(t, s.Close())
+	s, err = NewScanner(ViperGetString("monitored_file"), other, ViperGetString("timeout_dir"), []string{IP_PATTERN.String()})
+	require.Nil(t, err)
+	require.Nil(t, s.Close())
+}
+
+func TestCheckConfig(t *testing.T) {
+	initTestConfig(t)
+	args := []string{ViperGetString("monitored_file"), ViperGetString("address_file"), ViperGetString("timeout_dir")}
+	require.Nil(t, CheckConfig(args[0], args[1], args[2], []string{IP_PATTERN.String()}))
+	// nothing is created
+	require.NoFileExists(t, args[1])
+	require.NoDirExists(t, args[2])
+
+	// settings checked by NewScanner rather than Validate are reported too
+	ViperSet("list_mode", "deny")
+	require.ErrorContains(t, CheckConfig(args[0], args[1], args[2], []string{IP_PATTERN.String()}), "list_mode must be 'block' or 'allow'")
+}
+
+func TestRunCollectsErrors(t *testing.T) {
+	initTestConfig(t)
+	s := newTestScanner(t)
+	failing := func(message string) func(context.Context, chan struct{}) error {
+		return func(ctx context.Context, started chan struct{}) error {
+			close(started)
+			<-ctx.Done()
+			return errors.New(message)
+		}
+	}
+	s.startGoproc("first", failing("first failed"))
+	s.startGoproc("second", failing("second failed"))
+	s.startGoproc("third", func(ctx context.Context, started chan struct{}) error {
+		close(started)
+		<-ctx.Done()
+		return nil
+	})
+	s.started = true
+	s.cancel()
+	err := s.Run()
+	require.ErrorContains(t, err, "first failed")
+	require.ErrorContains(t, err, "second failed")
+}
+
+func TestStartStopGoroutines(t *testing.T) {
+	dir := initTestConfig(t)
+	ViperSet("control_socket", filepath.Join(dir, "control.sock"))
+	ViperSet("listen_address", "127.0.0.1:0")
+	ViperSet("flush_interval", "1s")
+	cycle := func() {
+		s := newTestScanner(t)
+		require.Nil(t, s.Start())
+		require.Nil(t, s.Stop())
+		requireRunExits(t, s)
+		require.Nil(t, s.Close())
+	}
+	// the first cycle starts the os/signal goroutine, which runs for the life of the process
+	cycle()
+	before := runtime.NumGoroutine()
+	for range 25 {
+		cycle()
+	}
+	// goroutines outside the WaitGroup, such as listener closers, may take a moment to exit;
+	// polled here rather than with Eventually, whose own goroutines would be counted
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.LessOrEqual(t, runtime.NumGoroutine(), before, "goroutines leaked")
+}
+
+func TestLineBuffer(t *testing.T) {
+	dir := initTestConfig(t)
+	script := filepath.Join(dir, "add")
+	require.Nil(t, os.WriteFile(script, []byte("#!/bin/sh\nsleep 1\n"), 0700))
+	ViperSet("add_command", script)
+	ViperSet("monitored_file", "-")
+	ViperSet("line_buffer", 1000)
+	s := newTestScanner(t, `from ((?:\d{1,3}\.){3}\d{1,3})`)
+	require.Equal(t, 1000, s.LineBuffer)
+	reader, writer := io.Pipe()
+	s.stdin = reader
+	result := startTestScanner(t, s)
+
+	// a flood larger than the reader's own read buffer is taken off the pipe while the slow add command runs
+	written := make(chan error, 1)
+	go func() {
+		var flood strings.Builder
+		flood.WriteString("failed from 198.51.100.1\n")
+		for i := range 500 {
+			fmt.Fprintf(&flood, "sshd: connection closed by peer %d\n", i)
+		}
+		flood.WriteString("failed from 198.51.100.2\n")
+		_, err := io.WriteString(writer, flood.String())
+		written <- err
+	}()
+	select {
+	case err := <-written:
+		require.Nil(t, err)
+	case <-time.After(500 * time.Millisecond):
+		require.Fail(t, "reader blocked behind the add command")
+	}
+
+	// and no line is lost
+	requireAddresses(t, s, "198.51.100.1", "198.51.100.2")
+	require.Nil(t, writer.Close())
+	require.Nil(t, <-result)
+
+	ViperSet("line_buffer", -1)
+	_, err := NewScanner(ViperGetString("monitored_file"), ViperGetString("address_file"), ViperGetString("timeout_dir"), []string{})
+	require.ErrorContains(t, err, "line_buffer must not be negative")
+}
+
+func TestCommandWorkers(t *testing.T) {
+	dir := initTestConfig(t)
+	script := filepath.Join(dir, "add")
+	require.Nil(t, os.WriteFile(script, []byte("#!/bin/sh\ntouch "+dir+"/started-$1\nsleep 1\ntouch "+dir+"/finished-$1\n"), 0700))
+	ViperSet("add_command", script)
+	ViperSet("command_workers", 3)
+	s := newTestScanner(t)
+	require.Nil(t, s.Start())
+	go func() {
+		for i := 1; i <= 5; i++ {
+			s.processLine(fmt.Sprintf("failed from 192.0.2.%d", i))
+		}
+	}()
+	count := func(prefix string) int {
+		matches, err := filepath.Glob(filepath.Join(dir, prefix+"-*"))
+		require.Nil(t, err)
+		return len(matches)
+	}
+	// three commands run at once, and the fourth waits for a free worker
+	require.Eventually(t, func() bool { return count("started") == 3 }, 900*time.Millisecond, 10*time.Millisecond)
+	time.Sleep(200 * time.Millisecond)
+	require.Equal(t, 3, count("started"))
+	require.Equal(t, 0, count("finished"))
+	// the watchlist is not held up by the running commands
+	addrs, err := s.readAddressFile()
+	require.Nil(t, err)
+	require.Len(t, addrs, 3)
+
+	require.Eventually(t, func() bool { return count("finished") == 5 }, 5*time.Second, 10*time.Millisecond)
+	requireAddresses(t, s, "192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4", "192.0.2.5")
+	require.Nil(t, s.Stop())
+	requireRunExits(t, s)
+}
+
+func TestOnMatchCommand(t *testing.T) {
+	dir := initTestConfig(t)
+	output := filepath.Join(dir, "output")
+	script := filepath.Join(dir, "onmatch")
+	require.Nil(t, os.WriteFile(script, []byte("#!/bin/sh\necho \"$IPLSD_EVENT|$IPLSD_ADDRESS|$IPLSD_PATTERN|$IPLSD_LINE|$*\" >> "+output+"\n"), 0700))
+	ViperSet("on_match_command", script+" --source iplsd")
+	ViperSet("match_threshold", 2)
+	ViperSet("match_window", "1m")
+	pattern := `from ((?:\d{1,3}\.){3}\d{1,3})`
+	s := newTestScanner(t, pattern)
+	require.Equal(t, []string{"--source", "iplsd"}, s.OnMatchArgs)
+	for _, line := range []string{
+		"failed from 192.0.2.1 port 22",
+		"failed from 10.0.0.1 port 22",
+		"failed from 192.0.2.1 port 23",
+	} {
+		require.Nil(t, s.processLine(line))
+	}
+	data, err := os.ReadFile(output)
+	require.Nil(t, err)
+	// each match runs it, including one below match_threshold; the ignored private address does not
+	require.Equal(t, "match|192.0.2.1|"+pattern+"|failed from 192.0.2.1 port 22|--source iplsd 192.0.2.1\n"+
+		"match|192.0.2.1|"+pattern+"|failed from 192.0.2.1 port 23|--source iplsd 192.0.2.1\n", string(data))
+	requireAddresses(t, s, "192.0.2.1")
+
+	// a failure is not fatal
+	ViperSet("on_match_command", "false")
+	require.Nil(t, s.Close())
+	s = newTestScanner(t, pattern)
+	require.Nil(t, s.processLine("failed from 192.0.2.2"))
+	require.Nil(t, s.processLine("failed from 192.0.2.2"))
+	requireAddresses(t, s, "192.0.2.1", "192.0.2.2")
+
+	ViperSet("on_match_command", "/nonexistent/onmatch")
+	err = Validate(ViperGetString("address_file"), ViperGetString("timeout_dir"), nil)
+	require.ErrorContains(t, err, "command '/nonexistent/onmatch' not found")
+}
+
+func TestSoftTimeoutCommand(t *testing.T) {
+	dir := initTestConfig(t)
+	output := filepath.Join(dir, "output")
+	script := filepath.Join(dir, "soft")
+	require.Nil(t, os.WriteFile(script, []byte("#!/bin/sh\necho \"$IPLSD_EVENT|$IPLSD_TIMEOUT|$*\" >> "+output+"\n"), 0700))
+	ViperSet("soft_timeout_command", script+" --warn")
+	ViperSet("soft_timeout_fraction", "0.5")
+	ViperSet("timeout", "2s")
+	s := newTestScanner(t)
+	softRuns := func() []string {
+		data, err := os.ReadFile(output)
+		if os.IsNotExist(err) {
+			return []string{}
+		}
+		require.Nil(t, err)
+		return strings.Split(strings.TrimSpace(string(data)), "\n")
+	}
+	filename := filepath.Join(s.TimeoutDir, timeoutFilename("192.0.2.1"))
+	require.Nil(t, s.processLine("failed from 192.0.2.1"))
+	require.Nil(t, s.expire())
+	require.Empty(t, softRuns())
+
+	// past half of its timeout the command runs once, and the entry stays blocked
+	time.Sleep(1100 * time.Millisecond)
+	require.Nil(t, s.expire())
+	require.Nil(t, s.expire())
+	require.Equal(t, []string{"soft_timeout|2|--warn 192.0.2.1"}, softRuns())
+	record, err := readTimeoutFile(filename)
+	require.Nil(t, err)
+	require.True(t, record.SoftTimedOut)
+	requireAddresses(t, s, "192.0.2.1")
+
+	// a match starts a new timeout, which can run it again
+	require.Nil(t, s.processLine("failed from 192.0.2.1"))
+	record, err = readTimeoutFile(filename)
+	require.Nil(t, err)
+	require.False(t, record.SoftTimedOut)
+	require.Nil(t, s.expire())
+	require.Len(t, softRuns(), 1)
+	time.Sleep(2100 * time.Millisecond)
+	require.Nil(t, s.expire())
+	requireAddresses(t, s)
+	require.Len(t, softRuns(), 1)
+
+	ViperSet("soft_timeout_fraction", "1")
+	require.Nil(t, s.Close())
+	_, err = NewScanner(ViperGetString("monitored_file"), ViperGetString("address_file"), ViperGetString("timeout_dir"), nil)
+	require.ErrorContains(t, err, "soft_timeout_fraction must be greater than 0 and less than 1")
+}
+
+func TestCommandEnvironment(t *testing.T) {
+	dir := initTestConfig(t)
+	output := filepath.Join(dir, "output")
+	script := filepath.Join(dir, "command")
+	require.Nil(t, os.WriteFile(script, []byte("#!/bin/sh\necho \"$IPLSD_EVENT|$IPLSD_ADDRESS|$IPLSD_PATTERN|$IPLSD_LINE|$IPLSD_TIMEOUT\" >> "+output+"\n"), 0700))
+	ViperSet("add_command", script)
+	ViperSet("delete_command", script)
+	ViperSet("timeout", "1h")
+	pattern := `from ((?:\d{1,3}\.){3}\d{1,3})`
+	s := newTestScanner(t, pattern)
+	var logged syncBuffer
+	writer := log.Writer()
+	defer log.SetOutput(writer)
+	log.SetOutput(&logged)
+	require.Nil(t, s.processLine("failed password for secret-user from 192.0.2.1"))
+	_, err := s.removeAddress("192.0.2.1", pattern)
+	require.Nil(t, err)
+	data, err := os.ReadFile(output)
+	require.Nil(t, err)
+	require.Equal(t, "add|192.0.2.1|"+pattern+"|failed password for secret-user from 192.0.2.1|3600\n"+
+		"delete|192.0.2.1|"+pattern+"||3600\n", string(data))
+	// the environment, which may carry log content, is not logged with the command
+	require.Contains(t, logged.String(), script+" 192.0.2.1")
+	require.NotContains(t, logged.String(), "secret-user")
+}
+
+func TestMatchBudget(t *testing.T) {
+	initTestConfig(t)
+	ViperSet("match_budget", "10ms")
+	ViperSet("disable_slow_patterns", true)
+	fast := `failed from ((?:\d{1,3}\.){3}\d{1,3})`
+	// linear time, but slow on a long line
+	slow := `(\w*\s*){1,50}from (\S+)`
+	s := newTestScanner(t, fast, slow)
+	var logged syncBuffer
+	writer := log.Writer()
+	defer log.SetOutput(writer)
+	log.SetOutput(&logged)
+	line := strings.Repeat("word ", 2000) + "failed from 192.0.2.7"
+	require.Nil(t, s.processLine(line))
+	require.Contains(t, logged.String(), "over match_budget 10ms; slowest pattern '"+slow+"'")
+	require.Contains(t, logged.String(), "scanner: pattern '"+slow+"' disabled until reload")
+	require.True(t, s.patternDisabled(s.Patterns[1]))
+	require.False(t, s.patternDisabled(s.Patterns[0]))
+	// the remaining pattern is never disabled
+	require.Nil(t, s.processLine(line))
+	require.False(t, s.patternDisabled(s.Patterns[0]))
+	requireAddresses(t, s, "192.0.2.7")
+	disabled := s.Patterns[1]
+	require.Nil(t, s.reload())
+	require.False(t, s.patternDisabled(disabled))
+
+	initTestConfig(t)
+	ViperSet("disable_slow_patterns", true)
+	_, err := NewScanner(ViperGetString("monitored_file"), ViperGetString("address_file"), ViperGetString("timeout_dir"), []string{fast})
+	require.ErrorContains(t, err, "disable_slow_patterns requires match_budget")
+}
+
+func TestPrefilter(t *testing.T) {
+	require.True(t, prefilter(regexp.MustCompile(`failed from (\S+)`), "login failed from 192.0.2.7"))
+	require.False(t, prefilter(regexp.MustCompile(`failed from (\S+)`), "accepted from 192.0.2.7"))
+	// no literal prefix; the full regex decides
+	require.True(t, prefilter(regexp.MustCompile(`(?i)failed from (\S+)`), "accepted from 192.0.2.7"))
+	require.True(t, prefilter(regexp.MustCompile(`(failed|refused) from (\S+)`), "accepted from 192.0.2.7"))
+}
+
+func BenchmarkLineMatches(b *testing.B) {
+	initTestConfig(b)
+	patterns := []string{
+		`sshd\[\d+\]: Failed password for .* from ((?:\d{1,3}\.){3}\d{1,3})`,
+		`sshd\[\d+\]: Invalid user \S+ from ((?:\d{1,3}\.){3}\d{1,3})`,
+		`postfix/smtpd\[\d+\]: NOQUEUE: reject: RCPT from \S+\[((?:\d{1,3}\.){3}\d{1,3})\]`,
+		`dovecot: auth failed, rip=((?:\d{1,3}\.){3}\d{1,3})`,
+	}
+	s := newTestScanner(b, patterns...)
+	line := "Jan  2 15:04:05 host cron[1234]: (root) CMD (run-parts /etc/cron.hourly) from 192.0.2.7"
+	for b.Loop() {
+		_, err := s.lineMatches(line)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// count the reads of the address file until the test ends
+func countWatchlistReads(t testing.TB) *int {
+	reads := 0
+	read := readWatchlist
+	readWatchlist = func(filename string) (*watchlistFile, error) {
+		reads++
+		return read(filename)
+	}
+	t.Cleanup(func() { readWatchlist = read })
+	return &reads
+}
+
+func TestWatchlistCache(t *testing.T) {
+	initTestConfig(t)
+	s := newTestScanner(t)
+	reads := countWatchlistReads(t)
+	for _, addr := range []string{"192.0.2.3", "192.0.2.1", "192.0.2.2", "192.0.2.1"} {
+		_, err := s.addAddress(addr, "", "")
+		require.Nil(t, err)
+	}
+	_, err := s.removeAddress("192.0.2.2", "")
+	require.Nil(t, err)
+	// NewScanner read the file; the scanner's own writes do not cause it to be read again
+	require.Equal(t, 0, *reads)
+	memory, err := s.readAddressFile()
+	require.Nil(t, err)
+	disk, err := ReadAddressFile(s.AddressFile)
+	require.Nil(t, err)
+	require.Equal(t, []string{"192.0.2.1", "192.0.2.3"}, memory)
+	require.Equal(t, disk, memory)
+
+	// an external change is read before the next update
+	require.Nil(t, os.WriteFile(s.AddressFile, []byte("192.0.2.1\n192.0.2.3\n198.51.100.1\n"), 0600))
+	_, err = s.addAddress("192.0.2.4", "", "")
+	require.Nil(t, err)
+	require.Equal(t, 1, *reads)
+	memory, err = s.readAddressFile()
+	require.Nil(t, err)
+	disk, err = ReadAddressFile(s.AddressFile)
+	require.Nil(t, err)
+	require.Equal(t, []string{"192.0.2.1", "192.0.2.3", "192.0.2.4", "198.51.100.1"}, memory)
+	require.Equal(t, disk, memory)
+}
+
+// a flood of matches for an address already in the watchlist
+func BenchmarkAddPresentAddress(b *testing.B) {
+	initTestConfig(b)
+	s := newTestScanner(b)
+	_, err := s.addAddress("192.0.2.1", "", "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	reads := countWatchlistReads(b)
+	for b.Loop() {
+		_, err := s.addAddress("192.0.2.1", "", "")
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(*reads)/float64(b.N), "reads/op")
+}
+
+func TestWatchlistExternalEdit(t *testing.T) {
+	initTestConfig(t)
+	s := newTestScanner(t)
+	var logged syncBuffer
+	writer := log.Writer()
+	defer log.SetOutput(writer)
+	log.SetOutput(&logged)
+	require.Nil(t, s.processLine("failed from 192.0.2.1"))
+	require.Nil(t, s.processLine("failed from 192.0.2.2"))
+
+	// an operator adds one entry and removes one of the scanner's
+	require.Nil(t, os.WriteFile(s.AddressFile, []byte("192.0.2.1\n198.51.100.1\n"), 0600))
+	require.Nil(t, s.processLine("failed from 192.0.2.3"))
+	require.Contains(t, logged.String(), "changed externally; reloaded 2 entries, 1 added and 1 removed")
+	requireAddresses(t, s, "192.0.2.1", "192.0.2.3", "198.51.100.1")
+
+	// an address removed by the operator is added again by its next match
+	require.Nil(t, s.processLine("failed from 192.0.2.2"))
+	requireAddresses(t, s, "192.0.2.1", "192.0.2.2", "192.0.2.3", "198.51.100.1")
+}
+
+func TestShutdownSummary(t *testing.T) {
+	dir := initTestConfig(t)
+	logFile := ViperGetString("monitored_file")
+	appendLine(t, logFile, "startup")
+	script := filepath.Join(dir, "command")
+	require.Nil(t, os.WriteFile(script, []byte("#!/bin/sh\n[ \"$IPLSD_EVENT $IPLSD_ADDRESS\" != \"add 192.0.2.3\" ]\n"), 0700))
+	ViperSet("add_command", script)
+	ViperSet("delete_command", script)
+	ViperSet("timeout", "1s")
+	s := newTestScanner(t)
+	var logged syncBuffer
+	writer := log.Writer()
+	defer log.SetOutput(writer)
+	log.SetOutput(&logged)
+	require.Nil(t, s.Start())
+	// let the follower open the log file at its end
+	time.Sleep(200 * time.Millisecond)
+	for _, line := range []string{"failed from 192.0.2.1", "accepted", "failed from 192.0.2.2", "failed from 192.0.2.3"} {
+		appendLine(t, logFile, line)
+	}
+	// each address expires a second after it is added
+	require.Eventually(t, func() bool {
+		return s.metrics.expired.Load() == 3
+	}, 5*time.Second, 50*time.Millisecond)
+	requireAddresses(t, s)
+	require.Nil(t, s.Stop())
+	requireRunExits(t, s)
+	require.Contains(t, logged.String(), "run: summary: 4 lines, 3 matches, 3 added, 3 expired, 1 command errors, uptime ")
+}
+
+func TestWatchlistRecreated(t *testing.T) {
+	dir := initTestConfig(t)
+	logFile := filepath.Join(dir, "logfile")
+	appendLine(t, logFile, "startup")
+	s := newTestScanner(t)
+	result := startTestScanner(t, s)
+	appendLine(t, logFile, "failed from 192.0.2.1")
+	requireAddresses(t, s, "192.0.2.1")
+
+	require.Nil(t, os.Remove(s.AddressFile))
+	appendLine(t, logFile, "failed from 192.0.2.2")
+	requireAddresses(t, s, "192.0.2.1", "192.0.2.2")
+	info, err := os.Stat(s.AddressFile)
+	require.Nil(t, err)
+	require.Equal(t, s.WatchlistMode, info.Mode().Perm())
+
+	s.shutdown("test")
+	require.Nil(t, <-result)
+}
+
+func TestWatchlistAnnotations(t *testing.T) {
+	initTestConfig(t)
+	require.Nil(t, os.WriteFile(ViperGetString("address_file"), []byte("# blocked by hand\n\n192.0.2.9 # scanner, ticket 42\n   # indented comment\n192.0.2.1\n"), 0600))
+	addrs, err := ReadAddressFile(ViperGetString("address_file"))
+	require.Nil(t, err)
+	require.Equal(t, []string{"192.0.2.1", "192.0.2.9"}, addrs)
+
+	ViperSet("annotate_watchlist", true)
+	pattern := `failed from ((?:\d{1,3}\.){3}\d{1,3})`
+	s := newTestScanner(t, pattern)
+	require.Nil(t, s.processLine("failed from 192.0.2.5"))
+	_, err = s.removeAddress("192.0.2.1", "")
+	require.Nil(t, err)
+	data, err := os.ReadFile(s.AddressFile)
+	require.Nil(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	require.Len(t, lines, 4)
+	require.Equal(t, []string{"# blocked by hand", "# indented comment"}, lines[:2])
+	require.Regexp(t, `^192\.0\.2\.5 # added \d{4}-\d\d-\d\dT\S+ by '`+regexp.QuoteMeta(pattern)+`'$`, lines[2])
+	require.Equal(t, "192.0.2.9 # scanner, ticket 42", lines[3])
+
+	// without annotate_watchlist existing annotations are kept and new entries are plain
+	ViperSet("annotate_watchlist", false)
+	require.Nil(t, s.Close())
+	s = newTestScanner(t, pattern)
+	require.Nil(t, s.processLine("failed from 192.0.2.6"))
+	data, err = os.ReadFile(s.AddressFile)
+	require.Nil(t, err)
+	require.Contains(t, string(data), "\n192.0.2.6\n192.0.2.9 # scanner, ticket 42\n")
+	requireAddresses(t, s, "192.0.2.5", "192.0.2.6", "192.0.2.9")
+}
+
+func TestAddPresentSkipsCommand(t *testing.T) {
+	dir := initTestConfig(t)
+	output := filepath.Join(dir, "output")
+	script := filepath.Join(dir, "command")
+	require.Nil(t, os.WriteFile(script, []byte("#!/bin/sh\necho \"$1\" >> "+output+"\n"), 0700))
+	ViperSet("add_command", script)
+	s := newTestScanner(t)
+	action, err := s.addAddress("192.0.2.1", "", "")
+	require.Nil(t, err)
+	require.Equal(t, "added to", action)
+	action, err = s.addAddress("192.0.2.1", "", "")
+	require.Nil(t, err)
+	require.Equal(t, "already present in", action)
+	data, err := os.ReadFile(output)
+	require.Nil(t, err)
+	require.Equal(t, "192.0.2.1\n", string(data))
+
+	ViperSet("force_add", true)
+	require.Nil(t, s.Close())
+	s = newTestScanner(t)
+	action, err = s.addAddress("192.0.2.1", "", "")
+	require.Nil(t, err)
+	require.Equal(t, "already present in", action)
+	data, err = os.ReadFile(output)
+	require.Nil(t, err)
+	require.Equal(t, "192.0.2.1\n192.0.2.1\n", string(data))
+}
+
+func TestMinBlockDuration(t *testing.T) {
+	initTestConfig(t)
+	ViperSet("timeout", "1s")
+	ViperSet("min_block_duration", "2s")
+	s := newTestScanner(t)
+	require.Nil(t, s.processLine("failed from 192.0.2.1"))
+	time.Sleep(1200 * time.Millisecond)
+	// expired, but added less than min_block_duration ago
+	require.Nil(t, s.expire())
+	requireAddresses(t, s, "192.0.2.1")
+	time.Sleep(1 * time.Second)
+	require.Nil(t, s.expire())
+	requireAddresses(t, s)
+
+	initTestConfig(t)
+	ViperSet("min_block_duration", "10")
+	err := Validate(ViperGetString("address_file"), ViperGetString("timeout_dir"), nil)
+	require.ErrorContains(t, err, "min_block_duration")
+}
+
+func TestClockSkewGrace(t *testing.T) {
+	initTestConfig(t)
+	ViperSet("timeout", "1h")
+	s := newTestScanner(t)
+	require.Nil(t, s.processLine("failed from 192.0.2.1"))
+	filename := filepath.Join(s.TimeoutDir, timeoutFilename("192.0.2.1"))
+	record, err := readTimeoutFile(filename)
+	require.Nil(t, err)
+	// a clock running slightly behind the one that set the expiration
+	record.Expiration = time.Now().Add(time.Second)
+	require.Nil(t, s.writeTimeoutRecord(filename, record))
+	require.Nil(t, s.expire())
+	requireAddresses(t, s, "192.0.2.1")
+	require.Nil(t, s.Close())
+
+	ViperSet("clock_skew_grace", "2s")
+	s = newTestScanner(t)
+	require.Nil(t, s.expire())
+	requireAddresses(t, s)
+
+	initTestConfig(t)
+	ViperSet("clock_skew_grace", "2")
+	err = Validate(ViperGetString("address_file"), ViperGetString("timeout_dir"), nil)
+	require.ErrorContains(t, err, "clock_skew_grace")
+	cfg := DefaultConfig()
+	cfg.AddressFile = ViperGetString("address_file")
+	cfg.TimeoutDir = ViperGetString("timeout_dir")
+	cfg.ClockSkewGrace = -time.Second
+	_, err = NewScannerFromConfig(cfg)
+	require.ErrorContains(t, err, "clock_skew_grace must not be negative")
+}
+
+func TestClockStepBack(t *testing.T) {
+	initTestConfig(t)
+	ViperSet("timeout", "10m")
+	ViperSet("clock_skew_grace", "5s")
+	s := newTestScanner(t)
+	require.Nil(t, s.processLine("failed from 192.0.2.1"))
+	require.Nil(t, s.processLine("failed from 192.0.2.2"))
+	now := time.Now()
+	// written just before the clock was stepped back an hour
+	stepped := filepath.Join(s.TimeoutDir, timeoutFilename("192.0.2.1"))
+	record, err := readTimeoutFile(stepped)
+	require.Nil(t, err)
+	record.FirstSeen = now.Add(-time.Hour)
+	record.Blocked = now.Add(time.Hour)
+	record.LastSeen = now.Add(time.Hour)
+	record.Expiration = now.Add(time.Hour + 10*time.Minute)
+	require.Nil(t, s.writeTimeoutRecord(stepped, record))
+	// written by a clock a few seconds ahead, within clock_skew_grace
+	skewed := filepath.Join(s.TimeoutDir, timeoutFilename("192.0.2.2"))
+	record, err = readTimeoutFile(skewed)
+	require.Nil(t, err)
+	record.LastSeen = now.Add(3 * time.Second)
+	record.Expiration = now.Add(3*time.Second + 10*time.Minute)
+	require.Nil(t, s.writeTimeoutRecord(skewed, record))
+
+	require.Nil(t, s.expire())
+	requireAddresses(t, s, "192.0.2.1", "192.0.2.2")
+	// the stepped record keeps the rest of its timeout instead of an extra hour
+	record, err = readTimeoutFile(stepped)
+	require.Nil(t, err)
+	require.WithinDuration(t, now.Add(10*time.Minute), record.Expiration, 5*time.Second)
+	require.WithinDuration(t, now, record.LastSeen, 5*time.Second)
+	require.WithinDuration(t, now, record.Blocked, 5*time.Second)
+	require.WithinDuration(t, now.Add(-time.Hour), record.FirstSeen, time.Second)
+	record, err = readTimeoutFile(skewed)
+	require.Nil(t, err)
+	require.WithinDuration(t, now.Add(3*time.Second), record.LastSeen, time.Second)
+	require.WithinDuration(t, now.Add(3*time.Second+10*time.Minute), record.Expiration, time.Second)
+
+	// a forward step past the expiration expires the address at the next check
+	record, err = readTimeoutFile(stepped)
+	require.Nil(t, err)
+	record.LastSeen = now.Add(-time.Hour)
+	record.Expiration = now.Add(-time.Hour + 10*time.Minute)
+	require.Nil(t, s.writeTimeoutRecord(stepped, record))
+	require.Nil(t, s.expire())
+	requireAddresses(t, s, "192.0.2.2")
+}
+
+func TestCleanupOnExit(t *testing.T) {
+	dir := initTestConfig(t)
+	output := filepath.Join(dir, "output")
+	script := filepath.Join(dir, "command")
+	require.Nil(t, os.WriteFile(script, []byte("#!/bin/sh\necho \"$1\" >> "+output+"\n"), 0700))
+	ViperSet("delete_command", script)
+	ViperSet("command_workers", 2)
+	stop := func(s *Scanner) {
+		result := make(chan error, 1)
+		go func() {
+			result <- s.Run()
+		}()
+		require.Eventually(t, func() bool {
+			_, ok := s.active.Load("handler")
+			return ok
+		}, 5*time.Second, 10*time.Millisecond)
+		require.Nil(t, syscall.Kill(os.Getpid(), syscall.SIGTERM))
+		select {
+		case err := <-result:
+			require.Nil(t, err)
+		case <-time.After(5 * time.Second):
+			require.Fail(t, "scanner did not stop on SIGTERM")
+		}
+	}
+
+	// by default the watchlist is kept
+	s := newTestScanner(t)
+	require.Nil(t, s.processLine("failed from 192.0.2.1"))
+	require.Nil(t, s.processLine("failed from 192.0.2.2"))
+	stop(s)
+	requireAddresses(t, s, "192.0.2.1", "192.0.2.2")
+	require.NoFileExists(t, output)
+
+	ViperSet("cleanup_on_exit", true)
+	require.Nil(t, s.Close())
+	s = newTestScanner(t)
+	stop(s)
+	requireAddresses(t, s)
+	data, err := os.ReadFile(output)
+	require.Nil(t, err)
+	require.ElementsMatch(t, []string{"192.0.2.1", "192.0.2.2"}, strings.Fields(string(data)))
+	entries, err := os.ReadDir(s.TimeoutDir)
+	require.Nil(t, err)
+	for _, entry := range entries {
+		require.False(t, isTimeoutFile(entry), entry.Name())
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	dir := initTestConfig(t)
+	require.Equal(t, ExitOK, ExitCode(nil))
+	require.Equal(t, ExitRuntime, ExitCode(fmt.Errorf("tail failed")))
+
+	// a rejected configuration
+	ViperSet("timeout", "bogus")
+	_, err := NewScanner(ViperGetString("monitored_file"), ViperGetString("address_file"), ViperGetString("timeout_dir"), nil)
+	require.Equal(t, ExitConfig, ExitCode(err))
+	require.Equal(t, ExitConfig, ExitCode(CheckConfig(ViperGetString("monitored_file"), ViperGetString("address_file"), ViperGetString("timeout_dir"), nil)))
+	ViperSet("timeout", "5s")
+	cfg := DefaultConfig()
+	cfg.AddressFile = ViperGetString("address_file")
+	cfg.TimeoutDir = ViperGetString("timeout_dir")
+	cfg.TickInterval = -time.Second
+	_, err = NewScannerFromConfig(cfg)
+	require.ErrorContains(t, err, "interval must be greater than zero")
+	require.Equal(t, ExitConfig, ExitCode(err))
+	// Run joins the errors of its goroutines; a configuration error among them decides
+	require.Equal(t, ExitConfig, ExitCode(errors.Join(fmt.Errorf("tail failed"), fmt.Errorf("reload: %w", err))))
+
+	// a timeout directory locked by another instance is not a configuration error
+	s := newTestScanner(t)
+	_, err = NewScanner(ViperGetString("monitored_file"), ViperGetString("address_file"), ViperGetString("timeout_dir"), nil)
+	require.NotNil(t, err)
+	require.Equal(t, ExitRuntime, ExitCode(err))
+
+	// a goroutine failing while running
+	ViperSet("control_socket", filepath.Join(dir, "missing", "control.sock"))
+	require.Nil(t, s.Close())
+	s = newTestScanner(t)
+	result := make(chan error, 1)
+	go func() {
+		result <- s.Run()
+	}()
+	select {
+	case err := <-result:
+		require.ErrorContains(t, err, "control:")
+		require.Equal(t, ExitRuntime, ExitCode(err))
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "scanner did not stop when the control socket failed")
+	}
+
+	// stopped by SIGTERM
+	ViperSet("control_socket", "")
+	require.Nil(t, s.Close())
+	s = newTestScanner(t)
+	go func() {
+		result <- s.Run()
+	}()
+	require.Eventually(t, func() bool {
+		_, ok := s.active.Load("handler")
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Nil(t, syscall.Kill(os.Getpid(), syscall.SIGTERM))
+	select {
+	case err := <-result:
+		require.Equal(t, ExitOK, ExitCode(err))
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "scanner did not stop on SIGTERM")
+	}
+}
+
+func TestSyslogProgram(t *testing.T) {
+	for line, program := range map[string]string{
+		"Jan  2 03:04:05 gw sshd[4242]: Invalid user admin from 192.0.2.1":                   "sshd",
+		"Oct 16 12:00:00 gw postfix/smtpd[77]: connect from unknown[192.0.2.2]":              "postfix/smtpd",
+		"<38>Oct 16 12:00:00 gw su: BAD SU from 192.0.2.3":                                   "su",
+		"2026-10-16T12:00:00.123456+00:00 gw nginx[9]: 192.0.2.4 - - \"GET / HTTP/1.1\" 404": "nginx",
+	} {
+		parsed, ok := syslogProgram(line)
+		require.True(t, ok, line)
+		require.Equal(t, program, parsed)
+	}
+	for _, line := range []string{
+		"192.0.2.5 - - [16/Oct/2026:12:00:00 +0000] \"GET / HTTP/1.1\" 404",
+		"failed from 192.0.2.6",
+	} {
+		_, ok := syslogProgram(line)
+		require.False(t, ok, line)
+	}
+}
+
+func TestMatchPrograms(t *testing.T) {
+	initTestConfig(t)
+	ViperSet("match_programs", []string{"sshd", "postfix/smtpd"})
+	s := newTestScanner(t)
+	for _, line := range []string{
+		"Oct 16 12:00:00 gw sshd[4242]: Invalid user admin from 192.0.2.1",
+		"Oct 16 12:00:01 gw named[53]: client 192.0.2.2#53: query refused",
+		"Oct 16 12:00:02 gw postfix/smtpd[77]: connect from unknown[192.0.2.3]",
+		"Oct 16 12:00:03 gw ntpd[123]: peer 192.0.2.4 now valid",
+		// not a syslog line; matched as usual
+		"failed from 192.0.2.5",
+	} {
+		require.Nil(t, s.processLine(line))
+	}
+	requireAddresses(t, s, "192.0.2.1", "192.0.2.3", "192.0.2.5")
+}
+
+func TestMaxAddsPerMinute(t *testing.T) {
+	initTestConfig(t)
+	ViperSet("max_adds_per_minute", 3)
+	var logged syncBuffer
+	writer := log.Writer()
+	defer log.SetOutput(writer)
+	log.SetOutput(&logged)
+	s := newTestScanner(t)
+	for i := 1; i <= 6; i++ {
+		require.Nil(t, s.processLine(fmt.Sprintf("failed from 192.0.2.%d", i)))
+	}
+	requireAddresses(t, s, "192.0.2.1", "192.0.2.2", "192.0.2.3")
+	require.Equal(t, int64(3), s.metrics.throttled.Load())
+	require.Equal(t, int64(3), s.metrics.added.Load())
+	require.Contains(t, logged.String(), "WARNING: more than max_adds_per_minute 3 adds; 192.0.2.4 not added")
+	// only the first throttled add of the burst is logged
+	require.NotContains(t, logged.String(), "192.0.2.5 not added")
+	require.NoFileExists(t, filepath.Join(s.TimeoutDir, timeoutFilename("192.0.2.4")))
+
+	// a throttled address is added by its next match once the bucket refills
+	s.limiter.lock.Lock()
+	s.limiter.last = s.limiter.last.Add(-20 * time.Second)
+	s.limiter.lock.Unlock()
+	require.Nil(t, s.processLine("failed from 192.0.2.4"))
+	requireAddresses(t, s, "192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4")
+	require.Contains(t, logged.String(), "adds resumed under max_adds_per_minute 3 after 3 were throttled")
+}
+
+func TestThrottledAddNotExpired(t *testing.T) {
+	dir := initTestConfig(t)
+	output := filepath.Join(dir, "output")
+	script := filepath.Join(dir, "delete")
+	require.Nil(t, os.WriteFile(script, []byte("#!/bin/sh\necho \"$1\" >> "+output+"\n"), 0700))
+	ViperSet("delete_command", script)
+	ViperSet("history_file", filepath.Join(dir, "history"))
+	ViperSet("max_adds_per_minute", 1)
+	ViperSet("timeout", "1s")
+	s := newTestScanner(t)
+	require.Nil(t, s.processLine("failed from 192.0.2.1"))
+	require.Nil(t, s.processLine("failed from 192.0.2.2"))
+	requireAddresses(t, s, "192.0.2.1")
+	time.Sleep(1100 * time.Millisecond)
+	require.Nil(t, s.expire())
+	requireAddresses(t, s)
+
+	// only the added address runs delete_command and is journalled as expired
+	data, err := os.ReadFile(output)
+	require.Nil(t, err)
+	require.Equal(t, "192.0.2.1\n", string(data))
+	require.Equal(t, int64(1), s.metrics.expired.Load())
+	records, err := ReadHistoryFile(s.HistoryFile)
+	require.Nil(t, err)
+	for _, record := range records {
+		require.Equal(t, "192.0.2.1", record.Address, record.Event)
+	}
+}
+
+func TestStrictBoundaries(t *testing.T) {
+	pattern := regexp.MustCompile(`((?:\d{1,3}\.){3}\d{1,3})`)
+	for line, expected := range map[string][]string{
+		"failed from 192.0.2.1":                  {"192.0.2.1"},
+		"failed from 192.0.2.1.":                 {"192.0.2.1"},
+		"failed from [192.0.2.1]:22":             {"192.0.2.1"},
+		"client=192.0.2.1,port=22":               {"192.0.2.1"},
+		"counter 10.0.0.1234 reached":            {},
+		"running v1.2.3.4build on host":          {},
+		"oid 1.3.6.1.4.1 not found":              {},
+		"serial 10.0.0.1234 then from 192.0.2.7": {"192.0.2.7"},
+	} {
+		captures, err := captureAddresses(pattern, 0, line, 1, true)
+		require.Nil(t, err)
+		require.Equal(t, expected, captures, line)
+	}
+	// without strict_boundaries the embedded substrings are captured
+	captures, err := captureAddresses(pattern, 0, "counter 10.0.0.1234 reached", 1, false)
+	require.Nil(t, err)
+	require.Equal(t, []string{"10.0.0.123"}, captures)
+
+	initTestConfig(t)
+	ViperSet("strict_boundaries", true)
+	s := newTestScanner(t)
+	for _, line := range []string{
+		"counter 10.0.0.1234 reached",
+		"running v1.2.3.4build on host",
+		"failed from 192.0.2.1",
+		// a candidate that is bounded but not an address is rejected by parsing
+		"failed from 192.0.2.300",
+	} {
+		require.Nil(t, s.processLine(line))
+	}
+	requireAddresses(t, s, "192.0.2.1")
+}
+
+func TestInstanceName(t *testing.T) {
+	initTestConfig(t)
+	ViperSet("instance_name", "sshd-guard")
+	var logged syncBuffer
+	writer := log.Writer()
+	flags := log.Flags()
+	prefix := log.Prefix()
+	defer func() {
+		log.SetOutput(writer)
+		log.SetFlags(flags)
+		log.SetPrefix(prefix)
+	}()
+	log.SetOutput(&logged)
+	s := newTestScanner(t)
+	require.Nil(t, s.processLine("failed from 192.0.2.1"))
+	require.Contains(t, logged.String(), "[sshd-guard] scanner: IP 192.0.2.1 added to")
+	for _, line := range strings.Split(strings.TrimSpace(logged.String()), "\n") {
+		require.Contains(t, line, "[sshd-guard] ")
+	}
+
+	recorder := httptest.NewRecorder()
+	s.metricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	require.Contains(t, recorder.Body.String(), "iplsd_addresses_added_total{instance_name=\"sshd-guard\"} 1\n")
+
+	var output bytes.Buffer
+	jsonLog := &jsonLogWriter{out: &output, instance: "sshd-guard"}
+	_, err := jsonLog.Write([]byte("scanner: started\n"))
+	require.Nil(t, err)
+	require.Contains(t, output.String(), `"instance":"sshd-guard"`)
+}
+
+func TestPatternsFile(t *testing.T) {
+	dir := initTestConfig(t)
+	filename := filepath.Join(dir, "patterns")
+	require.Nil(t, os.WriteFile(filename, []byte("# ssh\n  invalid user \\S+ from (\\S+)  \n\n# mail\nauth failed from (\\S+)\n"), 0600))
+	regexes, err := ReadPatternsFile(filename)
+	require.Nil(t, err)
+	require.Equal(t, []string{`invalid user \S+ from (\S+)`, `auth failed from (\S+)`}, regexes)
+
+	ViperSet("patterns_file", filename)
+	s := newTestScanner(t, `refused from (\S+)`)
+	require.Len(t, s.Patterns, 3)
+	require.Nil(t, s.processLine("invalid user admin from 192.0.2.1"))
+	require.Nil(t, s.processLine("refused from 192.0.2.2"))
+	require.Nil(t, s.processLine("relay denied from 192.0.2.3"))
+	requireAddresses(t, s, "192.0.2.1", "192.0.2.2")
+
+	// an edited file is compiled on reload
+	require.Nil(t, os.WriteFile(filename, []byte("relay denied from (\\S+)\n"), 0600))
+	ViperSet("regex", []string{`refused from (\S+)`})
+	require.Nil(t, s.reload())
+	require.Len(t, s.Patterns, 2)
+	require.Nil(t, s.processLine("relay denied from 192.0.2.3"))
+	requireAddresses(t, s, "192.0.2.1", "192.0.2.2", "192.0.2.3")
+
+	// a bad line is reported by number, and a failed reload keeps the current patterns
+	require.Nil(t, os.WriteFile(filename, []byte("# comment\nrelay denied from (\\S+)\nbroken (\n"), 0600))
+	_, err = ReadPatternsFile(filename)
+	require.ErrorContains(t, err, filename+":3: regex does not compile")
+	require.ErrorContains(t, s.reload(), ":3: regex does not compile")
+	require.Len(t, s.Patterns, 2)
+	err = Validate(ViperGetString("address_file"), ViperGetString("timeout_dir"), nil)
+	require.ErrorContains(t, err, ":3: regex does not compile")
+
+	_, err = ReadPatternsFile(filepath.Join(dir, "missing"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestFlushKeepsPendingAdd(t *testing.T) {
+	initTestConfig(t)
+	s := newTestScanner(t)
+	require.Nil(t, s.processLine("failed from 192.0.2.1"))
+	// the released record of an expired address is deleted
+	released := TimeoutRecord{Address: "192.0.2.2", Expiration: time.Now(), Strikes: 1, Released: true}
+	require.Nil(t, s.writeTimeoutRecord(filepath.Join(s.TimeoutDir, timeoutFilename("192.0.2.2")), released))
+	// a concurrent add has written its timeout file but not yet reached the watchlist
+	require.Nil(t, s.writeTimeoutFile("192.0.2.3", ""))
+	removed, err := s.Flush()
+	require.Nil(t, err)
+	require.Equal(t, 1, removed)
+	requireAddresses(t, s)
+	timeouts, err := ReadTimeouts(s.TimeoutDir)
+	require.Nil(t, err)
+	require.Len(t, timeouts, 1)
+	require.Equal(t, "192.0.2.3", timeouts[0].Address)
+}
+
+func TestReadSources(t *testing.T) {
+	initTestConfig(t)
+	defer ViperSet("sources", nil)
+	ViperSet("sources", []any{"/var/log/messages", map[string]any{"file": "/var/log/auth.log", "priority": 10}})
+	sources, err := readSources()
+	require.Nil(t, err)
+	require.Equal(t, []Source{{File: "/var/log/messages"}, {File: "/var/log/auth.log", Priority: 10}}, sources)
+
+	ViperSet("sources", []string{"/var/log/messages"})
+	sources, err = readSources()
+	require.Nil(t, err)
+	require.Equal(t, []Source{{File: "/var/log/messages"}}, sources)
+
+	for expected, entry := range map[string]any{
+		"priority must be an integer": map[string]any{"file": "/var/log/auth.log", "priority": "high"},
+		"missing file":                map[string]any{"priority": 1},
+		"unknown key 'weight'":        map[string]any{"file": "/var/log/auth.log", "weight": 1},
+		"expected a filename":         1,
+	} {
+		ViperSet("sources", []any{entry})
+		_, err = readSources()
+		require.ErrorContains(t, err, expected)
+	}
+	ViperSet("sources", "/var/log/auth.log")
+	_, err = readSources()
+	require.ErrorContains(t, err, "sources must be a list")
+}
+
+func TestSourcePriority(t *testing.T) {
+	initTestConfig(t)
+	s := newTestScanner(t)
+	queue := func(lines ...string) chan string {
+		c := make(chan string, 10)
+		for _, line := range lines {
+			c <- line
+		}
+		return c
+	}
+	auth := &sourceLevel{priority: 10, lines: queue("auth 1", "auth 2")}
+	even := &sourceLevel{priority: 0, lines: queue("even 1")}
+	flood := &sourceLevel{priority: -1, lines: queue("flood 1", "flood 2")}
+	s.sourceLevels = []*sourceLevel{auth, even, flood}
+	monitored := queue("monitored 1")
+	s.tailStdout = monitored
+
+	// a higher priority source is read ahead of the monitored file
+	for _, expected := range []string{"auth 1", "auth 2"} {
+		line, ok := s.prioritySourceLine()
+		require.True(t, ok)
+		require.Equal(t, expected, line)
+	}
+	// priority 0 is left to the scanner's select, and a lower priority waits for it
+	_, ok := s.prioritySourceLine()
+	require.False(t, ok)
+	require.Equal(t, (<-chan string)(even.lines), s.evenSourceLines())
+	<-monitored
+	_, ok = s.prioritySourceLine()
+	require.False(t, ok)
+	<-even.lines
+	line, ok := s.prioritySourceLine()
+	require.True(t, ok)
+	require.Equal(t, "flood 1", line)
+}
+
+func TestSources(t *testing.T) {
+	dir := initTestConfig(t)
+	defer ViperSet("sources", nil)
+	authLog := filepath.Join(dir, "auth.log")
+	appendLine(t, authLog, "startup")
+	ViperSet("sources", []any{map[string]any{"file": authLog, "priority": 10}})
+	s := newTestScanner(t, `failed from ((?:\d{1,3}\.){3}\d{1,3})`)
+	require.Equal(t, []Source{{File: authLog, Priority: 10}}, s.Sources)
+	require.Nil(t, s.Start())
+	require.Len(t, s.sourceLevels, 1)
+	// a source is followed from its end, once its follower has opened it
+	time.Sleep(200 * time.Millisecond)
+	appendLine(t, authLog, "sshd: failed from 192.0.2.1")
+	appendLine(t, ViperGetString("monitored_file"), "httpd: failed from 192.0.2.2")
+	requireAddresses(t, s, "192.0.2.1", "192.0.2.2")
+	require.Nil(t, s.Stop())
+	requireRunExits(t, s)
+}
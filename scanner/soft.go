@@ -0,0 +1,68 @@
+package scanner
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+)
+
+// the part of its timeout an address is blocked before SoftTimeoutCmd runs when soft_timeout_fraction is not set
+const defaultSoftFraction = 0.8
+
+// read soft_timeout_command, run once for an address that has been blocked for soft_timeout_fraction of its timeout
+func readSoftTimeoutCommand() (string, []string, error) {
+	command, args, err := splitCommand(ViperGetString("soft_timeout_command"))
+	if err != nil {
+		return "", nil, fmt.Errorf("soft_timeout_command: %v", err)
+	}
+	err = lookupCommand(command)
+	if err != nil {
+		return "", nil, err
+	}
+	return command, args, nil
+}
+
+// run SoftTimeoutCmd for an active record once less than 1 - SoftTimeoutFrac of its timeout remains.
+// The record is marked in its timeout file before the command is submitted, so the command runs at
+// most once until a match moves the expiration; a failure is only logged.
+func (s *Scanner) softTimeout(record TimeoutRecord, now time.Time) {
+	s.configLock.RLock()
+	command := s.SoftTimeoutCmd
+	args := s.SoftTimeoutArgs
+	s.configLock.RUnlock()
+	if command == "" || record.SoftTimedOut {
+		return
+	}
+	addr := record.Address
+	timeout := s.backoffTimeout(record.Pattern, record.Strikes)
+	remaining := time.Duration(float64(timeout) * (1 - s.SoftTimeoutFrac))
+	if record.Expiration.Sub(now) > remaining {
+		return
+	}
+	if s.DryRun {
+		log.Printf("dry-run: would run soft_timeout_command for %s\n", addr)
+		return
+	}
+	// a match since the reaper read the record starts a new timeout, which is not marked
+	filename := filepath.Join(s.TimeoutDir, timeoutFilename(addr))
+	current, err := readTimeoutFile(filename)
+	if err != nil || !current.Expiration.Equal(record.Expiration) || current.Released {
+		return
+	}
+	current.SoftTimedOut = true
+	err = s.writeTimeoutRecord(filename, current)
+	if err != nil {
+		log.Printf("reaper: failed marking soft timeout for %s: %v\n", addr, err)
+		return
+	}
+	s.event("soft_timeout", fields{"address": addr, "pattern": record.Pattern, "expiration": record.Expiration.Format(time.RFC3339)}, "reaper: soft timeout for %s, expiring %s\n", addr, record.Expiration.Format(time.RFC3339))
+	args = commandArgs(args, []string{addr}, record.Pattern, timeout)
+	env := commandEnv("soft_timeout", []string{addr}, record.Pattern, "", timeout)
+	s.submit(addr, func() {
+		err := s.exec(command, args, env)
+		if err != nil {
+			log.Printf("reaper: soft_timeout_command failed for %s: %v\n", addr, err)
+		}
+	})
+}
@@ -0,0 +1,184 @@
+package scanner
+
+import (
+	"fmt"
+	"log"
+	"slices"
+)
+
+// Sources are log files followed beside the monitored file, each with a priority; the monitored file
+// has priority 0.  The scanner matches a line from the highest priority source with one ready, so a
+// quiet source such as auth.log given a higher priority is matched promptly while a noisy web log
+// floods, and a source with a negative priority is only read while the monitored file and the
+// sources of priority 0 have no lines waiting.  Sources of equal priority share one queue, taking
+// their lines in the order they are read.
+
+// a log file followed beside the monitored file
+type Source struct {
+	File     string
+	Priority int
+}
+
+// the lines of the sources of one priority
+type sourceLevel struct {
+	priority int
+	lines    chan string
+}
+
+// read the sources list, whose entries are a filename or a map setting file and an optional priority
+func readSources() ([]Source, error) {
+	entries := []any{}
+	switch value := ViperGet("sources").(type) {
+	case nil:
+	case []any:
+		entries = value
+	case []string:
+		// set by --sources, which only takes filenames
+		for _, filename := range value {
+			entries = append(entries, filename)
+		}
+	default:
+		return nil, fmt.Errorf("sources must be a list")
+	}
+	sources := []Source{}
+	for i, entry := range entries {
+		switch entry := entry.(type) {
+		case string:
+			sources = append(sources, Source{File: entry})
+		case map[string]any:
+			source := Source{}
+			for key, value := range entry {
+				switch key {
+				case "file":
+					source.File, _ = value.(string)
+				case "priority":
+					priority, ok := value.(int)
+					if !ok {
+						return nil, fmt.Errorf("sources[%d]: priority must be an integer", i)
+					}
+					source.Priority = priority
+				default:
+					return nil, fmt.Errorf("sources[%d]: unknown key '%s'", i, key)
+				}
+			}
+			sources = append(sources, source)
+		default:
+			return nil, fmt.Errorf("sources[%d]: expected a filename or a map", i)
+		}
+		if sources[len(sources)-1].File == "" {
+			return nil, fmt.Errorf("sources[%d]: missing file", i)
+		}
+	}
+	return sources, nil
+}
+
+// follow each source from its end, queueing its lines by priority; called by the scanner before it
+// reads the monitored file
+func (s *Scanner) startSources() {
+	s.shutdownLock.Lock()
+	defer s.shutdownLock.Unlock()
+	if s.shuttingDown() {
+		return
+	}
+	s.sourceReady = make(chan struct{}, 1)
+	levels := make(map[int]*sourceLevel)
+	for _, source := range s.Sources {
+		level, ok := levels[source.Priority]
+		if !ok {
+			level = &sourceLevel{priority: source.Priority, lines: make(chan string, s.LineBuffer)}
+			levels[source.Priority] = level
+			s.sourceLevels = append(s.sourceLevels, level)
+		}
+		f := newFollower(source.File, s.FollowMode == "name", false, s.PollInterval, s.LineBuffer, s.MaxLineLength)
+		f.inotify = s.FollowBackend == "inotify"
+		s.sourceFollows = append(s.sourceFollows, f)
+		s.wg.Add(2)
+		go func() {
+			defer s.wg.Done()
+			f.run()
+		}()
+		go func() {
+			defer s.wg.Done()
+			s.forwardSource(source, f, level)
+		}()
+	}
+	slices.SortFunc(s.sourceLevels, func(a, b *sourceLevel) int {
+		return b.priority - a.priority
+	})
+}
+
+// queue the lines of a source's follower, logging its errors, until it exits or the scanner stops
+func (s *Scanner) forwardSource(source Source, f *follower, level *sourceLevel) {
+	if s.verbose {
+		log.Printf("scanner: following %s at priority %d\n", source.File, source.Priority)
+	}
+	lines := f.lines
+	errors := f.errors
+	for lines != nil || errors != nil {
+		select {
+		case <-s.ctx.Done():
+			return
+		case line, ok := <-errors:
+			if !ok {
+				errors = nil
+				continue
+			}
+			log.Printf("scanner: follower for %s: %s\n", source.File, line)
+		case line, ok := <-lines:
+			if !ok {
+				lines = nil
+				continue
+			}
+			select {
+			case level.lines <- line:
+			case <-s.ctx.Done():
+				return
+			}
+			select {
+			case s.sourceReady <- struct{}{}:
+			default:
+			}
+		}
+	}
+	if !s.shuttingDown() {
+		log.Printf("scanner: follower for %s exited; its lines are no longer read\n", source.File)
+	}
+}
+
+// stop the source followers; caller holds shutdownLock
+func (s *Scanner) stopSources() {
+	for _, f := range s.sourceFollows {
+		f.Stop()
+	}
+}
+
+// the queue of the sources sharing the monitored file's priority, or nil
+func (s *Scanner) evenSourceLines() <-chan string {
+	for _, level := range s.sourceLevels {
+		if level.priority == 0 {
+			return level.lines
+		}
+	}
+	return nil
+}
+
+// take a line from the highest priority source with one ready that outranks the monitored file; a
+// source below it is read only when neither the monitored file nor a source of priority 0 has a line
+// waiting.  Lines of priority 0 are left to the scanner's select, which shares them with the
+// monitored file.
+func (s *Scanner) prioritySourceLine() (string, bool) {
+	for _, level := range s.sourceLevels {
+		if level.priority == 0 {
+			continue
+		}
+		if level.priority < 0 && (len(s.tailStdout) > 0 || len(s.evenSourceLines()) > 0) {
+			return "", false
+		}
+		select {
+		case line := <-level.lines:
+			return line, true
+		default:
+		}
+	}
+	return "", false
+}
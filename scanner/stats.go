@@ -0,0 +1,99 @@
+package scanner
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+)
+
+// match counts for each pattern and for each address since the stats file was started
+type MatchStats struct {
+	Patterns  map[string]int64 `json:"patterns"`
+	Addresses map[string]int64 `json:"addresses"`
+}
+
+func newMatchStats() MatchStats {
+	return MatchStats{
+		Patterns:  make(map[string]int64),
+		Addresses: make(map[string]int64),
+	}
+}
+
+// one entry of a sorted count listing
+type StatCount struct {
+	Key   string `json:"key"`
+	Count int64  `json:"count"`
+}
+
+// return the limit highest counts, highest first; limit zero returns all
+func TopCounts(counts map[string]int64, limit int) []StatCount {
+	top := []StatCount{}
+	for key, count := range counts {
+		top = append(top, StatCount{Key: key, Count: count})
+	}
+	slices.SortFunc(top, func(a, b StatCount) int {
+		if a.Count != b.Count {
+			return cmp.Compare(b.Count, a.Count)
+		}
+		return cmp.Compare(a.Key, b.Key)
+	})
+	if limit > 0 && len(top) > limit {
+		top = top[:limit]
+	}
+	return top
+}
+
+func (s *Scanner) recordMatch(pattern, addr string) {
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+	s.stats.Patterns[pattern]++
+	s.stats.Addresses[addr]++
+}
+
+// return a copy of the match statistics
+func (s *Scanner) Stats() MatchStats {
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+	return MatchStats{
+		Patterns:  maps.Clone(s.stats.Patterns),
+		Addresses: maps.Clone(s.stats.Addresses),
+	}
+}
+
+// persist the match statistics to StatsFile if configured
+func (s *Scanner) writeStats() error {
+	if s.StatsFile == "" || s.DryRun {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.Stats(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed marshalling match stats: %v", err)
+	}
+	return writeFileAtomic(s.StatsFile, append(data, '\n'), 0600, noOwner)
+}
+
+// read the stats file written by a scanner; a missing file has no counts
+func ReadStatsFile(filename string) (MatchStats, error) {
+	stats := newMatchStats()
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return stats, nil
+		}
+		return stats, err
+	}
+	err = json.Unmarshal(data, &stats)
+	if err != nil {
+		return stats, fmt.Errorf("failed parsing stats file '%s': %v", filename, err)
+	}
+	if stats.Patterns == nil {
+		stats.Patterns = make(map[string]int64)
+	}
+	if stats.Addresses == nil {
+		stats.Addresses = make(map[string]int64)
+	}
+	return stats, nil
+}
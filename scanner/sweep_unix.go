@@ -0,0 +1,14 @@
+//go:build !windows
+
+package scanner
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// relay SIGUSR1, which asks the reaper for an immediate sweep, to c
+func notifySweepSignal(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
@@ -0,0 +1,9 @@
+package scanner
+
+import (
+	"os"
+)
+
+// there is no SIGUSR1 on Windows; use the control socket SWEEP command instead
+func notifySweepSignal(c chan<- os.Signal) {
+}
@@ -0,0 +1,29 @@
+package scanner
+
+import (
+	"regexp"
+	"slices"
+)
+
+// a BSD syslog line prefix: an optional <priority>, a traditional or ISO 8601 timestamp, the host,
+// and the program name with an optional [pid], ending in a colon
+var syslogHeader = regexp.MustCompile(`^(?:<\d{1,3}>)?(?:[A-Z][a-z]{2} +\d{1,2} \d\d:\d\d:\d\d|\d{4}-\d\d-\d\dT\S+) +\S+ +([^\s\[:]+)(?:\[\d+\])?: `)
+
+// return the program name from the syslog prefix of line, or false when line has no such prefix
+func syslogProgram(line string) (string, bool) {
+	header := syslogHeader.FindStringSubmatch(line)
+	if header == nil {
+		return "", false
+	}
+	return header[1], true
+}
+
+// false when MatchPrograms is set and line is a syslog line from another program; a line without
+// a syslog prefix is matched as usual
+func (s *Scanner) programSelected(line string) bool {
+	if len(s.MatchPrograms) == 0 {
+		return true
+	}
+	program, ok := syslogProgram(line)
+	return !ok || slices.Contains(s.MatchPrograms, program)
+}
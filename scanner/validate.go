@@ -0,0 +1,131 @@
+package scanner
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// check the configuration before the scanner is built, reporting every problem found rather than only the first
+func Validate(addressFile, timeoutDir string, patterns []string) error {
+	errs := []error{}
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, key := range []string{"timeout", "interval"} {
+		_, err := ConfiguredDuration(key)
+		check(err)
+	}
+	for _, key := range []string{"poll_interval_seconds", "symlink_check_seconds", "retry_max_age_seconds", "timeout_max_seconds", "notify_timeout_seconds"} {
+		check(validateDuration(key, ViperGetString(key), "s"))
+	}
+	for _, key := range []string{"max_line_age", "match_window", "command_retry_delay", "flush_interval", "shutdown_timeout", "startup_grace", "match_budget", "min_block_duration", "clock_skew_grace"} {
+		check(validateDuration(key, ViperGetString(key), ""))
+	}
+
+	addCommand, _, deleteCommand, _, err := parseCommands()
+	check(err)
+	check(lookupCommand(addCommand))
+	check(lookupCommand(deleteCommand))
+	_, _, err = readOnMatchCommand()
+	check(err)
+	_, _, err = readSoftTimeoutCommand()
+	check(err)
+
+	for _, pattern := range patterns {
+		_, err := regexp.Compile(pattern)
+		if err != nil {
+			check(fmt.Errorf("regex '%s' does not compile: %v", pattern, err))
+		}
+	}
+	_, _, err = readPatternRules(nil)
+	check(err)
+	_, err = readSources()
+	check(err)
+
+	table := ViperGetString("pf_table")
+	if table != "" {
+		if !pfSupported {
+			check(fmt.Errorf("pf_table is only supported on OpenBSD"))
+		} else if len(table) >= pfTableNameSize {
+			check(fmt.Errorf("pf_table name '%s' is longer than %d characters", table, pfTableNameSize-1))
+		}
+	}
+
+	_, err = parseFileMode("watchlist_mode", ViperGetString("watchlist_mode"), 0600)
+	check(err)
+	_, err = parseFileMode("timeout_dir_mode", ViperGetString("timeout_dir_mode"), 0700)
+	check(err)
+	_, err = parseFileOwner(ViperGetString("file_owner"))
+	check(err)
+
+	geoipDB := ViperGetString("geoip_db")
+	if geoipDB != "" {
+		_, err := openGeoIP(geoipDB)
+		check(err)
+	}
+	for _, key := range []string{"country_allowlist", "country_blocklist"} {
+		codes := countryCodes(ViperGetStringSlice(key))
+		if len(codes) > 0 && geoipDB == "" {
+			check(fmt.Errorf("%s requires geoip_db", key))
+		}
+		for _, code := range codes {
+			if len(code) != 2 {
+				check(fmt.Errorf("%s: '%s' is not a two letter ISO country code", key, code))
+			}
+		}
+	}
+
+	if !ViperGetBool("dry_run") {
+		check(validateDirectory(timeoutDir))
+		// the watchlist is replaced by renaming a temporary file written beside it
+		if IsDir(addressFile) {
+			check(fmt.Errorf("address file '%s' is a directory", addressFile))
+		} else {
+			check(validateDirectory(filepath.Dir(addressFile)))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n%v", errors.Join(errs...))
+	}
+	return nil
+}
+
+// parse value, if set, as a duration; suffix is appended to values given in seconds
+func validateDuration(key, value, suffix string) error {
+	if value == "" {
+		return nil
+	}
+	_, err := time.ParseDuration(value + suffix)
+	if err != nil {
+		return fmt.Errorf("ParseDuration (%s) failed: %v", key, err)
+	}
+	return nil
+}
+
+// check that files can be created in dir, which is created later if it does not exist yet
+func validateDirectory(dir string) error {
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		return validateDirectory(filepath.Dir(dir))
+	}
+	if err != nil {
+		return fmt.Errorf("cannot use directory '%s': %v", dir, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("'%s' is not a directory", dir)
+	}
+	file, err := os.CreateTemp(dir, ".iplsd.*")
+	if err != nil {
+		return fmt.Errorf("directory '%s' is not writable: %v", dir, err)
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
@@ -0,0 +1,146 @@
+package scanner
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"time"
+)
+
+// replaced by tests to count reads of the address file
+var readWatchlist = readWatchlistFile
+
+// the entries of an address file, its # comment lines, and the # annotation of each annotated entry
+type watchlistFile struct {
+	addrs    []string
+	comments []string
+	notes    map[string]string
+}
+
+// the address file as last read or written; adds and removes use it instead of re-reading the file
+type watchlistCache struct {
+	watchlistFile
+	set  map[string]bool
+	info os.FileInfo
+}
+
+// true when the file described by info is unchanged since cached was taken
+func unchanged(cached, info os.FileInfo) bool {
+	return cached != nil && os.SameFile(cached, info) && cached.Size() == info.Size() && cached.ModTime().Equal(info.ModTime())
+}
+
+// return the watchlist, reading the address file only when it has been replaced or modified since
+// it was last read or written; caller holds addressLock and must not modify the result
+func (s *Scanner) loadWatchlist() (*watchlistCache, error) {
+	info, err := os.Stat(s.AddressFile)
+	if os.IsNotExist(err) && !s.DryRun {
+		return s.recreateWatchlist()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if unchanged(s.watchlist.info, info) {
+		return &s.watchlist, nil
+	}
+	file, err := readWatchlist(s.AddressFile)
+	if err != nil {
+		return nil, err
+	}
+	if s.watchlist.info != nil {
+		s.externalChange(file.addrs)
+	}
+	s.cacheWatchlist(*file, info)
+	return &s.watchlist, nil
+}
+
+// log an edit of the address file made outside the scanner; the next add or remove is applied to
+// the file as edited, so the edit is kept. caller holds addressLock
+func (s *Scanner) externalChange(addrs []string) {
+	current := make(map[string]bool, len(addrs))
+	added := 0
+	for _, addr := range addrs {
+		current[addr] = true
+		if !s.watchlist.set[addr] {
+			added++
+		}
+	}
+	removed := 0
+	for _, addr := range s.watchlist.addrs {
+		if !current[addr] {
+			removed++
+			delete(s.present, addr)
+		}
+	}
+	s.event("reload", fields{"added": added, "removed": removed}, "scanner: %s changed externally; reloaded %d entries, %d added and %d removed\n", s.AddressFile, len(addrs), added, removed)
+}
+
+// write the last known watchlist, or an empty one, when the address file has been deleted;
+// caller holds addressLock
+func (s *Scanner) recreateWatchlist() (*watchlistCache, error) {
+	addrs := slices.Clone(s.watchlist.addrs)
+	s.event("recreate", fields{"entries": len(addrs)}, "scanner: %s is missing; recreating it with the %d entries last written\n", s.AddressFile, len(addrs))
+	err := s.saveWatchlist(addrs)
+	if err != nil {
+		return nil, err
+	}
+	return &s.watchlist, nil
+}
+
+// write addrs to the address file, with the cached comments and annotations, and cache them;
+// caller holds addressLock
+func (s *Scanner) saveWatchlist(addrs []string) error {
+	addrs = sortAddresses(addrs)
+	notes := make(map[string]string)
+	for _, addr := range addrs {
+		if note, ok := s.watchlist.notes[addr]; ok {
+			notes[addr] = note
+		}
+	}
+	err := s.writeAddressFile(addrs, s.watchlist.comments, notes)
+	if err != nil {
+		// the file may or may not have been replaced; read it again next time
+		s.watchlist.info = nil
+		return err
+	}
+	info, err := os.Stat(s.AddressFile)
+	if err != nil {
+		s.watchlist.info = nil
+		return err
+	}
+	s.cacheWatchlist(watchlistFile{addrs: addrs, comments: s.watchlist.comments, notes: notes}, info)
+	return nil
+}
+
+func (s *Scanner) cacheWatchlist(file watchlistFile, info os.FileInfo) {
+	set := make(map[string]bool, len(file.addrs))
+	for _, addr := range file.addrs {
+		set[addr] = true
+	}
+	s.watchlist = watchlistCache{watchlistFile: file, set: set, info: info}
+}
+
+// return a copy of the watchlist entries, sorted
+func (s *Scanner) readAddressFile() ([]string, error) {
+	s.addressLock.Lock()
+	defer s.addressLock.Unlock()
+	watchlist, err := s.loadWatchlist()
+	if err != nil {
+		return []string{}, err
+	}
+	return slices.Clone(watchlist.addrs), nil
+}
+
+// with AnnotateList set, note when and by which pattern addr was added; caller holds addressLock
+func (s *Scanner) annotate(addr, pattern string) {
+	if !s.AnnotateList {
+		return
+	}
+	note := "added " + time.Now().Format(time.RFC3339)
+	if pattern != "" {
+		note += fmt.Sprintf(" by '%s'", pattern)
+	}
+	if s.watchlist.notes == nil {
+		s.watchlist.notes = make(map[string]string)
+	}
+	s.watchlist.notes[addr] = note
+}